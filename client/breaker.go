@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets every connection attempt through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails attempts straight away until the cool-down ends.
+	CircuitOpen
+	// CircuitHalfOpen lets a single trial attempt through; its outcome
+	// closes or reopens the circuit.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// ErrCircuitOpen is returned by Dial while the Dialer's circuit breaker is
+// open.
+var ErrCircuitOpen = errors.New("Circuit breaker open")
+
+// CircuitBreaker stops a Dialer from hammering a server that keeps failing.
+// Once Failures consecutive connection attempts have failed within Window,
+// the circuit opens and attempts fail with ErrCircuitOpen, without touching
+// the network, for Cooldown. After that one trial attempt is let through:
+// success closes the circuit, failure opens it for another Cooldown. One
+// breaker may be shared by several Dialers aimed at the same server.
+type CircuitBreaker struct {
+	// Failures is the number of consecutive failures that opens the
+	// circuit; a Failures below one is treated as one. Failures further
+	// apart than Window start a new count; zero Window counts
+	// consecutive failures however far apart.
+	Failures int
+	Window   time.Duration
+	Cooldown time.Duration
+
+	// OnStateChange, if set, is called on every transition. It runs
+	// synchronously on the dialing goroutine.
+	OnStateChange func(from, to CircuitState)
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	first    time.Time // first failure of the current count
+	opened   time.Time
+	trial    bool // a half-open trial is in progress
+}
+
+// State returns the breaker's current state.
+func (b *CircuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// allow reports with ErrCircuitOpen whether an attempt may not be made
+// now, moving an open circuit whose cool-down has ended to half-open.
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	from := b.state
+	var err error
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.opened) < b.Cooldown {
+			err = ErrCircuitOpen
+			break
+		}
+		b.state = CircuitHalfOpen
+		b.trial = true
+	case CircuitHalfOpen:
+		if b.trial {
+			err = ErrCircuitOpen
+		}
+		b.trial = true
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.changed(from, to)
+	return err
+}
+
+// record updates the breaker with the outcome of an attempt that allow
+// let through.
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	from := b.state
+	now := time.Now()
+	switch {
+	case err == nil:
+		b.state = CircuitClosed
+		b.failures = 0
+	case b.state == CircuitHalfOpen:
+		b.state = CircuitOpen
+		b.opened = now
+	default:
+		if b.failures == 0 || b.Window > 0 && now.Sub(b.first) > b.Window {
+			b.failures = 0
+			b.first = now
+		}
+		b.failures++
+		if b.failures >= max(b.Failures, 1) {
+			b.state = CircuitOpen
+			b.opened = now
+			b.failures = 0
+		}
+	}
+	b.trial = false
+	to := b.state
+	b.mu.Unlock()
+	b.changed(from, to)
+}
+
+// changed calls OnStateChange if the state did change.
+func (b *CircuitBreaker) changed(from, to CircuitState) {
+	if from != to && b.OnStateChange != nil {
+		b.OnStateChange(from, to)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// transitionRecorder collects a CircuitBreaker's state changes.
+type transitionRecorder struct {
+	mu   sync.Mutex
+	seen []string
+}
+
+func (r *transitionRecorder) record(from, to CircuitState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen = append(r.seen, fmt.Sprintf("%v->%v", from, to))
+}
+
+func (r *transitionRecorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return fmt.Sprint(r.seen)
+}
+
+func TestDialerCircuitBreaker(t *testing.T) {
+	// A port nothing listens on, so every attempt is refused.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen error:", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	var transitions transitionRecorder
+	b := &CircuitBreaker{
+		Failures:      3,
+		Window:        time.Minute,
+		Cooldown:      50 * time.Millisecond,
+		OnStateChange: transitions.record,
+	}
+	d := &Dialer{ReconnectAttempts: 10, Breaker: b}
+
+	// Three failed attempts open the circuit and end the retries.
+	if _, err := d.Dial("ws://" + addr + "/ws"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Dial error = %v, want ErrCircuitOpen", err)
+	}
+	if got := b.State(); got != CircuitOpen {
+		t.Errorf("State() = %v, want %v", got, CircuitOpen)
+	}
+
+	// While open, Dial fails without waiting for any retries.
+	start := time.Now()
+	if _, err := d.Dial("ws://" + addr + "/ws"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Dial error = %v, want ErrCircuitOpen", err)
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("Dial with the circuit open took %v", elapsed)
+	}
+
+	// After the cool-down a single trial is made; it fails and reopens
+	// the circuit.
+	time.Sleep(60 * time.Millisecond)
+	d.ReconnectAttempts = 0
+	if _, err := d.Dial("ws://" + addr + "/ws"); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Dial error = %v, want the trial's connection error", err)
+	}
+	want := "[closed->open open->half-open half-open->open]"
+	if got := transitions.String(); got != want {
+		t.Errorf("Transitions = %s, want %s", got, want)
+	}
+}
+
+func TestCircuitBreakerStates(t *testing.T) {
+	var transitions transitionRecorder
+	b := &CircuitBreaker{Failures: 2, Cooldown: 20 * time.Millisecond, OnStateChange: transitions.record}
+	failure := errors.New("refused")
+
+	// A success in between resets the count.
+	b.record(failure)
+	b.record(nil)
+	b.record(failure)
+	if got := b.State(); got != CircuitClosed {
+		t.Fatalf("State() = %v after non-consecutive failures, want %v", got, CircuitClosed)
+	}
+	b.record(failure)
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("allow() error = %v, want ErrCircuitOpen", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := b.allow(); err != nil {
+		t.Fatal("allow() after the cool-down error:", err)
+	}
+	if got := b.State(); got != CircuitHalfOpen {
+		t.Errorf("State() = %v, want %v", got, CircuitHalfOpen)
+	}
+	// Only one trial at a time.
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Second allow() while half-open error = %v, want ErrCircuitOpen", err)
+	}
+	b.record(nil)
+
+	want := "[closed->open open->half-open half-open->closed]"
+	if got := transitions.String(); got != want {
+		t.Errorf("Transitions = %s, want %s", got, want)
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	b := &CircuitBreaker{Failures: 2, Window: 10 * time.Millisecond, Cooldown: time.Minute}
+	failure := errors.New("refused")
+
+	b.record(failure)
+	time.Sleep(20 * time.Millisecond)
+	b.record(failure)
+	if got := b.State(); got != CircuitClosed {
+		t.Errorf("State() = %v after failures outside the window, want %v", got, CircuitClosed)
+	}
+	b.record(failure)
+	if got := b.State(); got != CircuitOpen {
+		t.Errorf("State() = %v, want %v", got, CircuitOpen)
+	}
+}
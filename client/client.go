@@ -1,72 +1,37 @@
 package main
 
 import (
-	"bufio"
-	"crypto/rand"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
-	"net"
-	"net/url"
 	"os"
-	"strings"
 )
 
 func main() {
-	serverURL := "ws://localhost:8080/ws"
-	u, err := url.Parse(serverURL)
-	if err != nil {
-		log.Fatal("URL parse error:", err)
+	if err := run("ws://localhost:8080/ws", "received_message.json"); err != nil {
+		log.Fatal(err)
 	}
+}
 
-	conn, err := net.Dial("tcp", u.Host)
+// run connects to serverURL, reads a single text message and saves it as
+// JSON to outPath.
+func run(serverURL, outPath string) error {
+	conn, err := DefaultDialer.Dial(serverURL)
 	if err != nil {
-		log.Fatal("Dial error:", err)
+		return err
 	}
 	defer conn.Close()
 
-	key := make([]byte, 16)
-	if _, err := rand.Read(key); err != nil {
-		log.Fatal("Key generation error:", err)
-	}
-	secWebSocketKey := base64.StdEncoding.EncodeToString(key)
-
-	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\n", u.RequestURI())
-	fmt.Fprintf(conn, "Host: %s\r\n", u.Host)
-	fmt.Fprintf(conn, "Upgrade: websocket\r\n")
-	fmt.Fprintf(conn, "Connection: Upgrade\r\n")
-	fmt.Fprintf(conn, "Sec-WebSocket-Key: %s\r\n", secWebSocketKey)
-	fmt.Fprintf(conn, "Sec-WebSocket-Version: 13\r\n")
-	fmt.Fprintf(conn, "Origin: http://localhost:8080\r\n")
-	fmt.Fprintf(conn, "\r\n")
-
-	reader := bufio.NewReader(conn)
-
-	status, err := reader.ReadString('\n')
-	if err != nil {
-		log.Fatal("Error reading status line:", err)
-	}
-	if !strings.Contains(status, "101") {
-		log.Fatal("Did not receive 101 Switching Protocols")
-	}
-
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			log.Fatal("Error reading headers:", err)
-		}
-		if line == "\r\n" {
-			break
-		}
-	}
-
 	log.Println("Connected to server")
 
-	message, err := readTextMessage(reader)
+	received, err := conn.ReadMessage()
 	if err != nil {
-		log.Fatal("Error reading message:", err)
+		return fmt.Errorf("Error reading message: %w", err)
 	}
+	if received.Opcode != OpText {
+		return fmt.Errorf("Expected a text message, got opcode %#x", received.Opcode)
+	}
+	message := string(received.Data)
 
 	// Create JSON structure to hold the received message
 	msg := struct {
@@ -78,42 +43,14 @@ func main() {
 	// Marshal the message into JSON format with indentation
 	jsonData, err := json.MarshalIndent(msg, "", "  ")
 	if err != nil {
-		log.Fatal("JSON marshaling error:", err)
+		return fmt.Errorf("JSON marshaling error: %w", err)
 	}
 
 	// Write the JSON to a file
-	if err := os.WriteFile("received_message.json", jsonData, 0644); err != nil {
-		log.Fatal("Error writing to file:", err)
-	}
-
-	log.Println("Received message saved to received_message.json")
-}
-
-func readTextMessage(r *bufio.Reader) (string, error) {
-	header := make([]byte, 2)
-	if _, err := r.Read(header); err != nil {
-		return "", err
-	}
-
-	fin := header[0]&0x80 != 0
-	opcode := header[0] & 0x0F
-	masked := header[1]&0x80 != 0
-	payloadLen := int(header[1] & 0x7F)
-
-	if !fin {
-		return "", fmt.Errorf("Continuation frames are not supported")
-	}
-	if opcode != 0x1 {
-		return "", fmt.Errorf("Only text frames are supported")
-	}
-	if masked {
-		return "", fmt.Errorf("Server frames should not be masked")
-	}
-
-	payload := make([]byte, payloadLen)
-	if _, err := r.Read(payload); err != nil {
-		return "", err
+	if err := os.WriteFile(outPath, jsonData, 0644); err != nil {
+		return fmt.Errorf("Error writing to file: %w", err)
 	}
 
-	return string(payload), nil
+	log.Println("Received message saved to", outPath)
+	return nil
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+)
+
+// deflateOffer is the Sec-WebSocket-Extensions offer sent by
+// WithCompression. Both directions run without context takeover, so every
+// message is compressed independently.
+const deflateOffer = "permessage-deflate; client_no_context_takeover; server_no_context_takeover"
+
+// deflateTail is the empty stored block that ends every flushed deflate
+// stream; RFC 7692 removes it from the wire.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// compressMessage deflates a whole message payload for a frame with RSV1 set.
+func compressMessage(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail), nil
+}
+
+// finalBlock is an empty final stored block. Appending it after the
+// restored tail lets the flate reader end cleanly instead of reporting an
+// unexpected EOF.
+var finalBlock = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+// decompressMessage inflates the payload of a message received with RSV1
+// set. An inflated message longer than limit bytes fails with
+// ErrMessageTooLarge as soon as the excess is read; zero means no limit.
+func decompressMessage(data []byte, limit int64) ([]byte, error) {
+	fr := flate.NewReader(io.MultiReader(
+		bytes.NewReader(data),
+		bytes.NewReader(deflateTail),
+		bytes.NewReader(finalBlock),
+	))
+	defer fr.Close()
+	if limit <= 0 {
+		return io.ReadAll(fr)
+	}
+	out, err := io.ReadAll(io.LimitReader(fr, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, ErrMessageTooLarge
+	}
+	return out, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDialCompressionAccepted(t *testing.T) {
+	message := strings.Repeat("compress me ", 50)
+	offers := make(chan string, 1)
+	received := make(chan Frame, 1)
+	addr := startRequestMockServer(t, func(conn net.Conn, br *bufio.Reader, req *http.Request) {
+		offers <- req.Header.Get("Sec-WebSocket-Extensions")
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + computeAcceptKey(req.Header.Get("Sec-WebSocket-Key")) + "\r\n" +
+			"Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n" +
+			"\r\n"))
+
+		compressed, _ := compressMessage([]byte(message))
+		bw := bufio.NewWriter(conn)
+		writeFrame(bw, Frame{Fin: true, Rsv1: true, Opcode: OpText, Payload: compressed})
+		bw.Flush()
+
+		f, _, _ := readFrame(br)
+		received <- f
+	})
+
+	conn, err := Dial("ws://"+addr+"/ws", WithCompression())
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+
+	if got := <-offers; got != deflateOffer {
+		t.Errorf("Sec-WebSocket-Extensions offer = %q, want %q", got, deflateOffer)
+	}
+
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal("ReadMessage() error:", err)
+	}
+	if string(msg.Data) != message {
+		t.Errorf("ReadMessage() = %q, want %q", msg.Data, message)
+	}
+
+	if err := conn.WriteMessage(OpText, []byte(message)); err != nil {
+		t.Fatal("WriteMessage() error:", err)
+	}
+	f := <-received
+	if !f.Rsv1 || len(f.Payload) >= len(message) {
+		t.Fatalf("Client frame rsv1 = %v, %d bytes, want compressed", f.Rsv1, len(f.Payload))
+	}
+	if data, err := decompressMessage(f.Payload, 0); err != nil || string(data) != message {
+		t.Errorf("decompressMessage() = %q, %v, want %q", data, err, message)
+	}
+}
+
+func TestDialCompressionDeclined(t *testing.T) {
+	received := make(chan Frame, 1)
+	addr := startRequestMockServer(t, func(conn net.Conn, br *bufio.Reader, req *http.Request) {
+		writeSwitchingProtocols(conn)
+		f, _, _ := readFrame(br)
+		received <- f
+	})
+
+	conn, err := Dial("ws://"+addr+"/ws", WithCompression())
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(OpText, []byte("plain")); err != nil {
+		t.Fatal("WriteMessage() error:", err)
+	}
+	if f := <-received; f.Rsv1 || string(f.Payload) != "plain" {
+		t.Errorf("Client frame rsv1 = %v, payload %q, want uncompressed %q", f.Rsv1, f.Payload, "plain")
+	}
+}
+
+func TestDialUnofferedExtension(t *testing.T) {
+	addr := startMockServer(t, func(conn net.Conn) {
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + acceptFor(conn) + "\r\n" +
+			"Sec-WebSocket-Extensions: permessage-deflate\r\n" +
+			"\r\n"))
+	})
+
+	if _, err := Dial("ws://" + addr + "/ws"); err == nil {
+		t.Error("Dial succeeded although the server accepted an extension that was not offered")
+	}
+}
+
+func TestReadCompressedMessageLimit(t *testing.T) {
+	// 64MB of zeros deflate to well under 100KB.
+	bomb, err := compressMessage(make([]byte, 64<<20))
+	if err != nil {
+		t.Fatal("compressMessage() error:", err)
+	}
+	closes := make(chan Frame, 1)
+	addr := startRequestMockServer(t, func(conn net.Conn, br *bufio.Reader, req *http.Request) {
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + computeAcceptKey(req.Header.Get("Sec-WebSocket-Key")) + "\r\n" +
+			"Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n" +
+			"\r\n"))
+		bw := bufio.NewWriter(conn)
+		writeFrame(bw, Frame{Fin: true, Rsv1: true, Opcode: OpBinary, Payload: bomb})
+		bw.Flush()
+
+		f, _, _ := readFrame(br)
+		closes <- f
+	})
+
+	conn, err := Dial("ws://"+addr+"/ws", WithCompression())
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+	conn.MaxMessageSize = 1 << 20
+
+	if _, err := conn.ReadMessage(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("ReadMessage() error = %v, want ErrMessageTooLarge", err)
+	}
+	f := <-closes
+	if f.Opcode != OpClose || len(f.Payload) < 2 || binary.BigEndian.Uint16(f.Payload) != CloseMessageTooBig {
+		t.Errorf("Got frame %#x %v, want a close with %d", f.Opcode, f.Payload, CloseMessageTooBig)
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Conn is a client-side WebSocket connection returned by Dial.
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	// readMu is held while frames are read from br, so that Close can
+	// drain the connection without racing a concurrent ReadMessage.
+	readMu sync.Mutex
+
+	// writeMu serializes frames written to bw and guards closeSent.
+	writeMu   sync.Mutex
+	bw        *bufio.Writer
+	closeSent bool
+
+	// compress is set when the server accepted permessage-deflate.
+	compress bool
+
+	// subprotocol is the Sec-WebSocket-Protocol the server selected.
+	subprotocol string
+
+	// messageType is the opcode Send uses, from the Dialer's
+	// SubprotocolMessageTypes.
+	messageType byte
+
+	// peerClose is the close frame received from the server, returned
+	// again by every read after it.
+	peerClose atomic.Pointer[CloseError]
+
+	// lastPong is the time the last pong arrived, in Unix nanoseconds.
+	lastPong atomic.Int64
+
+	// Transfer counters, read through BytesSent and friends.
+	bytesSent        atomic.Int64
+	bytesReceived    atomic.Int64
+	messagesSent     atomic.Int64
+	messagesReceived atomic.Int64
+
+	// done is closed by Close to stop the keepalive goroutine.
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// CloseGracePeriod bounds how long Close waits for the server to
+	// answer its close frame and close the TCP connection.
+	CloseGracePeriod time.Duration
+
+	// MaxMessageSize bounds the size of a compressed message once
+	// inflated, so a small payload cannot expand without limit. A message
+	// inflating past it fails with ErrMessageTooLarge and the connection
+	// is closed with 1009. Zero means no limit.
+	MaxMessageSize int64
+
+	// MessageID, if set, extracts an application-level ID from each data
+	// message. ReadMessage drops a message whose ID is among the last
+	// DedupSize IDs seen (DefaultDedupSize if zero), which filters the
+	// resends of at-least-once delivery. Messages for which MessageID
+	// reports false are always delivered.
+	MessageID func(Message) (id string, ok bool)
+	DedupSize int
+
+	// seenMu guards seen, which concurrent ReadMessage calls consult
+	// outside readMu.
+	seenMu sync.Mutex
+	seen   *idCache
+}
+
+// Close status codes defined by RFC 6455 section 7.4.1 and the IANA
+// registry.
+const (
+	CloseNormalClosure    uint16 = 1000
+	CloseGoingAway        uint16 = 1001
+	CloseProtocolError    uint16 = 1002
+	CloseNoStatusReceived uint16 = 1005
+	ClosePolicyViolation  uint16 = 1008
+	CloseMessageTooBig    uint16 = 1009
+	CloseServiceRestart   uint16 = 1012
+	CloseTryAgainLater    uint16 = 1013
+)
+
+// Message is a complete data message read from or written to a Conn.
+type Message struct {
+	Opcode byte
+	Data   []byte
+}
+
+// CloseError is returned by ReadMessage when the server sends a close frame.
+type CloseError struct {
+	Code uint16
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("Connection closed with code %d: %s", e.Code, e.Text)
+}
+
+// Initial values of Conn.CloseGracePeriod and Conn.MaxMessageSize.
+const (
+	DefaultCloseGracePeriod = time.Second
+	DefaultMaxMessageSize   = 32 << 20
+)
+
+// ErrMessageTooLarge is returned by ReadMessage for a compressed message
+// that inflates past MaxMessageSize.
+var ErrMessageTooLarge = errors.New("Message too large")
+
+func newConn(conn net.Conn, br *bufio.Reader) *Conn {
+	return &Conn{
+		conn:             conn,
+		br:               br,
+		bw:               bufio.NewWriter(conn),
+		messageType:      OpText,
+		done:             make(chan struct{}),
+		CloseGracePeriod: DefaultCloseGracePeriod,
+		MaxMessageSize:   DefaultMaxMessageSize,
+	}
+}
+
+// WriteMessage sends data as a single masked frame with the given data
+// opcode (OpText or OpBinary).
+func (c *Conn) WriteMessage(opcode byte, data []byte) error {
+	f := Frame{Fin: true, Opcode: opcode, Payload: data}
+	if c.compress {
+		compressed, err := compressMessage(data)
+		if err != nil {
+			return err
+		}
+		f.Payload = compressed
+		f.Rsv1 = true
+	}
+	if err := c.writeFrame(f); err != nil {
+		return err
+	}
+	c.messagesSent.Add(1)
+	return nil
+}
+
+// BytesSent returns the number of on-the-wire frame bytes written so far.
+func (c *Conn) BytesSent() int64 { return c.bytesSent.Load() }
+
+// BytesReceived returns the number of on-the-wire frame bytes read so far.
+func (c *Conn) BytesReceived() int64 { return c.bytesReceived.Load() }
+
+// MessagesSent returns the number of data messages written so far.
+func (c *Conn) MessagesSent() int64 { return c.messagesSent.Load() }
+
+// MessagesReceived returns the number of complete data messages read so far.
+func (c *Conn) MessagesReceived() int64 { return c.messagesReceived.Load() }
+
+// ErrInvalidUTF8 is returned by WriteText for text that is not valid UTF-8,
+// which RFC 6455 requires of every text message.
+var ErrInvalidUTF8 = errors.New("Text message is not valid UTF-8")
+
+// WriteText sends s as a text message, refusing invalid UTF-8.
+func (c *Conn) WriteText(s string) error {
+	if !utf8.ValidString(s) {
+		return ErrInvalidUTF8
+	}
+	return c.WriteMessage(OpText, []byte(s))
+}
+
+// WriteBinary sends b as a binary message.
+func (c *Conn) WriteBinary(b []byte) error {
+	return c.WriteMessage(OpBinary, b)
+}
+
+// Send sends data as a message of the type the negotiated subprotocol
+// calls for, as configured by Dialer.SubprotocolMessageTypes, or as text if
+// the subprotocol has no type configured. Text is checked as by WriteText.
+func (c *Conn) Send(data []byte) error {
+	if c.messageType == OpText && !utf8.Valid(data) {
+		return ErrInvalidUTF8
+	}
+	return c.WriteMessage(c.messageType, data)
+}
+
+// MessageType returns the message type Send uses.
+func (c *Conn) MessageType() byte {
+	return c.messageType
+}
+
+// ErrControlTooLarge is returned by Ping and Pong for a payload longer than
+// the 125 bytes RFC 6455 allows in a control frame.
+var ErrControlTooLarge = errors.New("Control frame payload exceeds 125 bytes")
+
+// Ping sends a ping carrying data, which may be arbitrary binary up to 125
+// bytes. A conforming peer echoes it unchanged in its pong.
+func (c *Conn) Ping(data []byte) error {
+	return c.writeControl(OpPing, data)
+}
+
+// Pong sends an unsolicited pong carrying data, which may be arbitrary
+// binary up to 125 bytes. Pings are already answered by ReadMessage.
+func (c *Conn) Pong(data []byte) error {
+	return c.writeControl(OpPong, data)
+}
+
+// writeControl writes a ping or pong after checking its payload length.
+func (c *Conn) writeControl(opcode byte, data []byte) error {
+	if len(data) > maxControlPayload {
+		return ErrControlTooLarge
+	}
+	return c.writeFrame(Frame{Fin: true, Opcode: opcode, Payload: data})
+}
+
+// ErrCloseSent is returned when writing a data message after a close
+// frame has been sent, which RFC 6455 section 5.5.1 forbids.
+var ErrCloseSent = errors.New("Close frame already sent")
+
+// writeFrame masks, writes and flushes a single frame. Data frames are
+// refused with ErrCloseSent once a close frame has been sent.
+func (c *Conn) writeFrame(f Frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent && !isControl(f.Opcode) {
+		return ErrCloseSent
+	}
+	return c.writeFrameLocked(f)
+}
+
+// writeFrameLocked is writeFrame for callers holding writeMu.
+func (c *Conn) writeFrameLocked(f Frame) error {
+	f.Masked = true
+	n, err := writeFrame(c.bw, f)
+	c.bytesSent.Add(int64(n))
+	if err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+// ReadMessage reads the next complete data message, reassembling fragmented
+// messages. Pings are answered automatically and pongs are discarded. When
+// the server sends a close frame it is echoed and a *CloseError returned,
+// and every later call returns the same error without reading further.
+// Duplicates are skipped if MessageID is set.
+func (c *Conn) ReadMessage() (Message, error) {
+	for {
+		msg, err := c.readMessage()
+		if err != nil || !c.duplicate(msg) {
+			return msg, err
+		}
+	}
+}
+
+func (c *Conn) readMessage() (Message, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if closeErr := c.peerClose.Load(); closeErr != nil {
+		return Message{}, closeErr
+	}
+	var msg Message
+	var rsv1 bool
+	for {
+		f, n, err := readFrame(c.br)
+		c.bytesReceived.Add(int64(n))
+		if err != nil {
+			return Message{}, err
+		}
+		if f.Masked {
+			return Message{}, fmt.Errorf("Server frames should not be masked")
+		}
+		if f.Rsv1 && (!c.compress || f.Opcode != OpText && f.Opcode != OpBinary) {
+			return Message{}, fmt.Errorf("Unexpected RSV1 bit")
+		}
+		// Only data frames may be fragmented.
+		if isControl(f.Opcode) && !f.Fin {
+			c.sendClose(CloseProtocolError)
+			return Message{}, fmt.Errorf("Fragmented control frame")
+		}
+
+		switch f.Opcode {
+		case OpPing:
+			// The pong echoes the ping payload byte for byte.
+			if err := c.writeFrame(Frame{Fin: true, Opcode: OpPong, Payload: f.Payload}); err != nil {
+				return Message{}, err
+			}
+			continue
+		case OpPong:
+			c.lastPong.Store(time.Now().UnixNano())
+			continue
+		case OpClose:
+			closeErr, err := parseClosePayload(f.Payload)
+			if err != nil {
+				c.sendClose(CloseProtocolError)
+				return Message{}, err
+			}
+			c.peerClose.Store(closeErr)
+			c.sendClose(closeErr.Code)
+			return Message{}, closeErr
+		case OpContinuation:
+			if msg.Opcode == 0 {
+				return Message{}, fmt.Errorf("Unexpected continuation frame")
+			}
+			msg.Data = append(msg.Data, f.Payload...)
+		case OpText, OpBinary:
+			if msg.Opcode != 0 {
+				return Message{}, fmt.Errorf("Expected continuation frame")
+			}
+			msg.Opcode = f.Opcode
+			msg.Data = f.Payload
+			rsv1 = f.Rsv1
+		default:
+			return Message{}, fmt.Errorf("Unknown opcode %#x", f.Opcode)
+		}
+
+		if f.Fin {
+			if rsv1 {
+				data, err := decompressMessage(msg.Data, c.MaxMessageSize)
+				if errors.Is(err, ErrMessageTooLarge) {
+					c.sendClose(CloseMessageTooBig)
+					return Message{}, err
+				}
+				if err != nil {
+					return Message{}, err
+				}
+				msg.Data = data
+			}
+			c.messagesReceived.Add(1)
+			return msg, nil
+		}
+	}
+}
+
+// sendClose writes a close frame with code unless one was already sent.
+// CloseNoStatusReceived is sent as an empty payload. The frame is written
+// under writeMu together with setting closeSent, so no data frame can
+// follow it onto the wire.
+func (c *Conn) sendClose(code uint16) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+
+	var payload []byte
+	if code != CloseNoStatusReceived {
+		payload = binary.BigEndian.AppendUint16(nil, code)
+	}
+	return c.writeFrameLocked(Frame{Fin: true, Opcode: OpClose, Payload: payload})
+}
+
+// parseClosePayload decodes the body of a close frame. An empty body means
+// no status code was sent and is reported as CloseNoStatusReceived. A
+// one-byte body, a code not allowed on the wire or a reason that is not
+// valid UTF-8 is a protocol error.
+func parseClosePayload(payload []byte) (*CloseError, error) {
+	switch len(payload) {
+	case 0:
+		return &CloseError{Code: CloseNoStatusReceived}, nil
+	case 1:
+		return nil, fmt.Errorf("Close frame payload too short")
+	}
+	code := binary.BigEndian.Uint16(payload)
+	if !validCloseCode(code) {
+		return nil, fmt.Errorf("Invalid close code %d", code)
+	}
+	if !utf8.Valid(payload[2:]) {
+		return nil, fmt.Errorf("Close reason is not valid UTF-8")
+	}
+	return &CloseError{Code: code, Text: string(payload[2:])}, nil
+}
+
+// validCloseCode reports whether code may appear in a close frame: one of
+// the codes RFC 6455 and the IANA registry define for use on the wire, or
+// an application code in the 3000-4999 range. 1005, 1006 and 1015 are
+// reserved for reporting and never sent.
+func validCloseCode(code uint16) bool {
+	switch {
+	case code >= 1000 && code <= 1003,
+		code >= 1007 && code <= 1014,
+		code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// Request sends msg as a text message and returns the payload of the next
+// data message from the server, for simple request/response exchanges.
+// Control frames arriving in between are handled as in ReadMessage. If no
+// reply arrives within timeout the call fails with a timeout error.
+func (c *Conn) Request(msg []byte, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	c.conn.SetDeadline(deadline)
+	defer c.conn.SetDeadline(time.Time{})
+
+	if err := c.WriteMessage(OpText, msg); err != nil {
+		return nil, err
+	}
+	reply, err := c.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	return reply.Data, nil
+}
+
+// Subprotocol returns the subprotocol selected by the server, or "" if
+// none was.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// NetConn returns the underlying network connection. Reading from or
+// writing to it directly corrupts the WebSocket stream.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// ConnectionState returns the TLS state negotiated for a wss connection,
+// such as the version, cipher suite and peer certificates. ok is false
+// when the connection does not use TLS.
+func (c *Conn) ConnectionState() (state tls.ConnectionState, ok bool) {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tlsConn.ConnectionState(), true
+}
+
+// Close performs the closing handshake and closes the underlying network
+// connection. Following RFC 6455 section 7.1.1, it sends a close frame
+// (1000) unless one was already sent, reads until the server's close frame
+// arrives, and then waits for the server to close the TCP connection
+// before closing its own socket, so that the server, not the client, ends
+// up in TIME_WAIT. The whole exchange is bounded by CloseGracePeriod. It
+// is safe to call more than once; only the first call closes the socket
+// and reports its error.
+func (c *Conn) Close() error {
+	return c.close(true)
+}
+
+// close closes the connection, after the closing handshake if graceful is
+// set.
+func (c *Conn) close(graceful bool) error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if graceful {
+			c.shutdown()
+		}
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// shutdown is the part of Close before the socket is closed. The deadline
+// also cuts short a ReadMessage blocked in another goroutine.
+func (c *Conn) shutdown() {
+	c.conn.SetDeadline(time.Now().Add(c.CloseGracePeriod))
+	if err := c.sendClose(CloseNormalClosure); err != nil {
+		return
+	}
+
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for c.peerClose.Load() == nil {
+		f, _, err := readFrame(c.br)
+		if err != nil {
+			return
+		}
+		if f.Opcode == OpClose {
+			break
+		}
+	}
+	io.Copy(io.Discard, c.br)
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnRequest(t *testing.T) {
+	pong := make(chan Frame, 1)
+	addr := startMockServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		writeSwitchingProtocols(conn)
+
+		br := bufio.NewReader(conn)
+		bw := bufio.NewWriter(conn)
+		req, _, err := readFrame(br)
+		if err != nil || !req.Masked {
+			t.Errorf("Mock server got frame %+v, error %v", req, err)
+			return
+		}
+
+		// A ping before the reply must be answered, not returned.
+		writeFrame(bw, Frame{Fin: true, Opcode: OpPing, Payload: []byte("hb")})
+		bw.Flush()
+		f, _, _ := readFrame(br)
+		pong <- f
+
+		reply := strings.ToUpper(string(req.Payload))
+		writeFrame(bw, Frame{Fin: true, Opcode: OpText, Payload: []byte(reply)})
+		bw.Flush()
+	})
+
+	conn, err := Dial("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+
+	reply, err := conn.Request([]byte("ping me"), time.Second)
+	if err != nil {
+		t.Fatal("Request() error:", err)
+	}
+	if string(reply) != "PING ME" {
+		t.Errorf("Request() = %q, want %q", reply, "PING ME")
+	}
+	if f := <-pong; f.Opcode != OpPong || string(f.Payload) != "hb" {
+		t.Errorf("Got frame %#x %q, want pong %q", f.Opcode, f.Payload, "hb")
+	}
+}
+
+func TestConnRequestTimeout(t *testing.T) {
+	addr := startMockServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		writeSwitchingProtocols(conn)
+		readFrame(bufio.NewReader(conn))
+		time.Sleep(time.Second)
+	})
+
+	conn, err := Dial("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Request([]byte("hello"), 50*time.Millisecond)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Request() error = %v, want timeout", err)
+	}
+}
+
+func TestConnEmptyMessages(t *testing.T) {
+	received := make(chan Frame, 1)
+	addr := startMockServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		writeSwitchingProtocols(conn)
+
+		f, _, _ := readFrame(bufio.NewReader(conn))
+		received <- f
+		bw := bufio.NewWriter(conn)
+		writeFrame(bw, Frame{Fin: true, Opcode: OpBinary})
+		bw.Flush()
+	})
+
+	conn, err := Dial("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(OpText, nil); err != nil {
+		t.Fatal("WriteMessage() error:", err)
+	}
+	if f := <-received; !f.Masked || f.Opcode != OpText || len(f.Payload) != 0 {
+		t.Errorf("Server got masked %v, opcode %#x, payload %v", f.Masked, f.Opcode, f.Payload)
+	}
+
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal("ReadMessage() error:", err)
+	}
+	if msg.Opcode != OpBinary || msg.Data == nil || len(msg.Data) != 0 {
+		t.Errorf("ReadMessage() = %#x %#v, want empty non-nil binary", msg.Opcode, msg.Data)
+	}
+}
+
+// countingConn counts calls to Close on the wrapped connection.
+type countingConn struct {
+	net.Conn
+	closes int
+}
+
+func (c *countingConn) Close() error {
+	c.closes++
+	return c.Conn.Close()
+}
+
+func TestConnCloseOnce(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	cc := &countingConn{Conn: client}
+	c := newConn(cc, bufio.NewReader(cc))
+	// Nobody answers the close frame.
+	c.CloseGracePeriod = 10 * time.Millisecond
+
+	if err := c.Close(); err != nil {
+		t.Fatal("First Close() error:", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Second Close() error = %v, want nil", err)
+	}
+	if cc.closes != 1 {
+		t.Errorf("Underlying Close called %d times, want 1", cc.closes)
+	}
+}
+
+func TestConnWriteTextBinary(t *testing.T) {
+	received := make(chan Frame, 2)
+	addr := startMockServer(t, func(conn net.Conn) {
+		writeSwitchingProtocols(conn)
+		br := bufio.NewReader(conn)
+		for range 2 {
+			f, _, err := readFrame(br)
+			if err != nil {
+				return
+			}
+			received <- f
+		}
+	})
+
+	conn, err := Dial("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteText("\xff"); !errors.Is(err, ErrInvalidUTF8) {
+		t.Errorf("WriteText(invalid) error = %v, want ErrInvalidUTF8", err)
+	}
+	if err := conn.WriteText("Hello"); err != nil {
+		t.Fatal("WriteText() error:", err)
+	}
+	if err := conn.WriteBinary([]byte{0x00, 0xff}); err != nil {
+		t.Fatal("WriteBinary() error:", err)
+	}
+
+	for _, want := range []Frame{
+		{Opcode: OpText, Payload: []byte("Hello")},
+		{Opcode: OpBinary, Payload: []byte{0x00, 0xff}},
+	} {
+		f := <-received
+		if !f.Fin || !f.Masked || f.Opcode != want.Opcode || string(f.Payload) != string(want.Payload) {
+			t.Errorf("Server got fin=%v masked=%v opcode=%#x payload=%v, want masked final %#x %v",
+				f.Fin, f.Masked, f.Opcode, f.Payload, want.Opcode, want.Payload)
+		}
+	}
+}
+
+func TestConnBinaryControlPayload(t *testing.T) {
+	// Every byte from 0xFF down, so the payload is not valid UTF-8.
+	payload := make([]byte, maxControlPayload)
+	for i := range payload {
+		payload[i] = byte(255 - i)
+	}
+
+	frames := make(chan Frame, 3)
+	addr := startMockServer(t, func(conn net.Conn) {
+		writeSwitchingProtocols(conn)
+		br := bufio.NewReader(conn)
+		bw := bufio.NewWriter(conn)
+		writeFrame(bw, Frame{Fin: true, Opcode: OpPing, Payload: payload})
+		writeFrame(bw, Frame{Fin: true, Opcode: OpText, Payload: []byte("done")})
+		bw.Flush()
+		for {
+			f, _, err := readFrame(br)
+			if err != nil || f.Opcode == OpClose {
+				return
+			}
+			frames <- f
+		}
+	})
+
+	conn, err := Dial("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ReadMessage(); err != nil {
+		t.Fatal("ReadMessage() error:", err)
+	}
+	if f := <-frames; f.Opcode != OpPong || !bytes.Equal(f.Payload, payload) {
+		t.Errorf("Automatic reply = %#x %x, want pong %x", f.Opcode, f.Payload, payload)
+	}
+
+	if err := conn.Ping(payload); err != nil {
+		t.Fatal("Ping() error:", err)
+	}
+	if f := <-frames; f.Opcode != OpPing || !bytes.Equal(f.Payload, payload) {
+		t.Errorf("Ping() sent %#x %x, want ping %x", f.Opcode, f.Payload, payload)
+	}
+	if err := conn.Pong(payload); err != nil {
+		t.Fatal("Pong() error:", err)
+	}
+	if f := <-frames; f.Opcode != OpPong || !bytes.Equal(f.Payload, payload) {
+		t.Errorf("Pong() sent %#x %x, want pong %x", f.Opcode, f.Payload, payload)
+	}
+
+	tooLarge := make([]byte, maxControlPayload+1)
+	if err := conn.Ping(tooLarge); !errors.Is(err, ErrControlTooLarge) {
+		t.Errorf("Ping() of %d bytes error = %v, want ErrControlTooLarge", len(tooLarge), err)
+	}
+	if err := conn.Pong(tooLarge); !errors.Is(err, ErrControlTooLarge) {
+		t.Errorf("Pong() of %d bytes error = %v, want ErrControlTooLarge", len(tooLarge), err)
+	}
+}
+
+func TestConnReadAfterCloseFrame(t *testing.T) {
+	release := make(chan struct{})
+	addr := startMockServer(t, func(conn net.Conn) {
+		writeSwitchingProtocols(conn)
+		bw := bufio.NewWriter(conn)
+		payload := binary.BigEndian.AppendUint16(nil, CloseGoingAway)
+		writeFrame(bw, Frame{Fin: true, Opcode: OpClose, Payload: append(payload, "bye"...)})
+		// Trailing garbage after the close must never be parsed, and the
+		// connection stays open so a further read would block.
+		bw.Write([]byte{0xff, 0xff, 0xff})
+		bw.Flush()
+		<-release
+	})
+
+	conn, err := Dial("ws://" + addr + "/ws")
+	if err != nil {
+		close(release)
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+	defer close(release)
+	conn.NetConn().SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for i := 0; i < 3; i++ {
+		_, err := conn.ReadMessage()
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != CloseGoingAway || closeErr.Text != "bye" {
+			t.Errorf("ReadMessage() call %d error = %v, want the server's close", i+1, err)
+		}
+	}
+}
+
+func TestConnFragmentedControlFrame(t *testing.T) {
+	closeFrame := make(chan Frame, 1)
+	addr := startMockServer(t, func(conn net.Conn) {
+		writeSwitchingProtocols(conn)
+		bw := bufio.NewWriter(conn)
+		writeFrame(bw, Frame{Fin: false, Opcode: OpPing, Payload: []byte("frag")})
+		bw.Flush()
+		f, _, _ := readFrame(bufio.NewReader(conn))
+		closeFrame <- f
+	})
+
+	conn, err := Dial("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("ReadMessage() accepted a ping with FIN unset")
+	}
+	f := <-closeFrame
+	if f.Opcode != OpClose || len(f.Payload) < 2 || binary.BigEndian.Uint16(f.Payload) != CloseProtocolError {
+		t.Errorf("Got frame %#x %v, want a close with %d", f.Opcode, f.Payload, CloseProtocolError)
+	}
+}
+
+func TestConnInvalidClosePayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"One byte", []byte{0x03}},
+		{"Reserved code", binary.BigEndian.AppendUint16(nil, CloseNoStatusReceived)},
+		{"Unassigned code", binary.BigEndian.AppendUint16(nil, 2000)},
+		{"Invalid UTF-8 reason", append(binary.BigEndian.AppendUint16(nil, CloseNormalClosure), 0xff, 0xfe)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			closeFrame := make(chan Frame, 1)
+			addr := startMockServer(t, func(conn net.Conn) {
+				writeSwitchingProtocols(conn)
+				bw := bufio.NewWriter(conn)
+				writeFrame(bw, Frame{Fin: true, Opcode: OpClose, Payload: tt.payload})
+				bw.Flush()
+				f, _, _ := readFrame(bufio.NewReader(conn))
+				closeFrame <- f
+			})
+
+			conn, err := Dial("ws://" + addr + "/ws")
+			if err != nil {
+				t.Fatal("Dial error:", err)
+			}
+			defer conn.Close()
+
+			_, err = conn.ReadMessage()
+			var closeErr *CloseError
+			if err == nil || errors.As(err, &closeErr) {
+				t.Errorf("ReadMessage() error = %v, want a protocol error", err)
+			}
+			f := <-closeFrame
+			if f.Opcode != OpClose || len(f.Payload) < 2 || binary.BigEndian.Uint16(f.Payload) != CloseProtocolError {
+				t.Errorf("Got frame %#x %v, want a close with %d", f.Opcode, f.Payload, CloseProtocolError)
+			}
+		})
+	}
+}
+
+func TestConnWriteAfterCloseSent(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	conn := newConn(client, bufio.NewReader(client))
+	defer conn.Close()
+
+	frames := make(chan Frame, 2)
+	go func() {
+		br := bufio.NewReader(server)
+		for {
+			f, _, err := readFrame(br)
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- f
+		}
+	}()
+
+	if err := conn.sendClose(CloseNormalClosure); err != nil {
+		t.Fatal("sendClose() error:", err)
+	}
+	if err := conn.WriteMessage(OpText, []byte("late")); !errors.Is(err, ErrCloseSent) {
+		t.Errorf("WriteMessage() after close error = %v, want ErrCloseSent", err)
+	}
+	if f := <-frames; f.Opcode != OpClose {
+		t.Errorf("Got opcode %#x, want close", f.Opcode)
+	}
+	server.Close()
+	if f, ok := <-frames; ok {
+		t.Errorf("Got frame %#x %q after the close frame", f.Opcode, f.Payload)
+	}
+}
+
+// eventConn reports when its Read hits EOF and when it is closed.
+type eventConn struct {
+	net.Conn
+	record func(event string)
+}
+
+func (c *eventConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == io.EOF {
+		c.record("client saw EOF")
+	}
+	return n, err
+}
+
+func (c *eventConn) Close() error {
+	c.record("client closed socket")
+	return c.Conn.Close()
+}
+
+func TestConnCloseHandshakeOrder(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+
+	server, client := net.Pipe()
+	defer server.Close()
+	ec := &eventConn{Conn: client, record: record}
+	c := newConn(ec, bufio.NewReader(ec))
+
+	go func() {
+		f, _, err := readFrame(bufio.NewReader(server))
+		if err != nil || f.Opcode != OpClose || !f.Masked {
+			t.Errorf("Server got frame %+v, error %v, want a masked close", f, err)
+			return
+		}
+		record("server got close")
+		bw := bufio.NewWriter(server)
+		writeFrame(bw, Frame{Fin: true, Opcode: OpClose, Payload: f.Payload})
+		bw.Flush()
+		// Give a client that does not wait for the FIN time to close first.
+		time.Sleep(50 * time.Millisecond)
+		record("server closed TCP")
+		server.Close()
+	}()
+
+	if err := c.Close(); err != nil {
+		t.Fatal("Close() error:", err)
+	}
+
+	want := []string{"server got close", "server closed TCP", "client saw EOF", "client closed socket"}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(events, want) {
+		t.Errorf("Events = %q, want %q", events, want)
+	}
+}
+
+func TestConnTransferCounters(t *testing.T) {
+	addr := startMockServer(t, func(conn net.Conn) {
+		writeSwitchingProtocols(conn)
+		conn.Write([]byte{0x81, 0x05, 'H', 'e', 'l', 'l', 'o'})
+		readFrame(bufio.NewReader(conn))
+	})
+
+	conn, err := Dial("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ReadMessage(); err != nil {
+		t.Fatal("ReadMessage() error:", err)
+	}
+	if err := conn.WriteText("hi"); err != nil {
+		t.Fatal("WriteText() error:", err)
+	}
+	// A masked 2-byte payload is 2 header bytes, a 4-byte key and the data.
+	if got := conn.BytesReceived(); got != 7 {
+		t.Errorf("BytesReceived() = %d, want 7", got)
+	}
+	if got := conn.MessagesReceived(); got != 1 {
+		t.Errorf("MessagesReceived() = %d, want 1", got)
+	}
+	if got := conn.BytesSent(); got != 8 {
+		t.Errorf("BytesSent() = %d, want 8", got)
+	}
+	if got := conn.MessagesSent(); got != 1 {
+		t.Errorf("MessagesSent() = %d, want 1", got)
+	}
+}
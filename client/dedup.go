@@ -0,0 +1,56 @@
+package main
+
+import "container/list"
+
+// DefaultDedupSize is the number of message IDs remembered when
+// Conn.DedupSize is zero.
+const DefaultDedupSize = 1024
+
+// duplicate reports whether msg has an ID that was seen recently, and
+// records it otherwise.
+func (c *Conn) duplicate(msg Message) bool {
+	if c.MessageID == nil {
+		return false
+	}
+	id, ok := c.MessageID(msg)
+	if !ok {
+		return false
+	}
+	c.seenMu.Lock()
+	defer c.seenMu.Unlock()
+	if c.seen == nil {
+		size := c.DedupSize
+		if size <= 0 {
+			size = DefaultDedupSize
+		}
+		c.seen = newIDCache(size)
+	}
+	return !c.seen.add(id)
+}
+
+// idCache is a least recently used set of message IDs.
+type idCache struct {
+	size  int
+	order *list.List // most recently seen at the front
+	ids   map[string]*list.Element
+}
+
+func newIDCache(size int) *idCache {
+	return &idCache{size: size, order: list.New(), ids: map[string]*list.Element{}}
+}
+
+// add records id and reports whether it was new. Seeing an ID again makes
+// it the most recently used, so a burst of resends keeps it remembered.
+func (c *idCache) add(id string) bool {
+	if e, ok := c.ids[id]; ok {
+		c.order.MoveToFront(e)
+		return false
+	}
+	c.ids[id] = c.order.PushFront(id)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.ids, oldest.Value.(string))
+	}
+	return true
+}
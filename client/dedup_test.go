@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestConnMessageIDDedup(t *testing.T) {
+	addr := startMockServer(t, func(conn net.Conn) {
+		writeSwitchingProtocols(conn)
+		bw := bufio.NewWriter(conn)
+		for _, msg := range []string{"1:a", "2:b", "1:a", "x", "x", "3:c", "2:b"} {
+			writeFrame(bw, Frame{Fin: true, Opcode: OpText, Payload: []byte(msg)})
+		}
+		bw.Flush()
+	})
+
+	conn, err := Dial("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+	conn.DedupSize = 2
+	conn.MessageID = func(msg Message) (string, bool) {
+		id, _, ok := strings.Cut(string(msg.Data), ":")
+		return id, ok
+	}
+
+	// The resent "1:a" refreshes ID 1, so ID 3 pushes ID 2 out of the
+	// cache and the last "2:b" is delivered again. Messages without an ID
+	// are never dropped.
+	for _, want := range []string{"1:a", "2:b", "x", "x", "3:c", "2:b"} {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal("ReadMessage() error:", err)
+		}
+		if string(msg.Data) != want {
+			t.Errorf("ReadMessage() = %q, want %q", msg.Data, want)
+		}
+	}
+}
+
+func TestConnMessageIDDedupConcurrent(t *testing.T) {
+	const n = 100
+	addr := startMockServer(t, func(conn net.Conn) {
+		writeSwitchingProtocols(conn)
+		bw := bufio.NewWriter(conn)
+		for i := 0; i < n; i++ {
+			msg := []byte(strconv.Itoa(i) + ":m")
+			writeFrame(bw, Frame{Fin: true, Opcode: OpText, Payload: msg})
+			writeFrame(bw, Frame{Fin: true, Opcode: OpText, Payload: msg})
+		}
+		bw.Flush()
+		conn.Close()
+	})
+
+	conn, err := Dial("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+	conn.MessageID = func(msg Message) (string, bool) {
+		// Let another reader take the next frame before this ID is
+		// recorded.
+		runtime.Gosched()
+		id, _, ok := strings.Cut(string(msg.Data), ":")
+		return id, ok
+	}
+
+	var delivered atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+				delivered.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := delivered.Load(); got != n {
+		t.Errorf("Delivered %d messages, want %d", got, n)
+	}
+}
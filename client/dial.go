@@ -0,0 +1,759 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialer holds the settings used to open client connections. Configure one
+// and reuse it for every Dial; it must not be modified while dialing. The
+// zero value is usable and dials directly with no redirects, retries or
+// timeouts.
+type Dialer struct {
+	// TLSConfig is used for wss connections. If NextProtos is empty, ALPN
+	// offers "http/1.1", which some gateways require; set NextProtos to
+	// negotiate other protocols.
+	TLSConfig *tls.Config
+
+	// DialTimeout bounds establishing the network connection, including
+	// any proxy CONNECT and the TLS handshake, for each attempt.
+	// HandshakeTimeout bounds the whole handshake: connecting, writing the
+	// request and reading the response. Zero means no limit other than the
+	// context's deadline.
+	DialTimeout      time.Duration
+	HandshakeTimeout time.Duration
+
+	// Subprotocols are offered in Sec-WebSocket-Protocol in order of
+	// preference. The server's choice is available from Conn.Subprotocol.
+	Subprotocols []string
+
+	// SubprotocolMessageTypes maps a subprotocol to the message type,
+	// OpText or OpBinary, that Conn.Send uses once that subprotocol is
+	// negotiated, for protocols whose messages are always binary or
+	// always text. Send falls back to OpText otherwise.
+	SubprotocolMessageTypes map[string]byte
+
+	// Header holds extra handshake request headers, such as Authorization
+	// or a different Origin.
+	Header http.Header
+
+	// ReadBufferSize and WriteBufferSize size the connection's buffers.
+	// Zero selects the bufio default. The read buffer is created before
+	// the handshake response is read and kept for the data phase, so
+	// frames the server sends right behind its 101 response are not lost.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// SocketReadBuffer and SocketWriteBuffer, if positive, set the kernel
+	// socket buffer sizes (SO_RCVBUF and SO_SNDBUF) of the TCP connection
+	// before the handshake.
+	SocketReadBuffer  int
+	SocketWriteBuffer int
+
+	// TCPKeepAliveIdle, if positive, enables TCP keepalive probes,
+	// starting after that much idle time and repeated every
+	// TCPKeepAliveInterval (the OS default if zero). They detect a dead
+	// server at the socket level, independently of PingInterval.
+	TCPKeepAliveIdle     time.Duration
+	TCPKeepAliveInterval time.Duration
+
+	// Proxy, if set, returns the HTTP proxy to tunnel through with CONNECT
+	// for a given server URL, or nil to connect directly. Credentials in
+	// the proxy URL are sent as Basic Proxy-Authorization.
+	Proxy func(*url.URL) (*url.URL, error)
+
+	// MaxRedirects is the number of 3xx redirects to follow, re-performing
+	// the handshake at each new location. http and https redirect targets
+	// are mapped to ws and wss respectively. A redirect from wss to ws is
+	// refused, and Authorization, Proxy-Authorization and Cookie headers
+	// are not sent on once a redirect leaves the original host.
+	MaxRedirects int
+
+	// Lenient makes a handshake that does not switch protocols read the
+	// complete response and fail with a *HandshakeResponseError, which
+	// helps diagnose broken servers. By default Dial fails as soon as it
+	// sees a non-101 status.
+	Lenient bool
+
+	// Extensions is sent as the Sec-WebSocket-Extensions offer. Of the
+	// extensions a server may accept, only permessage-deflate is
+	// understood; accepting anything else fails the handshake.
+	Extensions string
+
+	// ReconnectAttempts is how many more times to try connecting after
+	// the network connection cannot be established, waiting
+	// ReconnectDelay between attempts. Rejected handshakes are not
+	// retried.
+	ReconnectAttempts int
+	ReconnectDelay    time.Duration
+
+	// Breaker, if set, records the outcome of every attempt to connect
+	// and stops attempts, retries included, while it is open.
+	Breaker *CircuitBreaker
+
+	// ClosePolicy decides whether Run reconnects after the server closes
+	// the connection with a given code. Codes it does not list stop Run.
+	// Nil means DefaultClosePolicy.
+	ClosePolicy map[uint16]CloseAction
+
+	// PingInterval, if positive, makes the connection ping the server
+	// that often and close itself when no pong arrives within
+	// PongTimeout of a ping (PingInterval if zero). Pongs are processed by
+	// ReadMessage, so the application must keep reading.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// MaxHeaderBytes and MaxHeaderCount bound the handshake response's
+	// status line and headers, so a hostile server cannot stream headers
+	// forever. Zero selects DefaultMaxHeaderBytes and
+	// DefaultMaxHeaderCount.
+	MaxHeaderBytes int
+	MaxHeaderCount int
+
+	// OnHandshakeComplete, if set, is called once every Dial finishes,
+	// successfully or not, with the time taken since the dial started,
+	// including name resolution, TLS and redirects, and the error if any.
+	// It can feed a handshake latency metric.
+	OnHandshakeComplete func(d time.Duration, err error)
+}
+
+// Defaults for Dialer.MaxHeaderBytes and Dialer.MaxHeaderCount.
+const (
+	DefaultMaxHeaderBytes = 64 << 10
+	DefaultMaxHeaderCount = 100
+)
+
+// ErrHeaderTooLarge is returned by Dial when the handshake response exceeds
+// the Dialer's header limits.
+var ErrHeaderTooLarge = errors.New("Handshake response headers too large")
+
+// DefaultDialer is the Dialer used by Dial before applying its options.
+var DefaultDialer = &Dialer{}
+
+// DialOption configures optional Dial behavior.
+type DialOption func(*Dialer)
+
+// maxDebugBody bounds how much of a rejected handshake's body is captured
+// in lenient mode.
+const maxDebugBody = 64 << 10
+
+// HandshakeResponseError is returned by Dial in lenient mode when the server
+// answers the handshake with something other than 101 Switching Protocols.
+// It carries the response so the caller can see what the server sent.
+type HandshakeResponseError struct {
+	StatusLine string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+func (e *HandshakeResponseError) Error() string {
+	return fmt.Sprintf("Did not receive 101 Switching Protocols: %s", e.StatusLine)
+}
+
+// WithRedirects makes Dial follow up to max 3xx redirects returned by the
+// server, re-performing the handshake at each new location. http and https
+// redirect targets are mapped to ws and wss respectively.
+func WithRedirects(max int) DialOption {
+	return func(d *Dialer) {
+		d.MaxRedirects = max
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used for wss connections. If
+// cfg.NextProtos is empty, ALPN offers "http/1.1", which some gateways
+// require; set NextProtos to negotiate other protocols.
+func WithTLSConfig(cfg *tls.Config) DialOption {
+	return func(d *Dialer) {
+		d.TLSConfig = cfg
+	}
+}
+
+// WithLenientHandshake makes Dial read the complete response when the
+// server does not switch protocols and return it as a
+// *HandshakeResponseError, which helps diagnose broken servers. By default
+// Dial fails as soon as it sees a non-101 status.
+func WithLenientHandshake() DialOption {
+	return func(d *Dialer) {
+		d.Lenient = true
+	}
+}
+
+// WithCompression offers permessage-deflate (RFC 7692). If the server
+// accepts, messages are compressed in both directions; if it declines, the
+// connection silently stays uncompressed.
+func WithCompression() DialOption {
+	return WithExtensions(deflateOffer)
+}
+
+// WithExtensions sends offer as the Sec-WebSocket-Extensions request header.
+// Of the extensions a server may accept, only permessage-deflate is
+// understood; accepting anything else fails the handshake.
+func WithExtensions(offer string) DialOption {
+	return func(d *Dialer) {
+		d.Extensions = offer
+	}
+}
+
+// Dial connects to a ws:// or wss:// URL and performs the opening handshake
+// using DefaultDialer adjusted by opts.
+func Dial(serverURL string, opts ...DialOption) (*Conn, error) {
+	d := *DefaultDialer
+	for _, opt := range opts {
+		opt(&d)
+	}
+	return d.Dial(serverURL)
+}
+
+// Dial connects to a ws:// or wss:// URL and performs the opening handshake.
+func (d *Dialer) Dial(serverURL string) (*Conn, error) {
+	return d.DialContext(context.Background(), serverURL)
+}
+
+// DialContext is Dial with a context that bounds connecting and the
+// opening handshake. Once the connection is established, cancelling ctx
+// has no effect on it.
+func (d *Dialer) DialContext(ctx context.Context, serverURL string) (*Conn, error) {
+	start := time.Now()
+	c, err := d.dialContext(ctx, serverURL)
+	if d.OnHandshakeComplete != nil {
+		d.OnHandshakeComplete(time.Since(start), err)
+	}
+	return c, err
+}
+
+func (d *Dialer) dialContext(ctx context.Context, serverURL string) (*Conn, error) {
+	if d.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.HandshakeTimeout)
+		defer cancel()
+	}
+
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("URL parse error: %w", err)
+	}
+
+	header := d.Header
+	visited := map[string]bool{}
+	for hops := 0; ; hops++ {
+		visited[u.String()] = true
+
+		c, location, err := d.handshake(ctx, u, header)
+		if err != nil {
+			return nil, err
+		}
+		if location == "" {
+			return c, nil
+		}
+
+		if hops >= d.MaxRedirects {
+			return nil, fmt.Errorf("Redirected to %s but redirects are limited to %d", location, d.MaxRedirects)
+		}
+		next, err := u.Parse(location)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redirect location %q: %w", location, err)
+		}
+		switch next.Scheme {
+		case "http":
+			next.Scheme = "ws"
+		case "https":
+			next.Scheme = "wss"
+		}
+		if u.Scheme == "wss" && next.Scheme != "wss" {
+			return nil, fmt.Errorf("Refusing redirect from %s to insecure %s", u, next)
+		}
+		if visited[next.String()] {
+			return nil, fmt.Errorf("Redirect loop detected at %s", next)
+		}
+		if next.Host != u.Host {
+			header = withoutCredentials(header)
+		}
+		u = next
+	}
+}
+
+// credentialHeaders are the request headers dropped on a redirect to
+// another host.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// withoutCredentials returns a copy of header without credentialHeaders.
+func withoutCredentials(header http.Header) http.Header {
+	header = header.Clone()
+	for _, name := range credentialHeaders {
+		header.Del(name)
+	}
+	return header
+}
+
+// handshake performs a single opening handshake against u, sending header
+// in addition to the WebSocket headers. When the server answers with a
+// redirect, the connection is closed and the Location header is returned
+// instead of a Conn.
+func (d *Dialer) handshake(ctx context.Context, u *url.URL, header http.Header) (*Conn, string, error) {
+	conn, err := d.dialRetry(ctx, u)
+	if err != nil {
+		return nil, "", fmt.Errorf("Dial error: %w", err)
+	}
+
+	// Abort the handshake when ctx ends by failing any blocked I/O.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	c, location, err := d.exchange(conn, u, header)
+	if err != nil {
+		conn.Close()
+		// The connection deadline is ctx's, but ctx may only report
+		// itself done a moment after the deadline fails the read.
+		if _, ok := ctx.Deadline(); ok && errors.Is(err, os.ErrDeadlineExceeded) {
+			<-ctx.Done()
+		}
+		if ctx.Err() != nil {
+			return nil, "", fmt.Errorf("Handshake aborted: %w", ctx.Err())
+		}
+		return nil, "", err
+	}
+	if !stop() {
+		conn.Close()
+		return nil, "", fmt.Errorf("Handshake aborted: %w", ctx.Err())
+	}
+	if c == nil {
+		conn.Close()
+		return nil, location, nil
+	}
+	conn.SetDeadline(time.Time{})
+	return c, "", nil
+}
+
+// exchange writes the handshake request on conn and reads the response.
+// It returns the Conn on success, or the Location of a redirect.
+func (d *Dialer) exchange(conn net.Conn, u *url.URL, extra http.Header) (*Conn, string, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, "", fmt.Errorf("Key generation error: %w", err)
+	}
+	secWebSocketKey := base64.StdEncoding.EncodeToString(key)
+
+	var req strings.Builder
+	fmt.Fprintf(&req, "GET %s HTTP/1.1\r\n", u.RequestURI())
+	fmt.Fprintf(&req, "Host: %s\r\n", u.Host)
+	fmt.Fprintf(&req, "Upgrade: websocket\r\n")
+	fmt.Fprintf(&req, "Connection: Upgrade\r\n")
+	fmt.Fprintf(&req, "Sec-WebSocket-Key: %s\r\n", secWebSocketKey)
+	fmt.Fprintf(&req, "Sec-WebSocket-Version: 13\r\n")
+	if extra.Get("Origin") == "" {
+		fmt.Fprintf(&req, "Origin: http://localhost:8080\r\n")
+	}
+	if d.Extensions != "" {
+		fmt.Fprintf(&req, "Sec-WebSocket-Extensions: %s\r\n", d.Extensions)
+	}
+	if len(d.Subprotocols) > 0 {
+		fmt.Fprintf(&req, "Sec-WebSocket-Protocol: %s\r\n", strings.Join(d.Subprotocols, ", "))
+	}
+	extra.Write(&req)
+	fmt.Fprintf(&req, "\r\n")
+	if _, err := io.WriteString(conn, req.String()); err != nil {
+		return nil, "", fmt.Errorf("Error writing handshake: %w", err)
+	}
+
+	// The same reader is handed to the Conn below; it may already hold
+	// the first frames.
+	reader := bufio.NewReader(conn)
+	if d.ReadBufferSize > 0 {
+		reader = bufio.NewReaderSize(conn, d.ReadBufferSize)
+	}
+
+	budget := d.MaxHeaderBytes
+	if budget <= 0 {
+		budget = DefaultMaxHeaderBytes
+	}
+	maxCount := d.MaxHeaderCount
+	if maxCount <= 0 {
+		maxCount = DefaultMaxHeaderCount
+	}
+
+	status, err := readHeaderLine(reader, &budget)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error reading status line: %w", err)
+	}
+	code := statusCode(status)
+
+	header := http.Header{}
+	for count := 0; ; count++ {
+		if count > maxCount {
+			return nil, "", fmt.Errorf("Error reading headers: %w", ErrHeaderTooLarge)
+		}
+		line, err := readHeaderLine(reader, &budget)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error reading headers: %w", err)
+		}
+		if line == "\r\n" {
+			break
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+
+	switch code {
+	case http.StatusSwitchingProtocols:
+		if err := checkUpgradeResponse(header, secWebSocketKey); err != nil {
+			return nil, "", err
+		}
+		c := newConn(conn, reader)
+		if d.WriteBufferSize > 0 {
+			c.bw = bufio.NewWriterSize(conn, d.WriteBufferSize)
+		}
+		if err := c.acceptExtensions(header, d.Extensions); err != nil {
+			return nil, "", err
+		}
+		if err := c.acceptSubprotocol(header, d.Subprotocols); err != nil {
+			return nil, "", err
+		}
+		if opcode, ok := d.SubprotocolMessageTypes[c.subprotocol]; ok && c.subprotocol != "" {
+			c.messageType = opcode
+		}
+		if d.PingInterval > 0 {
+			go c.keepAlive(d.PingInterval, d.PongTimeout)
+		}
+		return c, "", nil
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		location := header.Get("Location")
+		if location == "" {
+			return nil, "", fmt.Errorf("Redirect %d without Location header", code)
+		}
+		return nil, location, nil
+	default:
+		if !d.Lenient {
+			return nil, "", fmt.Errorf("Did not receive 101 Switching Protocols")
+		}
+		return nil, "", &HandshakeResponseError{
+			StatusLine: strings.TrimSpace(status),
+			StatusCode: code,
+			Header:     header,
+			Body:       readDebugBody(reader, header),
+		}
+	}
+}
+
+// checkUpgradeResponse verifies the headers RFC 6455 section 4.1 requires
+// of a 101 response: Upgrade and Connection tokens, compared
+// case-insensitively, and the Sec-WebSocket-Accept matching our key.
+func checkUpgradeResponse(header http.Header, secWebSocketKey string) error {
+	if !headerContainsToken(header, "Upgrade", "websocket") {
+		return fmt.Errorf("Handshake response missing Upgrade: websocket")
+	}
+	if !headerContainsToken(header, "Connection", "upgrade") {
+		return fmt.Errorf("Handshake response missing Connection: Upgrade")
+	}
+	if header.Get("Sec-WebSocket-Accept") != computeAcceptKey(secWebSocketKey) {
+		return fmt.Errorf("Handshake response has an invalid Sec-WebSocket-Accept")
+	}
+	return nil
+}
+
+// computeAcceptKey returns the Sec-WebSocket-Accept value a server must
+// send for secWebSocketKey.
+func computeAcceptKey(secWebSocketKey string) string {
+	return computeAcceptKeyHash(sha1.New, secWebSocketKey)
+}
+
+// computeAcceptKeyHash is computeAcceptKey with the SHA-1 that RFC 6455
+// mandates replaced by newHash, for experimenting with servers that differ.
+func computeAcceptKeyHash(newHash func() hash.Hash, secWebSocketKey string) string {
+	const magicString = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	h := newHash()
+	h.Write([]byte(secWebSocketKey + magicString))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContainsToken reports whether any comma-separated value of the
+// named header equals token, ignoring case.
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, t := range headerValues(h, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerValues returns the comma-separated elements of every line of the
+// named header, trimmed and without empty ones. Repeated header lines and a
+// single combined line therefore read the same, as RFC 9110 requires.
+func headerValues(h http.Header, name string) []string {
+	var values []string
+	for _, line := range h.Values(name) {
+		for _, v := range strings.Split(line, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// readHeaderLine reads up to and including the next '\n', charging it to
+// *budget and failing with ErrHeaderTooLarge once the budget is exhausted.
+func readHeaderLine(r *bufio.Reader, budget *int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(chunk) > *budget {
+			return "", ErrHeaderTooLarge
+		}
+		*budget -= len(chunk)
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return string(line), err
+	}
+}
+
+// acceptSubprotocol records the server's Sec-WebSocket-Protocol choice,
+// which must be a single one of the offered subprotocols. The choice may
+// arrive split over repeated header lines like any other header.
+func (c *Conn) acceptSubprotocol(header http.Header, offered []string) error {
+	selected := headerValues(header, "Sec-WebSocket-Protocol")
+	if len(selected) == 0 {
+		return nil
+	}
+	if len(selected) > 1 {
+		return fmt.Errorf("Server selected more than one subprotocol: %q", selected)
+	}
+	chosen := selected[0]
+	for _, p := range offered {
+		if p == chosen {
+			c.subprotocol = chosen
+			return nil
+		}
+	}
+	return fmt.Errorf("Server selected unexpected subprotocol %q", chosen)
+}
+
+// acceptExtensions configures c for the extensions the server accepted in
+// its Sec-WebSocket-Extensions response header. Accepting an extension
+// that was not offered is a handshake failure.
+func (c *Conn) acceptExtensions(header http.Header, offer string) error {
+	offered := map[string]bool{}
+	for _, ext := range strings.Split(offer, ",") {
+		name, _, _ := strings.Cut(ext, ";")
+		offered[strings.TrimSpace(name)] = true
+	}
+	for _, value := range header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !offered[name] || name != "permessage-deflate" {
+				return fmt.Errorf("Server accepted unexpected extension %q", name)
+			}
+			c.compress = true
+		}
+	}
+	return nil
+}
+
+// readDebugBody reads at most maxDebugBody bytes of a response body. The
+// body length comes from Content-Length; without it the body extends to
+// the end of the connection.
+func readDebugBody(r io.Reader, header http.Header) []byte {
+	limit := int64(maxDebugBody)
+	if cl := header.Get("Content-Length"); cl != "" {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < 0 {
+			return nil
+		}
+		limit = min(n, limit)
+	}
+	body, _ := io.ReadAll(io.LimitReader(r, limit))
+	return body
+}
+
+// dialRetry runs dialNet, retrying up to d.ReconnectAttempts times unless
+// d.Breaker opens.
+func (d *Dialer) dialRetry(ctx context.Context, u *url.URL) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		if d.Breaker != nil {
+			if err := d.Breaker.allow(); err != nil {
+				return nil, err
+			}
+		}
+		conn, err := d.dialNet(ctx, u)
+		if d.Breaker != nil {
+			d.Breaker.record(err)
+		}
+		if err == nil || attempt >= d.ReconnectAttempts {
+			return conn, err
+		}
+		select {
+		case <-time.After(d.ReconnectDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// dialNet opens the TCP (ws) or TLS (wss) connection for u, tunnelling
+// through the proxy selected by d.Proxy if there is one.
+func (d *Dialer) dialNet(ctx context.Context, u *url.URL) (net.Conn, error) {
+	host := u.Host
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "wss":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported scheme %q", u.Scheme)
+	}
+
+	var proxyURL *url.URL
+	if d.Proxy != nil {
+		var err error
+		if proxyURL, err = d.Proxy(u); err != nil {
+			return nil, fmt.Errorf("Proxy selection error: %w", err)
+		}
+	}
+
+	if d.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.DialTimeout)
+		defer cancel()
+	}
+
+	var nd net.Dialer
+	var conn net.Conn
+	var err error
+	if proxyURL != nil {
+		conn, err = dialProxy(ctx, &nd, proxyURL, host)
+	} else {
+		conn, err = nd.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketBuffers(conn, d.SocketReadBuffer, d.SocketWriteBuffer); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error setting socket buffers: %w", err)
+	}
+	if err := setKeepAlive(conn, d.TCPKeepAliveIdle, d.TCPKeepAliveInterval); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error setting TCP keepalive: %w", err)
+	}
+	if u.Scheme == "ws" {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, tlsConfigFor(u, d.TLSConfig))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialProxy connects to the HTTP proxy at proxyURL and asks it to open a
+// tunnel to host with CONNECT.
+func dialProxy(ctx context.Context, nd *net.Dialer, proxyURL *url.URL, host string) (net.Conn, error) {
+	proxyHost := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyHost = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	conn, err := nd.DialContext(ctx, "tcp", proxyHost)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: host},
+		Host:   host,
+		Header: http.Header{},
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The proxy sends nothing after its response until the tunnel is
+	// used, so no buffered bytes are lost with the reader.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy CONNECT failed: %s", resp.Status)
+	}
+	return conn, nil
+}
+
+// tlsConfigFor returns a copy of cfg completed with the server name from u
+// and the default ALPN protocol list.
+func tlsConfigFor(u *url.URL, cfg *tls.Config) *tls.Config {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{"http/1.1"}
+	}
+	return cfg
+}
+
+// statusCode extracts the numeric status from an HTTP status line such as
+// "HTTP/1.1 101 Switching Protocols". It returns 0 if the line is malformed.
+func statusCode(line string) int {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return 0
+	}
+	code, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0
+	}
+	return code
+}
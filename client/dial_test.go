@@ -0,0 +1,753 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startMockServer listens on a random local port and runs handle for every
+// accepted connection after the client's handshake request has been read.
+func startMockServer(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to create listener:", err)
+	}
+	return serveMock(t, listener, handle)
+}
+
+// startTLSMockServer is startMockServer over TLS. The server offers the
+// given ALPN protocols and the returned config trusts its certificate.
+func startTLSMockServer(t *testing.T, nextProtos []string, handle func(conn net.Conn)) (string, *tls.Config) {
+	t.Helper()
+	srv := httptest.NewTLSServer(nil)
+	t.Cleanup(srv.Close)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: srv.TLS.Certificates,
+		NextProtos:   nextProtos,
+	})
+	if err != nil {
+		t.Fatal("Failed to create listener:", err)
+	}
+	return serveMock(t, listener, handle), &tls.Config{RootCAs: pool}
+}
+
+// mockKeys maps each mock server connection to the Sec-WebSocket-Key of
+// its handshake request.
+var mockKeys sync.Map
+
+// acceptFor returns the Sec-WebSocket-Accept value answering the handshake
+// request read from conn.
+func acceptFor(conn net.Conn) string {
+	key, _ := mockKeys.Load(conn)
+	s, _ := key.(string)
+	return computeAcceptKey(s)
+}
+
+// serveMock runs the mock server loop described in startMockServer on
+// listener and returns its address.
+func serveMock(t *testing.T, listener net.Listener, handle func(conn net.Conn)) string {
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				defer mockKeys.Delete(conn)
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil || line == "\r\n" {
+						break
+					}
+					if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(name, "Sec-WebSocket-Key") {
+						mockKeys.Store(conn, strings.TrimSpace(value))
+					}
+				}
+				handle(conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// startRequestMockServer is like startMockServer but hands handle the parsed
+// handshake request and the reader it was parsed from.
+func startRequestMockServer(t *testing.T, handle func(conn net.Conn, br *bufio.Reader, req *http.Request)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to create listener:", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				defer mockKeys.Delete(conn)
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				mockKeys.Store(conn, req.Header.Get("Sec-WebSocket-Key"))
+				handle(conn, br, req)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// writeSwitchingProtocols sends a minimal 101 handshake response.
+func writeSwitchingProtocols(conn net.Conn) {
+	conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptFor(conn) + "\r\n" +
+		"\r\n"))
+}
+
+func TestDialFollowsRedirect(t *testing.T) {
+	target := startMockServer(t, func(conn net.Conn) {
+		writeSwitchingProtocols(conn)
+		conn.Write([]byte{0x81, 0x02, 'o', 'k'})
+	})
+	redirector := startMockServer(t, func(conn net.Conn) {
+		conn.Write([]byte("HTTP/1.1 302 Found\r\n" +
+			"Location: http://" + target + "/real\r\n" +
+			"Content-Length: 0\r\n" +
+			"\r\n"))
+	})
+
+	conn, err := Dial("ws://"+redirector+"/ws", WithRedirects(3))
+	if err != nil {
+		t.Fatal("Dial() error:", err)
+	}
+	defer conn.Close()
+
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal("ReadMessage() error:", err)
+	}
+	if string(msg.Data) != "ok" {
+		t.Errorf("Got message %q, want %q", msg.Data, "ok")
+	}
+}
+
+func TestDialRedirectNotFollowedByDefault(t *testing.T) {
+	redirector := startMockServer(t, func(conn net.Conn) {
+		conn.Write([]byte("HTTP/1.1 302 Found\r\nLocation: /elsewhere\r\n\r\n"))
+	})
+
+	if _, err := Dial("ws://" + redirector + "/ws"); err == nil {
+		t.Error("Dial() error = nil, want error for unfollowed redirect")
+	}
+}
+
+func TestDialRedirectLoop(t *testing.T) {
+	var addr string
+	addr = startMockServer(t, func(conn net.Conn) {
+		conn.Write([]byte("HTTP/1.1 307 Temporary Redirect\r\nLocation: ws://" + addr + "/ws\r\n\r\n"))
+	})
+
+	_, err := Dial("ws://"+addr+"/ws", WithRedirects(10))
+	if err == nil || !strings.Contains(err.Error(), "loop") {
+		t.Errorf("Dial() error = %v, want redirect loop error", err)
+	}
+}
+
+func TestDialRedirectStripsCredentials(t *testing.T) {
+	received := make(chan http.Header, 3)
+	target := startRequestMockServer(t, func(conn net.Conn, br *bufio.Reader, req *http.Request) {
+		received <- req.Header
+		writeSwitchingProtocols(conn)
+	})
+	var redirector string
+	redirector = startRequestMockServer(t, func(conn net.Conn, br *bufio.Reader, req *http.Request) {
+		received <- req.Header
+		location := "ws://" + target + "/real"
+		if req.URL.Path == "/ws" {
+			location = "ws://" + redirector + "/same-host"
+		}
+		conn.Write([]byte("HTTP/1.1 307 Temporary Redirect\r\nLocation: " + location + "\r\n\r\n"))
+	})
+
+	d := *DefaultDialer
+	d.MaxRedirects = 3
+	d.Header = http.Header{"Authorization": {"Bearer secret"}, "Cookie": {"session=1"}, "X-Trace": {"abc"}}
+	conn, err := d.Dial("ws://" + redirector + "/ws")
+	if err != nil {
+		t.Fatal("Dial() error:", err)
+	}
+	defer conn.Close()
+
+	for _, hop := range []string{"original", "same host"} {
+		if got := (<-received).Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("Authorization on %s request = %q, want it kept", hop, got)
+		}
+	}
+	got := <-received
+	if got.Get("Authorization") != "" || got.Get("Cookie") != "" {
+		t.Errorf("Credentials sent to another host: %v", got)
+	}
+	if got.Get("X-Trace") != "abc" {
+		t.Errorf("X-Trace = %q, want other headers kept", got.Get("X-Trace"))
+	}
+	if d.Header.Get("Authorization") == "" {
+		t.Error("Dialer.Header was modified")
+	}
+}
+
+func TestDialRedirectRefusesDowngrade(t *testing.T) {
+	plain := startMockServer(t, func(conn net.Conn) {
+		t.Error("Redirect to ws followed from wss")
+		writeSwitchingProtocols(conn)
+	})
+	addr, cfg := startTLSMockServer(t, nil, func(conn net.Conn) {
+		conn.Write([]byte("HTTP/1.1 302 Found\r\nLocation: ws://" + plain + "/ws\r\n\r\n"))
+	})
+
+	_, err := Dial("wss://"+addr+"/ws", WithTLSConfig(cfg), WithRedirects(3))
+	if err == nil || !strings.Contains(err.Error(), "insecure") {
+		t.Errorf("Dial() error = %v, want insecure redirect error", err)
+	}
+}
+
+func TestDialTLSDefaultALPN(t *testing.T) {
+	negotiated := make(chan string, 1)
+	addr, cfg := startTLSMockServer(t, []string{"h2", "http/1.1"}, func(conn net.Conn) {
+		negotiated <- conn.(*tls.Conn).ConnectionState().NegotiatedProtocol
+		writeSwitchingProtocols(conn)
+	})
+
+	conn, err := Dial("wss://"+addr+"/ws", WithTLSConfig(cfg))
+	if err != nil {
+		t.Fatal("Dial() error:", err)
+	}
+	defer conn.Close()
+
+	if got := <-negotiated; got != "http/1.1" {
+		t.Errorf("Negotiated protocol = %q, want %q", got, "http/1.1")
+	}
+}
+
+func TestDialTLSCustomALPN(t *testing.T) {
+	negotiated := make(chan string, 1)
+	addr, cfg := startTLSMockServer(t, []string{"custom/1", "http/1.1"}, func(conn net.Conn) {
+		negotiated <- conn.(*tls.Conn).ConnectionState().NegotiatedProtocol
+		writeSwitchingProtocols(conn)
+	})
+	cfg.NextProtos = []string{"custom/1"}
+
+	conn, err := Dial("wss://"+addr+"/ws", WithTLSConfig(cfg))
+	if err != nil {
+		t.Fatal("Dial() error:", err)
+	}
+	defer conn.Close()
+
+	if got := <-negotiated; got != "custom/1" {
+		t.Errorf("Negotiated protocol = %q, want %q", got, "custom/1")
+	}
+}
+
+func TestDialLenientCapturesResponse(t *testing.T) {
+	addr := startMockServer(t, func(conn net.Conn) {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"X-Reason: missing-token\r\n" +
+			"Content-Length: 11\r\n" +
+			"\r\n" +
+			"bad request"))
+	})
+
+	_, err := Dial("ws://"+addr+"/ws", WithLenientHandshake())
+	var respErr *HandshakeResponseError
+	if !errors.As(err, &respErr) {
+		t.Fatalf("Dial() error = %v, want *HandshakeResponseError", err)
+	}
+	if respErr.StatusCode != 400 || respErr.StatusLine != "HTTP/1.1 400 Bad Request" {
+		t.Errorf("Status = %d %q, want 400 %q", respErr.StatusCode, respErr.StatusLine, "HTTP/1.1 400 Bad Request")
+	}
+	if got := respErr.Header.Get("X-Reason"); got != "missing-token" {
+		t.Errorf("X-Reason header = %q, want %q", got, "missing-token")
+	}
+	if string(respErr.Body) != "bad request" {
+		t.Errorf("Body = %q, want %q", respErr.Body, "bad request")
+	}
+}
+
+func TestDialStrictByDefault(t *testing.T) {
+	addr := startMockServer(t, func(conn net.Conn) {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"))
+	})
+
+	_, err := Dial("ws://" + addr + "/ws")
+	var respErr *HandshakeResponseError
+	if err == nil || errors.As(err, &respErr) {
+		t.Errorf("Dial() error = %v, want plain handshake error", err)
+	}
+}
+
+func TestDialerOptionsApplied(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	addr := startRequestMockServer(t, func(conn net.Conn, br *bufio.Reader, req *http.Request) {
+		requests <- req
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + computeAcceptKey(req.Header.Get("Sec-WebSocket-Key")) + "\r\n" +
+			"Sec-WebSocket-Protocol: chat.v1\r\n" +
+			"\r\n"))
+	})
+
+	d := &Dialer{
+		HandshakeTimeout: time.Second,
+		Subprotocols:     []string{"chat.v2", "chat.v1"},
+		Header: http.Header{
+			"Authorization": {"Bearer token"},
+			"Origin":        {"https://app.example.com"},
+		},
+		ReadBufferSize:  512,
+		WriteBufferSize: 256,
+	}
+	conn, err := d.DialContext(context.Background(), "ws://"+addr+"/ws")
+	if err != nil {
+		t.Fatal("DialContext error:", err)
+	}
+	defer conn.Close()
+
+	req := <-requests
+	if got := req.Header.Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Authorization = %q, want %q", got, "Bearer token")
+	}
+	if got := req.Header.Values("Origin"); len(got) != 1 || got[0] != "https://app.example.com" {
+		t.Errorf("Origin = %q, want only %q", got, "https://app.example.com")
+	}
+	if got := req.Header.Get("Sec-WebSocket-Protocol"); got != "chat.v2, chat.v1" {
+		t.Errorf("Sec-WebSocket-Protocol = %q, want %q", got, "chat.v2, chat.v1")
+	}
+	if got := conn.Subprotocol(); got != "chat.v1" {
+		t.Errorf("Subprotocol() = %q, want %q", got, "chat.v1")
+	}
+	if got := conn.br.Size(); got != 512 {
+		t.Errorf("Read buffer size = %d, want 512", got)
+	}
+	if got := conn.bw.Size(); got != 256 {
+		t.Errorf("Write buffer size = %d, want 256", got)
+	}
+}
+
+func TestDialerHandshakeTimeout(t *testing.T) {
+	addr := startMockServer(t, func(conn net.Conn) {
+		time.Sleep(time.Second)
+	})
+
+	// Connecting is quick, so only HandshakeTimeout can stop the wait.
+	d := &Dialer{DialTimeout: time.Second, HandshakeTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	_, err := d.Dial("ws://" + addr + "/ws")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Dial() error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Dial took %v, want about 50ms", elapsed)
+	}
+}
+
+func TestDialerDialTimeoutExcludesResponse(t *testing.T) {
+	addr := startMockServer(t, func(conn net.Conn) {
+		time.Sleep(200 * time.Millisecond)
+		writeSwitchingProtocols(conn)
+	})
+
+	// A response slower than DialTimeout is fine as long as it arrives
+	// within HandshakeTimeout.
+	d := &Dialer{DialTimeout: 50 * time.Millisecond, HandshakeTimeout: 2 * time.Second}
+	conn, err := d.Dial("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal("Dial() error:", err)
+	}
+	conn.Close()
+}
+
+func TestDialerProxy(t *testing.T) {
+	targets := make(chan string, 1)
+	proxyAddr := startRequestMockServer(t, func(conn net.Conn, br *bufio.Reader, req *http.Request) {
+		if req.Method != http.MethodConnect {
+			t.Errorf("Proxy got %s, want CONNECT", req.Method)
+			return
+		}
+		targets <- req.Host + " " + req.Header.Get("Proxy-Authorization")
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+		// Play the WebSocket server at the end of the tunnel.
+		upgrade, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		mockKeys.Store(conn, upgrade.Header.Get("Sec-WebSocket-Key"))
+		writeSwitchingProtocols(conn)
+	})
+
+	d := &Dialer{
+		Proxy: func(*url.URL) (*url.URL, error) {
+			return url.Parse("http://user:pass@" + proxyAddr)
+		},
+	}
+	conn, err := d.Dial("ws://backend.test:9000/ws")
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	conn.Close()
+
+	want := "backend.test:9000 Basic dXNlcjpwYXNz"
+	if got := <-targets; got != want {
+		t.Errorf("Proxy saw %q, want %q", got, want)
+	}
+}
+
+func TestDialerUnexpectedSubprotocol(t *testing.T) {
+	addr := startMockServer(t, func(conn net.Conn) {
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + acceptFor(conn) + "\r\n" +
+			"Sec-WebSocket-Protocol: mqtt\r\n" +
+			"\r\n"))
+	})
+
+	d := &Dialer{Subprotocols: []string{"chat.v1"}}
+	if _, err := d.Dial("ws://" + addr + "/ws"); err == nil {
+		t.Error("Dial accepted a subprotocol that was not offered")
+	}
+}
+
+func TestDialerRepeatedSubprotocolHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines string
+		want  string
+		fails bool
+	}{
+		{"Empty line ignored", "Sec-WebSocket-Protocol: chat.v1\r\nSec-WebSocket-Protocol: \r\n", "chat.v1", false},
+		{"Two lines", "Sec-WebSocket-Protocol: chat.v1\r\nSec-WebSocket-Protocol: chat.v2\r\n", "", true},
+		{"One list", "Sec-WebSocket-Protocol: chat.v1, chat.v2\r\n", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startMockServer(t, func(conn net.Conn) {
+				conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+					"Upgrade: websocket\r\n" +
+					"Connection: Upgrade\r\n" +
+					"Sec-WebSocket-Accept: " + acceptFor(conn) + "\r\n" +
+					tt.lines +
+					"\r\n"))
+			})
+
+			d := &Dialer{Subprotocols: []string{"chat.v1", "chat.v2"}}
+			conn, err := d.Dial("ws://" + addr + "/ws")
+			if tt.fails {
+				if err == nil {
+					conn.Close()
+					t.Error("Dial accepted more than one selected subprotocol")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Dial error:", err)
+			}
+			defer conn.Close()
+			if got := conn.Subprotocol(); got != tt.want {
+				t.Errorf("Subprotocol() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialUpgradeResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		response func(conn net.Conn) string
+		wantErr  bool
+	}{
+		{"Valid", func(conn net.Conn) string {
+			return "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + acceptFor(conn) + "\r\n"
+		}, false},
+		{"Mixed case", func(conn net.Conn) string {
+			return "Upgrade: WebSocket\r\nConnection: keep-alive, UPGRADE\r\nSec-WebSocket-Accept: " + acceptFor(conn) + "\r\n"
+		}, false},
+		{"Missing Upgrade", func(conn net.Conn) string {
+			return "Connection: Upgrade\r\nSec-WebSocket-Accept: " + acceptFor(conn) + "\r\n"
+		}, true},
+		{"Wrong Upgrade", func(conn net.Conn) string {
+			return "Upgrade: h2c\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + acceptFor(conn) + "\r\n"
+		}, true},
+		{"Missing Connection", func(conn net.Conn) string {
+			return "Upgrade: websocket\r\nSec-WebSocket-Accept: " + acceptFor(conn) + "\r\n"
+		}, true},
+		{"Missing accept", func(conn net.Conn) string {
+			return "Upgrade: websocket\r\nConnection: Upgrade\r\n"
+		}, true},
+		{"Wrong accept", func(conn net.Conn) string {
+			return "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n"
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startMockServer(t, func(conn net.Conn) {
+				conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" + tt.response(conn) + "\r\n"))
+			})
+
+			conn, err := Dial("ws://" + addr + "/ws")
+			if err == nil {
+				conn.Close()
+			}
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("Dial() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDialerHeaderLimits(t *testing.T) {
+	// The server never ends its headers; it stops only when the client
+	// hangs up.
+	endless := func(line string) func(conn net.Conn) {
+		return func(conn net.Conn) {
+			if _, err := conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n")); err != nil {
+				return
+			}
+			for {
+				if _, err := conn.Write([]byte(line)); err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		line   string
+		dialer *Dialer
+	}{
+		{"Header count", "X-Filler: a\r\n", &Dialer{MaxHeaderCount: 10}},
+		{"Header bytes", "X-Filler: " + strings.Repeat("a", 1000) + "\r\n", &Dialer{MaxHeaderBytes: 4096}},
+		{"Endless line", strings.Repeat("a", 1000), &Dialer{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startMockServer(t, endless(tt.line))
+			_, err := tt.dialer.Dial("ws://" + addr + "/ws")
+			if !errors.Is(err, ErrHeaderTooLarge) {
+				t.Errorf("Dial() error = %v, want ErrHeaderTooLarge", err)
+			}
+		})
+	}
+}
+
+func TestDialerSocketBuffers(t *testing.T) {
+	addr := startMockServer(t, func(conn net.Conn) {
+		writeSwitchingProtocols(conn)
+	})
+
+	d := &Dialer{SocketReadBuffer: 64 << 10, SocketWriteBuffer: 64 << 10}
+	conn, err := d.Dial("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal("Dial() error:", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.conn.(*net.TCPConn); !ok {
+		t.Fatalf("Conn is %T, want *net.TCPConn", conn.conn)
+	}
+	if err := setSocketBuffers(conn.conn, d.SocketReadBuffer, d.SocketWriteBuffer); err != nil {
+		t.Errorf("setSocketBuffers() error: %v", err)
+	}
+}
+
+func TestConnConnectionState(t *testing.T) {
+	addr, cfg := startTLSMockServer(t, []string{"http/1.1"}, func(conn net.Conn) {
+		writeSwitchingProtocols(conn)
+	})
+
+	conn, err := Dial("wss://"+addr+"/ws", WithTLSConfig(cfg))
+	if err != nil {
+		t.Fatal("Dial() error:", err)
+	}
+	defer conn.Close()
+
+	state, ok := conn.ConnectionState()
+	if !ok {
+		t.Fatal("ConnectionState() ok = false for a wss connection")
+	}
+	if !state.HandshakeComplete || state.Version < tls.VersionTLS12 || state.CipherSuite == 0 {
+		t.Errorf("ConnectionState() = complete %v, version %#x, cipher %#x", state.HandshakeComplete, state.Version, state.CipherSuite)
+	}
+	if len(state.PeerCertificates) == 0 {
+		t.Error("ConnectionState() has no peer certificates")
+	}
+
+	plain := startMockServer(t, func(conn net.Conn) {
+		writeSwitchingProtocols(conn)
+	})
+	conn2, err := Dial("ws://" + plain + "/ws")
+	if err != nil {
+		t.Fatal("Dial() error:", err)
+	}
+	defer conn2.Close()
+	if _, ok := conn2.ConnectionState(); ok {
+		t.Error("ConnectionState() ok = true for a ws connection")
+	}
+}
+
+func TestDialerOnHandshakeComplete(t *testing.T) {
+	type result struct {
+		d   time.Duration
+		err error
+	}
+	results := make(chan result, 1)
+	d := &Dialer{OnHandshakeComplete: func(d time.Duration, err error) {
+		results <- result{d, err}
+	}}
+
+	addr := startMockServer(t, func(conn net.Conn) {
+		writeSwitchingProtocols(conn)
+	})
+	conn, err := d.Dial("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	conn.Close()
+	if r := <-results; r.err != nil || r.d <= 0 {
+		t.Errorf("Successful handshake reported %v, %v, want a positive duration and no error", r.d, r.err)
+	}
+
+	refused := startMockServer(t, func(conn net.Conn) {
+		conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+	})
+	_, err = d.Dial("ws://" + refused + "/ws")
+	if err == nil {
+		t.Fatal("Dial succeeded against a server that refused the upgrade")
+	}
+	if r := <-results; r.err != err {
+		t.Errorf("Failed handshake reported error %v, want %v", r.err, err)
+	}
+}
+
+func TestDialerSubprotocolMessageTypes(t *testing.T) {
+	tests := []struct {
+		name     string
+		selected string
+		want     byte
+	}{
+		{"Binary subprotocol", "bin.v1", OpBinary},
+		{"Unmapped subprotocol", "chat.v1", OpText},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := make(chan Frame, 1)
+			addr := startRequestMockServer(t, func(conn net.Conn, br *bufio.Reader, req *http.Request) {
+				conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+					"Upgrade: websocket\r\n" +
+					"Connection: Upgrade\r\n" +
+					"Sec-WebSocket-Accept: " + acceptFor(conn) + "\r\n" +
+					"Sec-WebSocket-Protocol: " + tt.selected + "\r\n" +
+					"\r\n"))
+				f, _, err := readFrame(br)
+				if err != nil {
+					t.Error("Reading client frame:", err)
+				}
+				frames <- f
+			})
+
+			d := &Dialer{
+				Subprotocols:            []string{tt.selected},
+				SubprotocolMessageTypes: map[string]byte{"bin.v1": OpBinary},
+			}
+			conn, err := d.Dial("ws://" + addr + "/ws")
+			if err != nil {
+				t.Fatal("Dial error:", err)
+			}
+			defer conn.Close()
+			if got := conn.MessageType(); got != tt.want {
+				t.Errorf("MessageType() = %#x, want %#x", got, tt.want)
+			}
+
+			if err := conn.Send([]byte("hello")); err != nil {
+				t.Fatal("Send error:", err)
+			}
+			if f := <-frames; f.Opcode != tt.want || string(f.Payload) != "hello" {
+				t.Errorf("Send wrote %#x %q, want %#x %q", f.Opcode, f.Payload, tt.want, "hello")
+			}
+		})
+	}
+}
+
+func TestDialFrameInHandshakeWrite(t *testing.T) {
+	tests := []struct {
+		name       string
+		bufferSize int
+	}{
+		{"Default buffer", 0},
+		{"Small buffer", 16},
+		{"Large buffer", 64 << 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startMockServer(t, func(conn net.Conn) {
+				// The response and the first frame go out in one write,
+				// so they typically arrive in the same read.
+				conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+					"Upgrade: websocket\r\n" +
+					"Connection: Upgrade\r\n" +
+					"Sec-WebSocket-Accept: " + acceptFor(conn) + "\r\n" +
+					"\r\n" +
+					"\x81\x05hello"))
+			})
+
+			d := &Dialer{ReadBufferSize: tt.bufferSize}
+			conn, err := d.Dial("ws://" + addr + "/ws")
+			if err != nil {
+				t.Fatal("Dial error:", err)
+			}
+			defer conn.Close()
+
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal("ReadMessage error:", err)
+			}
+			if msg.Opcode != OpText || string(msg.Data) != "hello" {
+				t.Errorf("ReadMessage() = %#x %q, want text %q", msg.Opcode, msg.Data, "hello")
+			}
+		})
+	}
+}
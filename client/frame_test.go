@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestEmptyFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		masked  bool
+		wireLen int
+	}{
+		{"Unmasked", false, 2},
+		{"Masked", true, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := bufio.NewWriter(&buf)
+			n, err := writeFrame(w, Frame{Fin: true, Opcode: OpText, Masked: tt.masked})
+			if err != nil {
+				t.Fatal("writeFrame() error:", err)
+			}
+			w.Flush()
+			if n != tt.wireLen || buf.Len() != tt.wireLen {
+				t.Errorf("writeFrame() wrote %d bytes (%d buffered), want %d", n, buf.Len(), tt.wireLen)
+			}
+
+			f, n, err := readFrame(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatal("readFrame() error:", err)
+			}
+			if n != tt.wireLen || f.Masked != tt.masked || len(f.Payload) != 0 {
+				t.Errorf("readFrame() = masked %v, %d payload bytes, %d wire bytes", f.Masked, len(f.Payload), n)
+			}
+		})
+	}
+}
+
+func TestReadEmptyMaskedFrame(t *testing.T) {
+	// A masked text frame with a mask key and no payload bytes.
+	input := []byte{0x81, 0x80, 0x12, 0x34, 0x56, 0x78}
+	f, n, err := readFrame(bufio.NewReader(bytes.NewReader(input)))
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if n != len(input) || !f.Masked || len(f.Payload) != 0 {
+		t.Errorf("readFrame() = masked %v, %d payload bytes, %d wire bytes", f.Masked, len(f.Payload), n)
+	}
+	if f.MaskKey != [4]byte{0x12, 0x34, 0x56, 0x78} {
+		t.Errorf("MaskKey = %v", f.MaskKey)
+	}
+}
+
+func TestFrameLen(t *testing.T) {
+	tests := []struct {
+		payloadLen int
+		masked     bool
+		want       int
+	}{
+		{0, false, 2},
+		{0, true, 6},
+		{125, false, 127},
+		{125, true, 131},
+		{126, false, 130},
+		{126, true, 134},
+		{0xFFFF, false, 0xFFFF + 4},
+		{0xFFFF, true, 0xFFFF + 8},
+		{0x10000, false, 0x10000 + 10},
+		{0x10000, true, 0x10000 + 14},
+	}
+	for _, tt := range tests {
+		got := FrameLen(tt.payloadLen, tt.masked)
+		if got != tt.want {
+			t.Errorf("FrameLen(%d, %v) = %d, want %d", tt.payloadLen, tt.masked, got, tt.want)
+		}
+
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		n, err := writeFrame(w, Frame{Fin: true, Opcode: OpBinary, Masked: tt.masked, Payload: make([]byte, tt.payloadLen)})
+		if err != nil {
+			t.Fatal("writeFrame() error:", err)
+		}
+		if n != got {
+			t.Errorf("writeFrame() wrote %d bytes for payload %d, FrameLen = %d", n, tt.payloadLen, got)
+		}
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	// Seeds from the TestReadTextMessage cases, plus frames with
+	// extended lengths.
+	for _, seed := range [][]byte{
+		{0x81, 0x05, 'H', 'e', 'l', 'l', 'o'},
+		{0x00, 0x05, 'H', 'e', 'l', 'l', 'o'},
+		{0x82, 0x05, 'H', 'e', 'l', 'l', 'o'},
+		{0x81, 0x80, 0x00, 0x00, 0x00, 0x00},
+		{0x81, 0x00},
+		{0x81, 0x7E, 0x00, 0x7E},
+		{0x82, 0x7F, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xAB, 0xCD},
+		{0x89, 0x85, 0x01, 0x02, 0x03, 0x04, 'p', 'i', 'n', 'g', '!'},
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frame, n, err := readFrame(bufio.NewReader(bytes.NewReader(data)))
+		if n > len(data) {
+			t.Fatalf("readFrame() consumed %d bytes of %d", n, len(data))
+		}
+		if err == nil && len(frame.Payload) > n {
+			t.Fatalf("readFrame() payload %d bytes, but only %d bytes consumed", len(frame.Payload), n)
+		}
+	})
+}
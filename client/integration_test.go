@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startRealServer builds the server module next to this one, runs it on a
+// free local port and returns its address. The server is a main package in
+// its own module, so it cannot be imported and runs as a subprocess.
+func startRealServer(t testing.TB) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("Skipping server build in short mode")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not available:", err)
+	}
+
+	bin := filepath.Join(t.TempDir(), "server")
+	build := exec.Command(goTool, "build", "-o", bin, ".")
+	build.Dir = filepath.Join("..", "server")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("Building server: %v\n%s", err, out)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to pick a port:", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	cmd := exec.Command(bin, "-addr", addr)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal("Starting server:", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Server did not start listening:", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestIntegration runs the real server binary and talks to it with Dial.
+func TestIntegration(t *testing.T) {
+	addr := startRealServer(t)
+
+	t.Run("Greeting", func(t *testing.T) {
+		conn, err := Dial("ws://" + addr + "/ws")
+		if err != nil {
+			t.Fatal("Dial error:", err)
+		}
+		defer conn.Close()
+
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal("ReadMessage() error:", err)
+		}
+		if msg.Opcode != OpText || string(msg.Data) != "Hello World" {
+			t.Errorf("ReadMessage() = %#x %q, want text %q", msg.Opcode, msg.Data, "Hello World")
+		}
+		var closeErr *CloseError
+		if _, err := conn.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != CloseNormalClosure {
+			t.Errorf("ReadMessage() error = %v, want close 1000", err)
+		}
+	})
+
+	t.Run("Echo", func(t *testing.T) {
+		conn, err := Dial("ws://"+addr+"/echo", WithCompression())
+		if err != nil {
+			t.Fatal("Dial error:", err)
+		}
+		defer conn.Close()
+
+		for _, want := range []Message{
+			{Opcode: OpText, Data: []byte("Hello")},
+			{Opcode: OpBinary, Data: []byte{0x00, 0x01, 0xff}},
+			{Opcode: OpText, Data: []byte{}},
+			{Opcode: OpBinary, Data: []byte{}},
+		} {
+			if err := conn.WriteMessage(want.Opcode, want.Data); err != nil {
+				t.Fatal("WriteMessage() error:", err)
+			}
+			got, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal("ReadMessage() error:", err)
+			}
+			if got.Opcode != want.Opcode || got.Data == nil || string(got.Data) != string(want.Data) {
+				t.Errorf("Echo = %#x %q, want %#x %q", got.Opcode, got.Data, want.Opcode, want.Data)
+			}
+		}
+
+		// The pong is recorded by the ReadMessage that returns the next
+		// echo, which the server sends after it.
+		if err := conn.writeFrame(Frame{Fin: true, Opcode: OpPing, Payload: []byte("ping")}); err != nil {
+			t.Fatal("Ping error:", err)
+		}
+		if err := conn.WriteMessage(OpText, []byte("after ping")); err != nil {
+			t.Fatal("WriteMessage() error:", err)
+		}
+		if _, err := conn.ReadMessage(); err != nil {
+			t.Fatal("ReadMessage() error:", err)
+		}
+		if conn.lastPong.Load() == 0 {
+			t.Error("No pong received for ping")
+		}
+
+		if err := conn.sendClose(CloseNormalClosure); err != nil {
+			t.Fatal("sendClose() error:", err)
+		}
+		var closeErr *CloseError
+		if _, err := conn.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != CloseNormalClosure {
+			t.Errorf("ReadMessage() error = %v, want close 1000", err)
+		}
+	})
+}
+
+// benchmarkConns is how many connections BenchmarkIntegrationEcho keeps
+// open at once.
+const benchmarkConns = 64
+
+// BenchmarkIntegrationEcho measures echo round trips against the real
+// server over benchmarkConns concurrent connections. Like the other
+// integration tests it builds the server, so it is skipped with -short.
+func BenchmarkIntegrationEcho(b *testing.B) {
+	addr := startRealServer(b)
+	payload := []byte(strings.Repeat("x", 128))
+
+	conns := make(chan *Conn, benchmarkConns)
+	for i := 0; i < benchmarkConns; i++ {
+		conn, err := Dial("ws://" + addr + "/echo")
+		if err != nil {
+			b.Fatal("Dial error:", err)
+		}
+		conn.CloseGracePeriod = 0
+		defer conn.Close()
+		conns <- conn
+	}
+
+	b.ReportAllocs()
+	b.SetParallelism((benchmarkConns + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// RunParallel may start a few more goroutines than there are
+		// connections; the spare ones leave the iterations to the rest.
+		var conn *Conn
+		select {
+		case conn = <-conns:
+		default:
+			return
+		}
+		for pb.Next() {
+			if err := conn.WriteMessage(OpBinary, payload); err != nil {
+				b.Error("WriteMessage error:", err)
+				return
+			}
+			if _, err := conn.ReadMessage(); err != nil {
+				b.Error("ReadMessage error:", err)
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+}
+
+// BenchmarkIntegrationHandshake measures how fast concurrent clients can
+// complete opening handshakes with the real server.
+func BenchmarkIntegrationHandshake(b *testing.B) {
+	addr := startRealServer(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn, err := Dial("ws://" + addr + "/echo")
+			if err != nil {
+				b.Error("Dial error:", err)
+				return
+			}
+			conn.close(false)
+		}
+	})
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "handshakes/s")
+}
@@ -0,0 +1,38 @@
+package main
+
+import "time"
+
+// keepAlive pings the server every interval and closes the connection when
+// no pong arrives within timeout of a ping. Pongs are only noticed while
+// the application is reading, which is where a long-lived client spends
+// its time anyway. It returns when the connection is closed.
+func (c *Conn) keepAlive(interval, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+
+		sent := time.Now()
+		if err := c.writeFrame(Frame{Fin: true, Opcode: OpPing}); err != nil {
+			c.close(false)
+			return
+		}
+
+		select {
+		case <-time.After(timeout):
+			if c.lastPong.Load() < sent.UnixNano() {
+				c.close(false)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestKeepAlivePongTimeout(t *testing.T) {
+	pings := make(chan int, 10)
+	addr := startRequestMockServer(t, func(conn net.Conn, br *bufio.Reader, req *http.Request) {
+		writeSwitchingProtocols(conn)
+		bw := bufio.NewWriter(conn)
+		for n := 1; ; n++ {
+			f, _, err := readFrame(br)
+			if err != nil {
+				return
+			}
+			if f.Opcode != OpPing {
+				continue
+			}
+			pings <- n
+			// Answer the first two pings, then go silent.
+			if n <= 2 {
+				writeFrame(bw, Frame{Fin: true, Opcode: OpPong, Payload: f.Payload})
+				bw.Flush()
+			}
+		}
+	})
+
+	d := &Dialer{PingInterval: 20 * time.Millisecond, PongTimeout: 50 * time.Millisecond}
+	conn, err := d.Dial("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.ReadMessage()
+		errs <- err
+	}()
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("ReadMessage() succeeded, want error after pong timeout")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connection still open after pongs stopped")
+	}
+	if n := len(pings); n < 3 {
+		t.Errorf("Server saw %d pings before the disconnect, want at least 3", n)
+	}
+}
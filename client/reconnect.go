@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// CloseAction is what Dialer.Run does after the server closes a
+// connection.
+type CloseAction int
+
+const (
+	// CloseStop makes Run return the *CloseError.
+	CloseStop CloseAction = iota
+	// CloseReconnect makes Run dial again after ReconnectDelay.
+	CloseReconnect
+)
+
+// DefaultClosePolicy reconnects when the server says it is going away,
+// restarting or temporarily overloaded, and stops on anything else.
+var DefaultClosePolicy = map[uint16]CloseAction{
+	CloseGoingAway:      CloseReconnect,
+	CloseServiceRestart: CloseReconnect,
+	CloseTryAgainLater:  CloseReconnect,
+}
+
+// Run connects to serverURL and calls fn with the connection, which is
+// closed when fn returns. If fn returns a *CloseError (typically passed
+// on from ReadMessage) whose code ClosePolicy maps to CloseReconnect, Run
+// waits ReconnectDelay and starts over with a new connection. Otherwise it
+// returns fn's result. Run also returns when ctx ends.
+func (d *Dialer) Run(ctx context.Context, serverURL string, fn func(*Conn) error) error {
+	policy := d.ClosePolicy
+	if policy == nil {
+		policy = DefaultClosePolicy
+	}
+	for {
+		conn, err := d.DialContext(ctx, serverURL)
+		if err != nil {
+			return err
+		}
+		err = fn(conn)
+		conn.Close()
+
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) || policy[closeErr.Code] != CloseReconnect {
+			return err
+		}
+		select {
+		case <-time.After(d.ReconnectDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDialerRunClosePolicy(t *testing.T) {
+	// The first connection is closed with 1013 (try again later), every
+	// later one with 1008 (policy violation).
+	var connections atomic.Int32
+	addr := startMockServer(t, func(conn net.Conn) {
+		writeSwitchingProtocols(conn)
+		code := ClosePolicyViolation
+		if connections.Add(1) == 1 {
+			code = CloseTryAgainLater
+		}
+		bw := bufio.NewWriter(conn)
+		writeFrame(bw, Frame{Fin: true, Opcode: OpClose, Payload: binary.BigEndian.AppendUint16(nil, code)})
+		bw.Flush()
+		readFrame(bufio.NewReader(conn))
+	})
+
+	d := &Dialer{}
+	err := d.Run(context.Background(), "ws://"+addr+"/ws", func(c *Conn) error {
+		for {
+			if _, err := c.ReadMessage(); err != nil {
+				return err
+			}
+		}
+	})
+
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != ClosePolicyViolation {
+		t.Errorf("Run() error = %v, want close 1008", err)
+	}
+	if got := connections.Load(); got != 2 {
+		t.Errorf("Connections = %d, want 2", got)
+	}
+}
+
+func TestDialerRunCustomClosePolicy(t *testing.T) {
+	var connections atomic.Int32
+	addr := startMockServer(t, func(conn net.Conn) {
+		writeSwitchingProtocols(conn)
+		connections.Add(1)
+		bw := bufio.NewWriter(conn)
+		writeFrame(bw, Frame{Fin: true, Opcode: OpClose, Payload: binary.BigEndian.AppendUint16(nil, CloseTryAgainLater)})
+		bw.Flush()
+		readFrame(bufio.NewReader(conn))
+	})
+
+	// With 1013 mapped to stop, the first close ends Run.
+	d := &Dialer{ClosePolicy: map[uint16]CloseAction{CloseGoingAway: CloseReconnect}}
+	err := d.Run(context.Background(), "ws://"+addr+"/ws", func(c *Conn) error {
+		_, err := c.ReadMessage()
+		return err
+	})
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseTryAgainLater {
+		t.Errorf("Run() error = %v, want close 1013", err)
+	}
+	if got := connections.Load(); got != 1 {
+		t.Errorf("Connections = %d, want 1", got)
+	}
+}
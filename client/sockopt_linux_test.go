@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// keepAliveSettings reads back SO_KEEPALIVE, TCP_KEEPIDLE and
+// TCP_KEEPINTVL (in seconds) from conn.
+func keepAliveSettings(t *testing.T, conn net.Conn) (enabled bool, idle, interval int) {
+	t.Helper()
+	tcp := tcpConn(conn)
+	if tcp == nil {
+		t.Fatalf("Conn is %T, want a TCP connection", conn)
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		t.Fatal("SyscallConn error:", err)
+	}
+	var on int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if on, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); sockErr != nil {
+			return
+		}
+		if idle, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); sockErr != nil {
+			return
+		}
+		interval, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		t.Fatal("Getsockopt error:", err)
+	}
+	return on != 0, idle, interval
+}
+
+func TestDialerTCPKeepAlive(t *testing.T) {
+	addr := startMockServer(t, func(conn net.Conn) {
+		writeSwitchingProtocols(conn)
+	})
+
+	d := &Dialer{TCPKeepAliveIdle: 42 * time.Second, TCPKeepAliveInterval: 7 * time.Second}
+	conn, err := d.Dial("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal("Dial() error:", err)
+	}
+	defer conn.Close()
+
+	enabled, idle, interval := keepAliveSettings(t, conn.conn)
+	if !enabled || idle != 42 || interval != 7 {
+		t.Errorf("Keepalive = enabled %v, idle %ds, interval %ds, want enabled, 42s, 7s", enabled, idle, interval)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Splitter reads logical messages that a server packs into text messages
+// separated by a delimiter, as some legacy servers do with newlines. A
+// record may also be split across messages: whatever follows the last
+// delimiter of a message is kept and completed by the next one. Create one
+// with Conn.Split and do not mix its reads with ReadMessage.
+type Splitter struct {
+	conn      *Conn
+	delimiter []byte
+
+	records [][]byte
+	partial []byte
+}
+
+// Split returns a Splitter reading records separated by delimiter.
+func (c *Conn) Split(delimiter []byte) *Splitter {
+	return &Splitter{conn: c, delimiter: delimiter}
+}
+
+// ReadRecord returns the next complete record, without its delimiter,
+// reading further messages as needed. A partial record still buffered
+// when the connection closes is dropped, and the read error returned.
+func (s *Splitter) ReadRecord() ([]byte, error) {
+	for len(s.records) == 0 {
+		msg, err := s.conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg.Opcode != OpText {
+			return nil, fmt.Errorf("Expected a text message, got opcode %#x", msg.Opcode)
+		}
+		parts := bytes.Split(append(s.partial, msg.Data...), s.delimiter)
+		s.records = parts[:len(parts)-1]
+		s.partial = parts[len(parts)-1]
+	}
+	record := s.records[0]
+	s.records = s.records[1:]
+	return record, nil
+}
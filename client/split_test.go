@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+func TestSplitterReadRecord(t *testing.T) {
+	addr := startMockServer(t, func(conn net.Conn) {
+		writeSwitchingProtocols(conn)
+		bw := bufio.NewWriter(conn)
+		// Two records in one frame, then a third split across two frames.
+		writeFrame(bw, Frame{Fin: true, Opcode: OpText, Payload: []byte("one\ntwo\nthr")})
+		writeFrame(bw, Frame{Fin: true, Opcode: OpText, Payload: []byte("ee\n")})
+		bw.Flush()
+	})
+
+	conn, err := Dial("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+
+	s := conn.Split([]byte("\n"))
+	for _, want := range []string{"one", "two", "three"} {
+		record, err := s.ReadRecord()
+		if err != nil {
+			t.Fatal("ReadRecord() error:", err)
+		}
+		if string(record) != want {
+			t.Errorf("ReadRecord() = %q, want %q", record, want)
+		}
+	}
+	if _, err := s.ReadRecord(); err == nil {
+		t.Error("ReadRecord() succeeded after the server hung up")
+	}
+}
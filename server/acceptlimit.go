@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// AcceptLimiter wraps a net.Listener and paces Accept with a token bucket,
+// so a burst of new connections is smoothed out before any HTTP or
+// WebSocket work is done for them. It works with http.Serve as well as
+// Upgrader.Serve.
+type AcceptLimiter struct {
+	net.Listener
+
+	// Rate is the number of connections admitted per second on average,
+	// and Burst how many may be admitted back to back after a quiet
+	// period. A Burst below one is treated as one, and a Rate of zero
+	// or less disables the limit.
+	Rate  float64
+	Burst int
+
+	// MaxWait, if positive, bounds how long a connection is held back. A
+	// connection that would have to wait longer is closed straight away
+	// instead. Zero delays every connection for as long as needed.
+	MaxWait time.Duration
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	// done is closed by Close; it is made lazily so that the zero value
+	// with a Listener set is usable.
+	done chan struct{}
+}
+
+// NewAcceptLimiter returns l limited to rate connections per second with
+// the given burst.
+func NewAcceptLimiter(l net.Listener, rate float64, burst int) *AcceptLimiter {
+	return &AcceptLimiter{Listener: l, Rate: rate, Burst: burst}
+}
+
+// Accept waits for the next connection and then for a token to admit it.
+// Connections rejected because of MaxWait are closed and never returned.
+func (l *AcceptLimiter) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		wait, ok := l.reserve(time.Now())
+		if !ok {
+			conn.Close()
+			continue
+		}
+		if wait <= 0 {
+			return conn, nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			return conn, nil
+		case <-l.closed():
+			timer.Stop()
+			conn.Close()
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+// Close closes the listener, also ending an Accept waiting for a token.
+func (l *AcceptLimiter) Close() error {
+	done := l.closed()
+	l.mu.Lock()
+	select {
+	case <-done:
+	default:
+		close(done)
+	}
+	l.mu.Unlock()
+	return l.Listener.Close()
+}
+
+// closed returns the channel closed by Close.
+func (l *AcceptLimiter) closed() chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done == nil {
+		l.done = make(chan struct{})
+	}
+	return l.done
+}
+
+// reserve takes a token for a connection arriving at now and returns how
+// long the connection has to wait for it. The bucket may go into debt, so
+// connections waiting at the same time are spaced out at Rate. ok is false
+// if the wait would exceed MaxWait, in which case no token is taken.
+func (l *AcceptLimiter) reserve(now time.Time) (wait time.Duration, ok bool) {
+	if l.Rate <= 0 {
+		return 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	burst := float64(max(l.Burst, 1))
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else {
+		l.tokens = min(burst, l.tokens+now.Sub(l.last).Seconds()*l.Rate)
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		wait = time.Duration((1 - l.tokens) / l.Rate * float64(time.Second))
+	}
+	if l.MaxWait > 0 && wait > l.MaxWait {
+		return 0, false
+	}
+	l.tokens--
+	return wait, true
+}
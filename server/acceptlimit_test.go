@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAcceptLimiter(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen error:", err)
+	}
+	l := NewAcceptLimiter(inner, 20, 1)
+	defer l.Close()
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal("Dial error:", err)
+		}
+		defer conn.Close()
+	}
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal("Accept error:", err)
+		}
+		conn.Close()
+	}
+	// The first connection uses the burst; each of the others waits for
+	// a token, 50ms apart.
+	if elapsed, want := time.Since(start), (n-1)*50*time.Millisecond; elapsed < want*9/10 {
+		t.Errorf("Accepted %d connections in %v, want at least %v", n, elapsed, want)
+	}
+}
+
+func TestAcceptLimiterMaxWait(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen error:", err)
+	}
+	l := NewAcceptLimiter(inner, 1, 1)
+	l.MaxWait = 10 * time.Millisecond
+	defer l.Close()
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal("Dial error:", err)
+		}
+		defer conn.Close()
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal("Accept error:", err)
+	}
+	conn.Close()
+
+	// The other two would have to wait about a second, so they are
+	// rejected and Accept blocks until the listener is closed.
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+	select {
+	case err := <-accepted:
+		t.Fatalf("Accept returned a connection over the limit (error %v)", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	l.Close()
+	if err := <-accepted; err == nil {
+		t.Error("Accept after Close returned no error")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// AccessLogFormat selects the line format of Upgrader access logs.
+//
+// AccessLogText is modeled on the Common Log Format:
+//
+//	203.0.113.7 - - [15/Oct/2026:10:00:00 +0000] "GET /ws chat.v1" 1000 512 128 1.5s
+//
+// giving the client IP, session start, path, subprotocol ("-" if none),
+// close code, bytes sent, bytes received and duration. AccessLogJSON
+// writes the same fields as a JSON object.
+type AccessLogFormat int
+
+const (
+	AccessLogOff AccessLogFormat = iota
+	AccessLogText
+	AccessLogJSON
+)
+
+// AccessLogEntry describes a finished connection. CloseCode is the code of
+// the close frame the server sent, which echoes the client's when the
+// client closed first, or 1006 if none was sent.
+type AccessLogEntry struct {
+	RemoteIP      string        `json:"remote_ip"`
+	Time          time.Time     `json:"time"`
+	Path          string        `json:"path"`
+	Subprotocol   string        `json:"subprotocol"`
+	CloseCode     uint16        `json:"close_code"`
+	BytesSent     int64         `json:"bytes_sent"`
+	BytesReceived int64         `json:"bytes_received"`
+	Duration      time.Duration `json:"duration_ns"`
+}
+
+// Format renders e as a single line in the given format.
+func (e AccessLogEntry) Format(format AccessLogFormat) (string, error) {
+	switch format {
+	case AccessLogText:
+		subprotocol := e.Subprotocol
+		if subprotocol == "" {
+			subprotocol = "-"
+		}
+		return fmt.Sprintf("%s - - [%s] \"GET %s %s\" %d %d %d %s",
+			e.RemoteIP, e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Path, subprotocol,
+			e.CloseCode, e.BytesSent, e.BytesReceived, e.Duration), nil
+	case AccessLogJSON:
+		line, err := json.Marshal(e)
+		return string(line), err
+	default:
+		return "", fmt.Errorf("Unknown access log format %d", format)
+	}
+}
+
+// logAccess writes the access log line for c, upgraded from r at start, if
+// access logging is enabled.
+func (u *Upgrader) logAccess(r *http.Request, c *Conn, start time.Time) {
+	if u.AccessLogFormat == AccessLogOff {
+		return
+	}
+	code := uint16(c.closeCode.Load())
+	if code == 0 {
+		code = CloseAbnormalClosure
+	}
+	entry := AccessLogEntry{
+		RemoteIP:      u.ClientIP(r),
+		Time:          start,
+		Path:          r.URL.Path,
+		Subprotocol:   c.Subprotocol(),
+		CloseCode:     code,
+		BytesSent:     c.BytesSent(),
+		BytesReceived: c.BytesReceived(),
+		Duration:      time.Since(start),
+	}
+	line, err := entry.Format(u.AccessLogFormat)
+	if err != nil {
+		log.Println("Error formatting access log:", err)
+		return
+	}
+	logger := u.AccessLogger
+	if logger == nil {
+		logger = log.Default()
+	}
+	logger.Println(line)
+}
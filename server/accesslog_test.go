@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// lineWriter hands every write, one log line each, to a channel.
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+// accessLogSession runs one session against an Upgrader logging in format
+// and returns the logged line: the server greets, closes with 1000 and the
+// client answers the close.
+func accessLogSession(t *testing.T, format AccessLogFormat) string {
+	t.Helper()
+	lines := make(lineWriter, 1)
+	u := NewUpgrader()
+	u.Subprotocols = []string{"chat.v1"}
+	u.AccessLogFormat = format
+	u.AccessLogger = log.New(lines, "", 0)
+	srv := httptest.NewServer(u.Handler(func(c *Conn) error {
+		return c.WriteMessage(OpText, []byte("hello"))
+	}))
+	defer srv.Close()
+
+	_, rw := dialTestServer(t, srv, "/ws", http.Header{"Sec-Websocket-Protocol": {"chat.v1"}})
+	for {
+		f, _, err := readFrame(rw.Reader)
+		if err != nil {
+			t.Fatal("readFrame() error:", err)
+		}
+		if f.Opcode == OpClose {
+			break
+		}
+	}
+	writeFrame(rw.Writer, Frame{Fin: true, Opcode: OpClose, Payload: binary.BigEndian.AppendUint16(nil, CloseNormalClosure), Masked: true})
+	rw.Flush()
+
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatal("No access log line")
+		return ""
+	}
+}
+
+func TestAccessLogText(t *testing.T) {
+	line := accessLogSession(t, AccessLogText)
+
+	// 7 bytes of greeting plus a 4-byte close frame sent, an 8-byte masked
+	// close frame received.
+	want := regexp.MustCompile(`^127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /ws chat\.v1" 1000 11 8 \S+s\n$`)
+	if !want.MatchString(line) {
+		t.Errorf("Access log line = %q, want a match for %s", line, want)
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	line := accessLogSession(t, AccessLogJSON)
+
+	var entry AccessLogEntry
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("Access log line %q is not JSON: %v", line, err)
+	}
+	if entry.RemoteIP != "127.0.0.1" || entry.Path != "/ws" || entry.Subprotocol != "chat.v1" ||
+		entry.CloseCode != CloseNormalClosure || entry.BytesSent != 11 || entry.BytesReceived != 8 {
+		t.Errorf("Access log entry = %+v", entry)
+	}
+	if entry.Time.IsZero() || entry.Duration <= 0 {
+		t.Errorf("Access log entry has time %v and duration %v, want both set", entry.Time, entry.Duration)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// authenticate runs the Authenticate hook for r, writing the rejection
+// response if it fails.
+func (u *Upgrader) authenticate(w http.ResponseWriter, r *http.Request) (any, error) {
+	if u.Authenticate == nil {
+		return nil, nil
+	}
+	identity, err := u.Authenticate(r)
+	if err != nil {
+		log.Println("Authentication failed:", err)
+		http.Error(w, http.StatusText(u.AuthFailureStatus), u.AuthFailureStatus)
+		return nil, fmt.Errorf("Authentication failed: %w", err)
+	}
+	return identity, nil
+}
+
+// Identity returns the identity Upgrader.Authenticate associated with the
+// connection, or nil if no hook was configured.
+func (c *Conn) Identity() any {
+	return c.identity
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testUser struct {
+	Name string
+}
+
+func TestAuthenticate(t *testing.T) {
+	u := NewUpgrader()
+	u.Authenticate = func(r *http.Request) (any, error) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token != "secret-alice" {
+			return nil, errors.New("invalid token")
+		}
+		return testUser{Name: "alice"}, nil
+	}
+
+	srv := httptest.NewServer(u.Handler(func(c *Conn) error {
+		user, _ := c.Identity().(testUser)
+		return c.WriteMessage(OpText, []byte(user.Name))
+	}))
+	defer srv.Close()
+
+	t.Run("Valid token", func(t *testing.T) {
+		resp, rw := dialTestServer(t, srv, "/ws", http.Header{"Authorization": {"Bearer secret-alice"}})
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+		}
+		f, _, err := readFrame(rw.Reader)
+		if err != nil {
+			t.Fatal("readFrame() error:", err)
+		}
+		if string(f.Payload) != "alice" {
+			t.Errorf("Identity() name = %q, want %q", f.Payload, "alice")
+		}
+	})
+
+	t.Run("Invalid token", func(t *testing.T) {
+		resp, _ := dialTestServer(t, srv, "/ws", http.Header{"Authorization": {"Bearer forged"}})
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+		}
+	})
+}
+
+func TestAuthFailureStatus(t *testing.T) {
+	u := NewUpgrader()
+	u.Authenticate = func(r *http.Request) (any, error) {
+		return nil, errors.New("banned")
+	}
+	u.AuthFailureStatus = http.StatusForbidden
+
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Origin", "http://localhost:8080")
+	rr := httptest.NewRecorder()
+	u.Handler(greet)(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+}
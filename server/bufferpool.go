@@ -0,0 +1,61 @@
+package main
+
+import "sync"
+
+// BufferPool supplies scratch buffers for frame reading and writing so that
+// servers with many connections can share memory instead of allocating per
+// frame. Get returns a pointer to a slice of length n; Put hands it back
+// once the slice is no longer referenced. Buffers travel as *[]byte so that
+// handing one back does not allocate a new slice header, as putting a
+// []byte into a sync.Pool would. Implementations must be safe for
+// concurrent use.
+type BufferPool interface {
+	Get(n int) *[]byte
+	Put(b *[]byte)
+}
+
+// syncBufferPool is a BufferPool backed by a sync.Pool.
+type syncBufferPool struct {
+	pool sync.Pool
+}
+
+// NewBufferPool returns a BufferPool backed by a sync.Pool. A single pool
+// is meant to be shared by all connections of a server.
+func NewBufferPool() BufferPool {
+	return &syncBufferPool{}
+}
+
+func (p *syncBufferPool) Get(n int) *[]byte {
+	b, ok := p.pool.Get().(*[]byte)
+	if !ok {
+		b = new([]byte)
+	}
+	if *b != nil && cap(*b) >= n {
+		*b = (*b)[:n]
+	} else {
+		*b = make([]byte, n)
+	}
+	return b
+}
+
+func (p *syncBufferPool) Put(b *[]byte) {
+	p.pool.Put(b)
+}
+
+// getBuffer returns a buffer of length n from pool, or a fresh one when
+// pool is nil. buf is what to hand back to putBuffer; it is nil for a
+// fresh buffer.
+func getBuffer(pool BufferPool, n int) (b []byte, buf *[]byte) {
+	if pool == nil {
+		return make([]byte, n), nil
+	}
+	buf = pool.Get(n)
+	return *buf, buf
+}
+
+// putBuffer returns buf to pool if there is one.
+func putBuffer(pool BufferPool, buf *[]byte) {
+	if pool != nil && buf != nil {
+		pool.Put(buf)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Coalescer batches small messages written in quick succession into a
+// single WebSocket message, cutting per-frame overhead for chatty
+// producers. Messages in a batch are joined with a delimiter, which the
+// peer uses to split them again. Create one with Conn.Coalesce.
+type Coalescer struct {
+	conn      *Conn
+	opcode    byte
+	delimiter []byte
+	interval  time.Duration
+	maxBatch  int
+
+	mu    sync.Mutex
+	batch []byte
+	count int    // messages in batch, which may be empty
+	gen   uint64 // bumped on every flush so stale timers can tell
+	timer *time.Timer
+	err   error
+}
+
+// Coalesce returns a Coalescer sending batches as opcode messages, with
+// messages separated by delimiter. A batch is sent interval after its
+// first message or as soon as it reaches maxBatch bytes.
+func (c *Conn) Coalesce(opcode byte, delimiter []byte, interval time.Duration, maxBatch int) *Coalescer {
+	return &Coalescer{
+		conn:      c,
+		opcode:    opcode,
+		delimiter: delimiter,
+		interval:  interval,
+		maxBatch:  maxBatch,
+	}
+}
+
+// Write adds data to the current batch. An error from sending an earlier
+// batch in the background is returned by the next Write or Flush.
+func (w *Coalescer) Write(data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if w.count > 0 {
+		w.batch = append(w.batch, w.delimiter...)
+	}
+	w.batch = append(w.batch, data...)
+	w.count++
+	if len(w.batch) >= w.maxBatch {
+		return w.flushLocked()
+	}
+	if w.timer == nil {
+		// A timer that fires while a flush is stopping it must not send
+		// the batch that was started after that flush.
+		gen := w.gen
+		w.timer = time.AfterFunc(w.interval, func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			if w.gen == gen {
+				w.flushLocked()
+			}
+		})
+	}
+	return nil
+}
+
+// Flush sends the current batch immediately.
+func (w *Coalescer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	return w.flushLocked()
+}
+
+func (w *Coalescer) flushLocked() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.gen++
+	if w.count == 0 {
+		return nil
+	}
+	err := w.conn.WriteMessage(w.opcode, w.batch)
+	w.batch = nil
+	w.count = 0
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCoalescerInterval(t *testing.T) {
+	c, peer := newTestConn(t)
+	w := c.Coalesce(OpText, []byte("\n"), 50*time.Millisecond, 1024)
+
+	for _, msg := range []string{"a", "b", "c"} {
+		if err := w.Write([]byte(msg)); err != nil {
+			t.Fatal("Write() error:", err)
+		}
+	}
+
+	f, _, err := readFrame(peer.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if f.Opcode != OpText || string(f.Payload) != "a\nb\nc" {
+		t.Errorf("Frame = %#x %q, want text %q", f.Opcode, f.Payload, "a\nb\nc")
+	}
+}
+
+func TestCoalescerMaxBatch(t *testing.T) {
+	c, peer := newTestConn(t)
+	w := c.Coalesce(OpBinary, nil, time.Hour, 4)
+
+	go func() {
+		for _, msg := range []string{"ab", "cd", "ef"} {
+			if err := w.Write([]byte(msg)); err != nil {
+				t.Errorf("Write() error: %v", err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Errorf("Flush() error: %v", err)
+		}
+	}()
+
+	for _, want := range []string{"abcd", "ef"} {
+		f, _, err := readFrame(peer.Reader)
+		if err != nil {
+			t.Fatal("readFrame() error:", err)
+		}
+		if string(f.Payload) != want {
+			t.Errorf("Frame payload = %q, want %q", f.Payload, want)
+		}
+	}
+}
+
+func TestCoalescerEmptyFirstMessage(t *testing.T) {
+	c, peer := newTestConn(t)
+	w := c.Coalesce(OpText, []byte("\n"), time.Hour, 1024)
+
+	go func() {
+		for _, msg := range []string{"", "b"} {
+			if err := w.Write([]byte(msg)); err != nil {
+				t.Errorf("Write() error: %v", err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Errorf("Flush() error: %v", err)
+		}
+	}()
+
+	f, _, err := readFrame(peer.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if string(f.Payload) != "\nb" {
+		t.Errorf("Frame payload = %q, want %q", f.Payload, "\nb")
+	}
+}
+
+func TestCoalescerStaleTimer(t *testing.T) {
+	c, peer := newTestConn(t)
+	w := c.Coalesce(OpText, nil, 10*time.Millisecond, 1024)
+
+	frames := make(chan Frame, 2)
+	go func() {
+		for {
+			f, _, err := readFrame(peer.Reader)
+			if err != nil {
+				return
+			}
+			frames <- f
+		}
+	}()
+
+	if err := w.Write([]byte("a")); err != nil {
+		t.Fatal("Write() error:", err)
+	}
+	// Hold the lock until the timer has fired and is waiting for it, then
+	// flush and start a new batch before letting the callback run.
+	w.mu.Lock()
+	time.Sleep(50 * time.Millisecond)
+	if err := w.flushLocked(); err != nil {
+		w.mu.Unlock()
+		t.Fatal("flushLocked() error:", err)
+	}
+	w.batch = []byte("b")
+	w.count = 1
+	w.mu.Unlock()
+
+	if f := <-frames; string(f.Payload) != "a" {
+		t.Fatalf("Frame payload = %q, want %q", f.Payload, "a")
+	}
+	select {
+	case f := <-frames:
+		t.Fatalf("Stale timer sent %q", f.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"strings"
+)
+
+// DefaultCompressionThreshold is the initial Conn.CompressionThreshold.
+const DefaultCompressionThreshold = 256
+
+// deflateTail is the empty stored block that ends every flushed deflate
+// stream; RFC 7692 removes it from the wire.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// deflateExtension implements permessage-deflate. Both directions run
+// without context takeover, so every message is compressed independently.
+type deflateExtension struct{}
+
+func (deflateExtension) Name() string {
+	return "permessage-deflate"
+}
+
+func (deflateExtension) Negotiate(params []string) (string, bool) {
+	for _, p := range params {
+		name, _, _ := strings.Cut(p, "=")
+		switch strings.TrimSpace(name) {
+		case "server_no_context_takeover", "client_no_context_takeover", "client_max_window_bits":
+		default:
+			// server_max_window_bits cannot be honored by compress/flate,
+			// which always uses a 32KB window.
+			return "", false
+		}
+	}
+	return "permessage-deflate; server_no_context_takeover; client_no_context_takeover", true
+}
+
+// Encode compresses messages of at least Conn.CompressionThreshold bytes and
+// marks them with RSV1, unless compression has been switched off.
+func (deflateExtension) Encode(c *Conn, m *ExtensionMessage) error {
+	if c.compressOff.Load() || len(m.Payload) < c.CompressionThreshold {
+		return nil
+	}
+	compressed, err := compressMessage(m.Payload)
+	if err != nil {
+		return err
+	}
+	m.Payload = compressed
+	m.Rsv1 = true
+	return nil
+}
+
+// SetCompressionEnabled switches compression of outgoing messages on or
+// off from the next message on, for example to save CPU during a load
+// spike. permessage-deflate stays negotiated, so no renegotiation is
+// needed: each message's RSV1 bit tells the peer whether it is compressed.
+// Compression is enabled by default; without permessage-deflate this has
+// no effect.
+func (c *Conn) SetCompressionEnabled(enabled bool) {
+	c.compressOff.Store(!enabled)
+}
+
+// CompressionEnabled reports whether outgoing messages are compressed:
+// permessage-deflate was negotiated and compression has not been switched
+// off with SetCompressionEnabled. Applications can check it before
+// compressing payloads themselves, to avoid compressing twice.
+func (c *Conn) CompressionEnabled() bool {
+	return c.compress && !c.compressOff.Load()
+}
+
+// Decode inflates messages that arrived with RSV1 set. Inflating stops
+// with ErrMessageTooLarge once the message exceeds MaxMessageSize, so a
+// small compressed payload cannot expand without bound.
+func (deflateExtension) Decode(c *Conn, m *ExtensionMessage) error {
+	if !m.Rsv1 {
+		return nil
+	}
+	data, err := decompressMessage(m.Payload, c.MaxMessageSize)
+	if err != nil {
+		return err
+	}
+	m.Payload = data
+	m.Rsv1 = false
+	return nil
+}
+
+// compressMessage deflates a whole message payload for a frame with RSV1 set.
+func compressMessage(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail), nil
+}
+
+// finalBlock is an empty final stored block. Appending it after the
+// restored tail lets the flate reader end cleanly instead of reporting an
+// unexpected EOF.
+var finalBlock = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+// decompressMessage inflates the payload of a message received with RSV1
+// set. An inflated message longer than limit bytes fails with
+// ErrMessageTooLarge as soon as the excess is read; zero means no limit.
+func decompressMessage(data []byte, limit int64) ([]byte, error) {
+	fr := flate.NewReader(io.MultiReader(
+		bytes.NewReader(data),
+		bytes.NewReader(deflateTail),
+		bytes.NewReader(finalBlock),
+	))
+	defer fr.Close()
+	if limit <= 0 {
+		return io.ReadAll(fr)
+	}
+	out, err := io.ReadAll(io.LimitReader(fr, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, ErrMessageTooLarge
+	}
+	return out, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("compress me ", 100))
+	compressed, err := compressMessage(data)
+	if err != nil {
+		t.Fatal("compressMessage() error:", err)
+	}
+	if len(compressed) >= len(data) {
+		t.Errorf("Compressed size %d not smaller than %d", len(compressed), len(data))
+	}
+	if bytes.HasSuffix(compressed, deflateTail) {
+		t.Error("Compressed payload still ends with the deflate tail")
+	}
+
+	out, err := decompressMessage(compressed, 0)
+	if err != nil {
+		t.Fatal("decompressMessage() error:", err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Error("Round-tripped data does not match original")
+	}
+}
+
+func TestNegotiateDeflate(t *testing.T) {
+	tests := []struct {
+		offer string
+		want  bool
+	}{
+		{"permessage-deflate", true},
+		{"permessage-deflate; client_max_window_bits", true},
+		{"x-foo, permessage-deflate; client_no_context_takeover", true},
+		{"permessage-deflate; server_max_window_bits=10", false},
+		{"x-foo", false},
+		{"", false},
+	}
+	u := NewUpgrader()
+	u.EnableCompression = true
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/ws", nil)
+		if tt.offer != "" {
+			req.Header.Set("Sec-WebSocket-Extensions", tt.offer)
+		}
+		if _, value := negotiateExtensions(req, u.extensions(req)); (value != "") != tt.want {
+			t.Errorf("negotiateExtensions(%q) = %q, want accepted = %v", tt.offer, value, tt.want)
+		}
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	c, peer := newTestConn(t)
+	c.setExtensions([]Extension{deflateExtension{}})
+
+	small := []byte("tiny hello")
+	large := []byte(strings.Repeat("a fairly compressible payload ", 40))
+
+	go func() {
+		c.WriteMessage(OpText, small)
+		c.WriteMessage(OpText, large)
+	}()
+
+	f, _, err := readFrame(peer.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if f.Rsv1 || !bytes.Equal(f.Payload, small) {
+		t.Errorf("Small message rsv1 = %v, payload = %q, want uncompressed", f.Rsv1, f.Payload)
+	}
+
+	f, _, err = readFrame(peer.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if !f.Rsv1 {
+		t.Fatal("Large message sent without RSV1")
+	}
+	out, err := decompressMessage(f.Payload, 0)
+	if err != nil {
+		t.Fatal("decompressMessage() error:", err)
+	}
+	if !bytes.Equal(out, large) {
+		t.Error("Large message does not decompress to the original")
+	}
+}
+
+func TestReadCompressedMessage(t *testing.T) {
+	c, peer := newTestConn(t)
+	c.setExtensions([]Extension{deflateExtension{}})
+
+	data := []byte(strings.Repeat("inbound ", 50))
+	compressed, err := compressMessage(data)
+	if err != nil {
+		t.Fatal("compressMessage() error:", err)
+	}
+	go func() {
+		writeFrame(peer.Writer, Frame{Fin: true, Rsv1: true, Opcode: OpText, Payload: compressed, Masked: true})
+		peer.Flush()
+	}()
+
+	msg, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal("ReadMessage() error:", err)
+	}
+	if !bytes.Equal(msg.Data, data) {
+		t.Errorf("ReadMessage() = %q, want %q", msg.Data, data)
+	}
+}
+
+func TestReadCompressedMessageBomb(t *testing.T) {
+	c, peer := newTestConn(t)
+	c.setExtensions([]Extension{deflateExtension{}})
+	c.MaxMessageSize = 1 << 20
+
+	// 256MB of zeros deflate to a few hundred KB.
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	zeros := make([]byte, 1<<20)
+	for i := 0; i < 256; i++ {
+		fw.Write(zeros)
+	}
+	fw.Flush()
+	bomb := bytes.TrimSuffix(buf.Bytes(), deflateTail)
+
+	closeFrame := make(chan Frame, 1)
+	go func() {
+		writeFrame(peer.Writer, Frame{Fin: true, Rsv1: true, Opcode: OpBinary, Payload: bomb, Masked: true})
+		peer.Flush()
+		f, _, _ := readFrame(peer.Reader)
+		closeFrame <- f
+	}()
+
+	if _, err := c.ReadMessage(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("ReadMessage() error = %v, want ErrMessageTooLarge", err)
+	}
+	f := <-closeFrame
+	if f.Opcode != OpClose || len(f.Payload) < 2 || binary.BigEndian.Uint16(f.Payload) != CloseMessageTooBig {
+		t.Errorf("Got frame %#x %v, want a close with %d", f.Opcode, f.Payload, CloseMessageTooBig)
+	}
+}
+
+func TestUpgradeNegotiatesDeflate(t *testing.T) {
+	u := NewUpgrader()
+	u.EnableCompression = true
+
+	srv := httptest.NewServer(u.Handler(func(c *Conn) error { return nil }))
+	defer srv.Close()
+
+	header := http.Header{"Sec-WebSocket-Extensions": {"permessage-deflate"}}
+	resp, _ := dialTestServer(t, srv, "/ws", header)
+	if got := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.HasPrefix(got, "permessage-deflate") {
+		t.Errorf("Sec-WebSocket-Extensions = %q, want permessage-deflate", got)
+	}
+}
+
+func TestSetCompressionEnabled(t *testing.T) {
+	c, peer := newTestConn(t)
+	c.setExtensions([]Extension{deflateExtension{}})
+
+	message := []byte(strings.Repeat("a fairly compressible payload ", 40))
+	go func() {
+		c.WriteMessage(OpText, message)
+		c.SetCompressionEnabled(false)
+		c.WriteMessage(OpText, message)
+		c.SetCompressionEnabled(true)
+		c.WriteMessage(OpText, message)
+	}()
+
+	for i, wantRsv1 := range []bool{true, false, true} {
+		f, _, err := readFrame(peer.Reader)
+		if err != nil {
+			t.Fatal("readFrame() error:", err)
+		}
+		if f.Rsv1 != wantRsv1 {
+			t.Errorf("Message %d rsv1 = %v, want %v", i, f.Rsv1, wantRsv1)
+		}
+		payload := f.Payload
+		if f.Rsv1 {
+			if payload, err = decompressMessage(f.Payload, 0); err != nil {
+				t.Fatal("decompressMessage() error:", err)
+			}
+		}
+		if !bytes.Equal(payload, message) {
+			t.Errorf("Message %d does not match the original", i)
+		}
+	}
+}
+
+func TestConnCompressionEnabled(t *testing.T) {
+	tests := []struct {
+		name  string
+		offer string
+		want  bool
+	}{
+		{"Negotiated", "permessage-deflate", true},
+		{"Declined", "permessage-deflate; server_max_window_bits=10", false},
+		{"Not offered", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := NewUpgrader()
+			u.EnableCompression = true
+			enabled := make(chan bool, 1)
+			srv := httptest.NewServer(u.Handler(func(c *Conn) error {
+				enabled <- c.CompressionEnabled()
+				return nil
+			}))
+			defer srv.Close()
+
+			header := http.Header{}
+			if tt.offer != "" {
+				header.Set("Sec-WebSocket-Extensions", tt.offer)
+			}
+			dialTestServer(t, srv, "/ws", header)
+			if got := <-enabled; got != tt.want {
+				t.Errorf("CompressionEnabled() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	c, _ := newTestConn(t)
+	c.setExtensions([]Extension{deflateExtension{}})
+	c.SetCompressionEnabled(false)
+	if c.CompressionEnabled() {
+		t.Error("CompressionEnabled() = true after SetCompressionEnabled(false)")
+	}
+}
@@ -0,0 +1,885 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Conn is a server-side WebSocket connection created by wsHandler after a
+// successful handshake.
+type Conn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	req  *http.Request
+
+	// client is set on connections this server dialed itself, such as a
+	// proxy's upstream: they mask outgoing frames and expect incoming ones
+	// unmasked.
+	client bool
+
+	mu     sync.Mutex
+	values map[string]any
+
+	// identity is the result of the Authenticate hook, subprotocol the
+	// negotiated Sec-WebSocket-Protocol and version the client's
+	// Sec-WebSocket-Version.
+	identity    any
+	subprotocol string
+	version     int
+
+	// writeMu serializes frames written to rw.Writer and guards
+	// fragmenting.
+	writeMu     sync.Mutex
+	fragmenting bool
+
+	// stateMu guards state. It is never held while blocking on the
+	// network, so Close and State stay responsive during slow writes.
+	stateMu sync.Mutex
+	state   ConnState
+
+	// pauseMu guards resumed, which is non-nil while reading is paused
+	// and closed by Resume.
+	pauseMu sync.Mutex
+	resumed chan struct{}
+
+	// closeOnce makes sure the underlying connection is closed only once,
+	// however many of Close, CloseGracefully and ReadMessage get there.
+	closeOnce sync.Once
+
+	// extensions are the negotiated extensions in pipeline order.
+	// compress is set when permessage-deflate is among them. Messages
+	// shorter than CompressionThreshold bytes are still sent uncompressed,
+	// since deflate overhead can make tiny payloads larger.
+	// compressOff is set by SetCompressionEnabled(false).
+	extensions           []Extension
+	compress             bool
+	compressOff          atomic.Bool
+	CompressionThreshold int
+
+	// OnMessageSize, if set, is called by ReadMessage with the opcode and
+	// total payload size of every complete data message, after fragments
+	// have been reassembled. It can feed a message size histogram.
+	OnMessageSize func(opcode byte, n int)
+
+	// MaxFragments bounds how many frames a single message may be split
+	// into, guarding against floods of tiny fragments that never finish.
+	// Zero means no limit.
+	MaxFragments int
+
+	// MaxFrameSize bounds the payload length a single frame may declare and
+	// is checked before the payload is read, so a bogus length cannot
+	// force a huge allocation. MaxMessageSize bounds a whole message after
+	// reassembly and decompression. Exceeding either closes the connection
+	// with 1009. Zero means no limit.
+	MaxFrameSize   int64
+	MaxMessageSize int64
+
+	// BufferPool, if set, supplies the scratch buffers used to encode
+	// outgoing frames and to read fragments and control frames. Sharing
+	// one pool across connections reduces GC pressure on busy servers.
+	BufferPool BufferPool
+
+	// CloseGracePeriod bounds how long CloseGracefully waits for the peer
+	// to answer a close frame.
+	CloseGracePeriod time.Duration
+
+	// WriteTimeout, if positive, bounds every write to the network. The
+	// deadline grows with the amount being sent: on top of WriteTimeout,
+	// each write gets the time it would take at WriteThroughput bytes per
+	// second, so large messages are not cut short while a small one to a
+	// dead peer still fails fast. Zero WriteThroughput disables the
+	// scaling.
+	WriteTimeout    time.Duration
+	WriteThroughput int64
+
+	// KeepRawMask makes ReadRawFrame return masked payloads exactly as
+	// they appeared on the wire instead of unmasking them.
+	KeepRawMask bool
+
+	// LenientControlFrames accepts control frames whose payload exceeds
+	// the 125 bytes RFC 6455 allows, reading the whole payload instead of
+	// failing the read. This is not standard behavior; it exists only to
+	// interoperate with peers known to send oversized pings or close
+	// frames, and should stay off otherwise. Such a ping is answered with
+	// an equally oversized pong. MaxFrameSize still applies.
+	LenientControlFrames bool
+
+	// peerClose is the close frame received from the peer, returned again
+	// by every read after it.
+	peerClose atomic.Pointer[CloseError]
+
+	// events holds what ReadEvent has read but not yet returned.
+	events []Event
+
+	// handlers are the callbacks Listen dispatches to.
+	handlers handlers
+
+	// closeCode is the code of the close frame we sent, zero until then.
+	closeCode atomic.Uint32
+
+	// readDeadline is the deadline last set with SetReadDeadline, in Unix
+	// nanoseconds, or zero for none. ReadMessageTimeout restores it.
+	readDeadline atomic.Int64
+
+	bytesSent        atomic.Int64
+	bytesReceived    atomic.Int64
+	messagesSent     atomic.Int64
+	messagesReceived atomic.Int64
+}
+
+// Close status codes defined by RFC 6455 section 7.4.1.
+const (
+	CloseNormalClosure    uint16 = 1000
+	CloseGoingAway        uint16 = 1001
+	CloseProtocolError    uint16 = 1002
+	CloseUnsupportedData  uint16 = 1003
+	CloseNoStatusReceived uint16 = 1005
+	CloseAbnormalClosure  uint16 = 1006
+	CloseInvalidPayload   uint16 = 1007
+	ClosePolicyViolation  uint16 = 1008
+	CloseMessageTooBig    uint16 = 1009
+	CloseInternalError    uint16 = 1011
+)
+
+// validCloseCode reports whether code may appear in a close frame: one of
+// the codes RFC 6455 and the IANA registry define for use on the wire, or
+// an application code in the 3000-4999 range. 1005, 1006 and 1015 are
+// reserved for reporting and never sent.
+func validCloseCode(code uint16) bool {
+	switch {
+	case code >= 1000 && code <= 1003,
+		code >= 1007 && code <= 1014,
+		code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// ConnState is the lifecycle state of a Conn. States only move forward.
+type ConnState int
+
+const (
+	// StateOpen allows reading and writing.
+	StateOpen ConnState = iota
+	// StateClosing means a close frame has been sent. Only the peer's
+	// close reply may still be read; nothing more is written.
+	StateClosing
+	// StateClosed means the underlying connection has been closed.
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateOpen:
+		return "open"
+	case StateClosing:
+		return "closing"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+// ErrClosed is returned when writing to a connection that has sent a close
+// frame or been closed, and when reading from a closed connection.
+var ErrClosed = errors.New("Connection closed")
+
+// DefaultMaxFragments is the initial Conn.MaxFragments.
+const DefaultMaxFragments = 1024
+
+// Default limits for Conn.MaxFrameSize and Conn.MaxMessageSize.
+const (
+	DefaultMaxFrameSize   = 16 << 20
+	DefaultMaxMessageSize = 32 << 20
+)
+
+// ErrMessageTooLarge is returned by ReadMessage when a frame or message
+// exceeds Conn.MaxFrameSize or Conn.MaxMessageSize. The connection is
+// closed with 1009.
+var ErrMessageTooLarge = errors.New("Message too large")
+
+// ErrTooManyFragments is returned by ReadMessage when a message arrives in
+// more than Conn.MaxFragments frames. The connection is closed with 1009.
+var ErrTooManyFragments = errors.New("Too many message fragments")
+
+// Message is a complete data message read from or written to a Conn.
+type Message struct {
+	Opcode byte
+	Data   []byte
+}
+
+// CloseError is returned by ReadMessage when the peer sends a close frame.
+type CloseError struct {
+	Code uint16
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("Connection closed with code %d: %s", e.Code, e.Text)
+}
+
+func newConn(conn net.Conn, rw *bufio.ReadWriter, req *http.Request) *Conn {
+	return &Conn{
+		conn:   conn,
+		rw:     rw,
+		req:    req,
+		values: make(map[string]any),
+
+		CompressionThreshold: DefaultCompressionThreshold,
+		MaxFragments:         DefaultMaxFragments,
+		MaxFrameSize:         DefaultMaxFrameSize,
+		MaxMessageSize:       DefaultMaxMessageSize,
+		CloseGracePeriod:     DefaultCloseGracePeriod,
+	}
+}
+
+// Set attaches application data (user ID, session, room, ...) to the
+// connection under key. It is safe to call from multiple goroutines.
+func (c *Conn) Set(key string, value any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = value
+}
+
+// Get returns the value stored under key and whether it was present.
+func (c *Conn) Get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.values[key]
+	return value, ok
+}
+
+// Request returns the handshake request that created the connection, so
+// handlers can read headers, cookies and the query after the upgrade. Its
+// Body must not be used. It is nil for connections not created by Upgrade.
+func (c *Conn) Request() *http.Request {
+	return c.req
+}
+
+// setExtensions installs the extensions negotiated during the handshake.
+func (c *Conn) setExtensions(exts []Extension) {
+	c.extensions = exts
+	for _, ext := range exts {
+		if _, ok := ext.(deflateExtension); ok {
+			c.compress = true
+		}
+	}
+}
+
+// State returns the connection's current lifecycle state.
+func (c *Conn) State() ConnState {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.state
+}
+
+// advanceState moves the connection to state s if that is a step forward
+// and reports whether it did.
+func (c *Conn) advanceState(s ConnState) bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if s <= c.state {
+		return false
+	}
+	c.state = s
+	return true
+}
+
+// Version returns the protocol version from the client's
+// Sec-WebSocket-Version header. Handshakes are only accepted for version
+// 13, so for now that is what it always reports.
+func (c *Conn) Version() int {
+	return c.version
+}
+
+// Subprotocol returns the Sec-WebSocket-Protocol value selected during the
+// handshake, or "" if none was.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Path returns the URL path of the handshake request.
+func (c *Conn) Path() string {
+	if c.req == nil {
+		return ""
+	}
+	return c.req.URL.Path
+}
+
+// PathValue returns the value of the named path wildcard captured when the
+// handler was registered on a ServeMux pattern such as "/ws/{tenant}".
+func (c *Conn) PathValue(name string) string {
+	if c.req == nil {
+		return ""
+	}
+	return c.req.PathValue(name)
+}
+
+// SetReadDeadline sets the deadline for reading from the connection, as
+// net.Conn.SetReadDeadline does; a zero t means reads do not time out.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	var nanos int64
+	if !t.IsZero() {
+		nanos = t.UnixNano()
+	}
+	c.readDeadline.Store(nanos)
+	return c.conn.SetReadDeadline(t)
+}
+
+// BytesSent returns the number of on-the-wire frame bytes written so far.
+func (c *Conn) BytesSent() int64 { return c.bytesSent.Load() }
+
+// BytesReceived returns the number of on-the-wire frame bytes read so far.
+func (c *Conn) BytesReceived() int64 { return c.bytesReceived.Load() }
+
+// MessagesSent returns the number of data messages written so far.
+func (c *Conn) MessagesSent() int64 { return c.messagesSent.Load() }
+
+// MessagesReceived returns the number of complete data messages read so far.
+func (c *Conn) MessagesReceived() int64 { return c.messagesReceived.Load() }
+
+// WriteMessage sends data as a single unfragmented frame with the given
+// data opcode (OpText or OpBinary).
+//
+// Each frame is written and flushed while holding writeMu, so messages
+// written by one goroutine reach the peer in the order WriteMessage was
+// called. Frames from concurrent writers, including control frames, are
+// interleaved only between whole frames and never reorder a single
+// goroutine's messages.
+func (c *Conn) WriteMessage(opcode byte, data []byte) error {
+	return c.writeMessage(opcode, data, true)
+}
+
+// WriteMessageNoFlush is WriteMessage without the flush: the message stays
+// in the write buffer until Flush is called, the buffer fills up, or a
+// control frame is written. Batching a burst of messages this way lets
+// them go out in a single network write.
+func (c *Conn) WriteMessageNoFlush(opcode byte, data []byte) error {
+	return c.writeMessage(opcode, data, false)
+}
+
+// Flush writes any buffered messages to the network.
+func (c *Conn) Flush() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.armWriteDeadline(0)
+	return c.flushLocked()
+}
+
+// WriteMessages writes msgs in order as one batch and flushes once at the
+// end. writeMu is held throughout, so no other message or control frame,
+// not even an automatic pong, can come between them on the wire. It stops
+// at the first message that fails.
+func (c *Conn) WriteMessages(msgs []Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	for _, msg := range msgs {
+		if err := c.bufferMessageLocked(msg.Opcode, msg.Data); err != nil {
+			return err
+		}
+	}
+	return c.flushLocked()
+}
+
+func (c *Conn) writeMessage(opcode byte, data []byte, flush bool) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.bufferMessageLocked(opcode, data); err != nil {
+		return err
+	}
+	if flush {
+		return c.flushLocked()
+	}
+	return nil
+}
+
+// bufferMessageLocked runs a message through the extensions and buffers it
+// as a single frame. The caller holds writeMu and flushes.
+func (c *Conn) bufferMessageLocked(opcode byte, data []byte) error {
+	if c.fragmenting {
+		return fmt.Errorf("Previous fragmented message not finished")
+	}
+
+	m := ExtensionMessage{Opcode: opcode, Payload: data}
+	for _, ext := range c.extensions {
+		if err := ext.Encode(c, &m); err != nil {
+			return err
+		}
+	}
+	f := Frame{Fin: true, Rsv1: m.Rsv1, Opcode: opcode, Payload: m.Payload}
+	if err := c.bufferFrameLocked(f); err != nil {
+		return err
+	}
+	c.messagesSent.Add(1)
+	return nil
+}
+
+// ErrInvalidUTF8 is returned by WriteText for text that is not valid UTF-8,
+// which RFC 6455 requires of every text message.
+var ErrInvalidUTF8 = errors.New("Text message is not valid UTF-8")
+
+// WriteText sends s as a text message, refusing invalid UTF-8.
+func (c *Conn) WriteText(s string) error {
+	if !utf8.ValidString(s) {
+		return ErrInvalidUTF8
+	}
+	return c.WriteMessage(OpText, []byte(s))
+}
+
+// WriteBinary sends b as a binary message.
+func (c *Conn) WriteBinary(b []byte) error {
+	return c.WriteMessage(OpBinary, b)
+}
+
+// ErrControlTooLarge is returned by Ping and Pong for a payload longer than
+// the 125 bytes RFC 6455 allows in a control frame.
+var ErrControlTooLarge = errors.New("Control frame payload exceeds 125 bytes")
+
+// Ping sends a ping carrying data, which may be arbitrary binary up to 125
+// bytes. A conforming peer echoes it unchanged in its pong.
+func (c *Conn) Ping(data []byte) error {
+	return c.writeControl(OpPing, data)
+}
+
+// Pong sends an unsolicited pong carrying data, which may be arbitrary
+// binary up to 125 bytes. Pings are already answered by ReadMessage.
+func (c *Conn) Pong(data []byte) error {
+	return c.writeControl(OpPong, data)
+}
+
+// writeControl writes a ping or pong after checking its payload length.
+func (c *Conn) writeControl(opcode byte, data []byte) error {
+	if len(data) > maxControlPayload {
+		return ErrControlTooLarge
+	}
+	return c.writeFrame(true, opcode, data)
+}
+
+// SendFragment writes one frame of a message whose total size is not known
+// up front. The first call uses OpText or OpBinary with fin=false, any
+// following calls use OpContinuation, and the last one sets fin=true. No
+// other data message may be written until the fragmented one is finished;
+// control frames may still be interleaved.
+func (c *Conn) SendFragment(opcode byte, data []byte, fin bool) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	switch {
+	case isControl(opcode):
+		return fmt.Errorf("Control frames cannot be fragmented")
+	case opcode == OpContinuation && !c.fragmenting:
+		return fmt.Errorf("No fragmented message in progress")
+	case opcode != OpContinuation && c.fragmenting:
+		return fmt.Errorf("Previous fragmented message not finished")
+	}
+
+	if err := c.writeFrameLocked(Frame{Fin: fin, Opcode: opcode, Payload: data}); err != nil {
+		return err
+	}
+	c.fragmenting = !fin
+	if fin {
+		c.messagesSent.Add(1)
+	}
+	return nil
+}
+
+// writeFrame writes and flushes a single frame, updating the byte counters.
+func (c *Conn) writeFrame(fin bool, opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writeFrameLocked(Frame{Fin: fin, Opcode: opcode, Payload: payload})
+}
+
+// writeFrameLocked is writeFrame for callers already holding writeMu. Once
+// a close frame has been sent no further frames are written. Flushing also
+// sends any messages buffered by WriteMessageNoFlush, so control frames
+// are never held back behind them.
+func (c *Conn) writeFrameLocked(f Frame) error {
+	if err := c.bufferFrameLocked(f); err != nil {
+		return err
+	}
+	return c.flushLocked()
+}
+
+// bufferFrameLocked is writeFrameLocked without the flush.
+func (c *Conn) bufferFrameLocked(f Frame) error {
+	if f.Opcode != OpClose && c.State() != StateOpen {
+		return ErrClosed
+	}
+	f.Masked = c.client
+	c.armWriteDeadline(FrameLen(len(f.Payload), f.Masked))
+	n, err := writeFramePooled(c.rw.Writer, f, c.BufferPool)
+	c.bytesSent.Add(int64(n))
+	return c.failWrite(err)
+}
+
+// flushLocked flushes the write buffer for callers holding writeMu.
+func (c *Conn) flushLocked() error {
+	return c.failWrite(c.rw.Flush())
+}
+
+// failWrite closes the connection if a write to it failed, and returns
+// err. A failed write may have put part of a frame on the wire, after which
+// the peer can no longer find frame boundaries, so nothing more may be
+// written; bufio.Writer would also keep returning the same error.
+func (c *Conn) failWrite(err error) error {
+	if err != nil {
+		c.Close()
+	}
+	return err
+}
+
+// ReadMessage reads the next complete data message, reassembling fragmented
+// messages. Pings are answered automatically and pongs are discarded. When
+// the peer sends a close frame a *CloseError is returned, and the same
+// error is returned by every later call; anything the peer sent after its
+// close frame is never read.
+func (c *Conn) ReadMessage() (Message, error) {
+	return c.readMessage(nil)
+}
+
+// readMessage is ReadMessage, additionally passing every control frame to
+// onControl if it is set. A ping or pong between messages then ends the
+// read with errEventPending, so that ReadEvent can report it right away;
+// one arriving between the fragments of a message does not.
+func (c *Conn) readMessage(onControl func(Event)) (Message, error) {
+	var msg Message
+	var rsv1 bool
+	var fragments int
+	var text utf8Validator
+	c.waitResumed()
+	if c.State() == StateClosed {
+		return Message{}, c.closedErr()
+	}
+	for {
+		// Between messages, a deadline that expires before the next
+		// frame starts leaves the stream intact; see idleTimeoutError.
+		if msg.Opcode == 0 {
+			if _, err := c.rw.Reader.Peek(1); err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					return Message{}, &idleTimeoutError{err}
+				}
+				return Message{}, err
+			}
+		}
+		f, n, err := readFramePooled(c.rw.Reader, c.BufferPool, c.MaxFrameSize, c.LenientControlFrames)
+		c.bytesReceived.Add(int64(n))
+		if errors.Is(err, errFrameTooLarge) {
+			return Message{}, c.failTooLarge()
+		}
+		if err != nil {
+			return Message{}, err
+		}
+		if f.Masked == c.client {
+			if c.client {
+				return Message{}, c.failProtocolError(fmt.Errorf("Server frames must not be masked"))
+			}
+			return Message{}, c.failProtocolError(fmt.Errorf("Client frames must be masked"))
+		}
+		if f.Rsv1 && (!c.compress || f.Opcode != OpText && f.Opcode != OpBinary) {
+			return Message{}, c.failProtocolError(fmt.Errorf("Unexpected RSV1 bit"))
+		}
+		// Only data frames may be fragmented; reassembly never applies to
+		// control frames.
+		if isControl(f.Opcode) && !f.Fin {
+			return Message{}, c.failProtocolError(fmt.Errorf("Fragmented control frame"))
+		}
+
+		switch f.Opcode {
+		case OpPing:
+			// The pong echoes the ping payload byte for byte. After
+			// our close frame has gone out pings are ignored.
+			var err error
+			if c.State() == StateOpen {
+				err = c.writeFrame(true, OpPong, f.Payload)
+			}
+			if onControl != nil {
+				onControl(Event{Type: EventPing, Payload: bytes.Clone(f.Payload)})
+			}
+			putBuffer(c.BufferPool, f.buf)
+			if err != nil {
+				return Message{}, err
+			}
+			if onControl != nil && msg.Opcode == 0 {
+				return Message{}, errEventPending
+			}
+			continue
+		case OpPong:
+			if onControl != nil {
+				onControl(Event{Type: EventPong, Payload: bytes.Clone(f.Payload)})
+			}
+			putBuffer(c.BufferPool, f.buf)
+			if onControl != nil && msg.Opcode == 0 {
+				return Message{}, errEventPending
+			}
+			continue
+		case OpClose:
+			closeErr, err := parseClosePayload(f.Payload)
+			if err != nil {
+				return Message{}, c.failProtocolError(err)
+			}
+			// If we already sent a close (we initiated, or both sides
+			// closed at once) this frame completes the handshake and must
+			// not be echoed. Either way the close handshake is over.
+			c.peerClose.Store(closeErr)
+			if onControl != nil {
+				onControl(Event{Type: EventClose, Close: closeErr})
+			}
+			if err := c.sendClose(closeErr.Code, ""); err != nil {
+				c.Close()
+				return Message{}, err
+			}
+			c.Close()
+			return Message{}, closeErr
+		case OpContinuation:
+			if msg.Opcode == 0 {
+				return Message{}, c.failProtocolError(fmt.Errorf("Unexpected continuation frame"))
+			}
+			fragments++
+			if c.MaxFragments > 0 && fragments > c.MaxFragments {
+				c.sendClose(CloseMessageTooBig, "Too many fragments")
+				c.Close()
+				return Message{}, ErrTooManyFragments
+			}
+			if !c.validateText(&text, msg.Opcode, rsv1, f.Payload) {
+				return Message{}, c.failInvalidUTF8()
+			}
+			if c.MaxMessageSize > 0 && int64(len(msg.Data)+len(f.Payload)) > c.MaxMessageSize {
+				return Message{}, c.failTooLarge()
+			}
+			msg.Data = append(msg.Data, f.Payload...)
+			putBuffer(c.BufferPool, f.buf)
+		case OpText, OpBinary:
+			if msg.Opcode != 0 {
+				return Message{}, c.failProtocolError(fmt.Errorf("Expected continuation frame"))
+			}
+			msg.Opcode = f.Opcode
+			msg.Data = f.Payload
+			rsv1 = f.Rsv1
+			fragments = 1
+			if !c.validateText(&text, msg.Opcode, rsv1, f.Payload) {
+				return Message{}, c.failInvalidUTF8()
+			}
+		default:
+			return Message{}, c.failProtocolError(fmt.Errorf("Unknown opcode %#x", f.Opcode))
+		}
+
+		if f.Fin {
+			m := ExtensionMessage{Opcode: msg.Opcode, Rsv1: rsv1, Payload: msg.Data}
+			for i := len(c.extensions) - 1; i >= 0; i-- {
+				if err := c.extensions[i].Decode(c, &m); err != nil {
+					if errors.Is(err, ErrMessageTooLarge) {
+						return Message{}, c.failTooLarge()
+					}
+					return Message{}, err
+				}
+			}
+			msg.Data = m.Payload
+			if c.MaxMessageSize > 0 && int64(len(msg.Data)) > c.MaxMessageSize {
+				return Message{}, c.failTooLarge()
+			}
+			if msg.Opcode == OpText {
+				valid := text.complete()
+				if c.decodesPayload(rsv1) {
+					valid = utf8.Valid(msg.Data)
+				}
+				if !valid {
+					return Message{}, c.failInvalidUTF8()
+				}
+			}
+			c.messagesReceived.Add(1)
+			if c.OnMessageSize != nil {
+				c.OnMessageSize(msg.Opcode, len(msg.Data))
+			}
+			return msg, nil
+		}
+	}
+}
+
+// closedErr is the error reads of a closed connection return: the peer's
+// close frame if one was received, ErrClosed otherwise.
+func (c *Conn) closedErr() error {
+	if closeErr := c.peerClose.Load(); closeErr != nil {
+		return closeErr
+	}
+	return ErrClosed
+}
+
+// decodesPayload reports whether the extension pipeline may change the
+// payload of a message whose first frame had the given RSV1 bit. Only
+// then must text be validated after decoding rather than on the wire.
+func (c *Conn) decodesPayload(rsv1 bool) bool {
+	if rsv1 {
+		return true
+	}
+	for _, ext := range c.extensions {
+		if _, ok := ext.(deflateExtension); !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validateText feeds one fragment of a text message to v. Fragments whose
+// payload the extensions will still transform are skipped; such messages
+// are validated once decoded.
+func (c *Conn) validateText(v *utf8Validator, opcode byte, rsv1 bool, payload []byte) bool {
+	if opcode != OpText || c.decodesPayload(rsv1) {
+		return true
+	}
+	return v.write(payload)
+}
+
+// failTooLarge closes the connection with 1009 after a frame or message
+// exceeded the configured limits.
+func (c *Conn) failTooLarge() error {
+	c.sendClose(CloseMessageTooBig, "Message too large")
+	c.Close()
+	return ErrMessageTooLarge
+}
+
+// failProtocolError closes the connection with 1002 after the peer broke
+// the protocol as described by err, and returns err.
+func (c *Conn) failProtocolError(err error) error {
+	c.sendClose(CloseProtocolError, "")
+	c.Close()
+	return err
+}
+
+// failInvalidUTF8 closes the connection with 1007 after a text message
+// turned out not to be valid UTF-8.
+func (c *Conn) failInvalidUTF8() error {
+	c.sendClose(CloseInvalidPayload, "Invalid UTF-8")
+	c.Close()
+	return fmt.Errorf("Text message is not valid UTF-8")
+}
+
+// maxCloseReason is the longest close reason that fits in a control frame
+// next to the 2-byte status code.
+const maxCloseReason = maxControlPayload - 2
+
+// sendClose writes a close frame carrying code and reason. Passing
+// CloseNoStatusReceived sends a close frame with an empty payload, since
+// 1005 must never appear on the wire. Reasons longer than 123 bytes are
+// cut at the last whole UTF-8 character that fits. Only the first call
+// writes a frame; later calls are no-ops so a close is never sent twice.
+// Any other code that may not appear on the wire is rejected.
+func (c *Conn) sendClose(code uint16, reason string) error {
+	if code != CloseNoStatusReceived && !validCloseCode(code) {
+		return fmt.Errorf("Invalid close code %d", code)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if !c.advanceState(StateClosing) {
+		return nil
+	}
+	c.closeCode.Store(uint32(code))
+
+	var payload []byte
+	if code != CloseNoStatusReceived {
+		payload = binary.BigEndian.AppendUint16(nil, code)
+		payload = append(payload, truncateReason(reason)...)
+	}
+	return c.writeFrameLocked(Frame{Fin: true, Opcode: OpClose, Payload: payload})
+}
+
+// truncateReason shortens reason to at most maxCloseReason bytes without
+// splitting a multi-byte character.
+func truncateReason(reason string) string {
+	if len(reason) <= maxCloseReason {
+		return reason
+	}
+	n := maxCloseReason
+	for n > 0 && !utf8.RuneStart(reason[n]) {
+		n--
+	}
+	return reason[:n]
+}
+
+// parseClosePayload decodes the body of a close frame. An empty body means
+// no status code was sent and is reported as CloseNoStatusReceived. A code
+// not allowed on the wire or a reason that is not valid UTF-8 is a
+// protocol error.
+func parseClosePayload(payload []byte) (*CloseError, error) {
+	switch len(payload) {
+	case 0:
+		return &CloseError{Code: CloseNoStatusReceived}, nil
+	case 1:
+		return nil, fmt.Errorf("Close frame payload too short")
+	}
+	code := binary.BigEndian.Uint16(payload)
+	if !validCloseCode(code) {
+		return nil, fmt.Errorf("Invalid close code %d", code)
+	}
+	if !utf8.Valid(payload[2:]) {
+		return nil, fmt.Errorf("Close reason is not valid UTF-8")
+	}
+	return &CloseError{
+		Code: code,
+		Text: string(payload[2:]),
+	}, nil
+}
+
+// CloseGracefully performs the closing handshake: it sends a close frame
+// with code and reason, then waits up to CloseGracePeriod for the peer's
+// close reply, discarding any data messages still in flight, and finally
+// closes the connection. Since every frame is flushed when written, the
+// peer has received all earlier messages before the socket goes away.
+func (c *Conn) CloseGracefully(code uint16, reason string) error {
+	if err := c.sendClose(code, reason); err != nil {
+		c.Close()
+		return err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(c.CloseGracePeriod))
+	for {
+		if _, err := c.ReadMessage(); err != nil {
+			c.Close()
+			if _, ok := err.(*CloseError); ok {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// CloseNow sends a close frame with code and reason and closes the
+// connection straight away, without waiting for the peer's reply as
+// CloseGracefully does. It suits shutdown paths that must not linger; the
+// peer still learns why the connection ended. The socket is closed even if
+// the close frame cannot be sent, and the first error is returned.
+func (c *Conn) CloseNow(code uint16, reason string) error {
+	err := c.sendClose(code, reason)
+	if closeErr := c.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close closes the underlying network connection without a closing
+// handshake. It is safe to call any number of times, also after a
+// CloseGracefully, so handlers can always defer it; only the first call
+// closes the socket and reports its error.
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.advanceState(StateClosed)
+		err = c.conn.Close()
+		c.Resume()
+	})
+	return err
+}
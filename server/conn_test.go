@@ -0,0 +1,1181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestConn returns a server Conn connected through an in-memory pipe to
+// a peer ReadWriter that plays the role of the client.
+func newTestConn(t *testing.T) (*Conn, *bufio.ReadWriter) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	c := newConn(server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)), nil)
+	peer := bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))
+	return c, peer
+}
+
+// writeClientFrame writes a masked frame from the peer side and flushes it.
+func writeClientFrame(t *testing.T, peer *bufio.ReadWriter, fin bool, opcode byte, payload []byte) {
+	t.Helper()
+	if _, err := writeFrame(peer.Writer, Frame{Fin: fin, Opcode: opcode, Payload: payload, Masked: true}); err != nil {
+		t.Errorf("writeFrame() error = %v", err)
+		return
+	}
+	if err := peer.Flush(); err != nil {
+		t.Errorf("Flush() error = %v", err)
+	}
+}
+
+func TestConnSetGet(t *testing.T) {
+	c, _ := newTestConn(t)
+
+	if _, ok := c.Get("user"); ok {
+		t.Error("Get() on empty connection reported a value")
+	}
+
+	c.Set("user", "alice")
+	c.Set("room", 42)
+
+	if v, ok := c.Get("user"); !ok || v != "alice" {
+		t.Errorf("Get(user) = %v, %v, want alice, true", v, ok)
+	}
+	if v, ok := c.Get("room"); !ok || v != 42 {
+		t.Errorf("Get(room) = %v, %v, want 42, true", v, ok)
+	}
+}
+
+func TestConnSetGetConcurrent(t *testing.T) {
+	c, _ := newTestConn(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key-%d", i)
+			c.Set(key, i)
+			if v, ok := c.Get(key); !ok || v != i {
+				t.Errorf("Get(%s) = %v, %v, want %d, true", key, v, ok, i)
+			}
+			c.Get("key-0")
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestConnByteAccounting(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	go func() {
+		writeClientFrame(t, peer, true, OpText, []byte("hello"))
+		writeClientFrame(t, peer, true, OpBinary, make([]byte, 200))
+	}()
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.ReadMessage(); err != nil {
+			t.Fatal("ReadMessage() error:", err)
+		}
+	}
+
+	// Masked frames: 2 header + 4 mask + 5 payload, and
+	// 2 header + 2 extended length + 4 mask + 200 payload.
+	if got, want := c.BytesReceived(), int64(11+208); got != want {
+		t.Errorf("BytesReceived() = %d, want %d", got, want)
+	}
+	if got := c.MessagesReceived(); got != 2 {
+		t.Errorf("MessagesReceived() = %d, want 2", got)
+	}
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			if _, _, err := readFrame(peer.Reader); err != nil {
+				t.Errorf("readFrame() error = %v", err)
+			}
+		}
+	}()
+
+	if err := c.WriteMessage(OpText, []byte("world!")); err != nil {
+		t.Fatal("WriteMessage() error:", err)
+	}
+	if err := c.WriteMessage(OpBinary, make([]byte, 300)); err != nil {
+		t.Fatal("WriteMessage() error:", err)
+	}
+
+	// Unmasked frames: 2 header + 6 payload, and 2 header + 2 extended
+	// length + 300 payload.
+	if got, want := c.BytesSent(), int64(8+304); got != want {
+		t.Errorf("BytesSent() = %d, want %d", got, want)
+	}
+	if got := c.MessagesSent(); got != 2 {
+		t.Errorf("MessagesSent() = %d, want 2", got)
+	}
+}
+
+func TestSendCloseWithoutStatus(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	go func() {
+		if err := c.sendClose(CloseNoStatusReceived, ""); err != nil {
+			t.Errorf("sendClose() error = %v", err)
+		}
+	}()
+
+	f, _, err := readFrame(peer.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if f.Opcode != OpClose || !f.Fin {
+		t.Errorf("Frame opcode = %#x, fin = %v, want close frame with fin", f.Opcode, f.Fin)
+	}
+	if len(f.Payload) != 0 {
+		t.Errorf("Close payload = %v, want empty", f.Payload)
+	}
+}
+
+func TestSendCloseWithStatus(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	go func() {
+		if err := c.sendClose(CloseGoingAway, "bye"); err != nil {
+			t.Errorf("sendClose() error = %v", err)
+		}
+	}()
+
+	f, _, err := readFrame(peer.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	want := []byte{0x03, 0xE9, 'b', 'y', 'e'}
+	if string(f.Payload) != string(want) {
+		t.Errorf("Close payload = %v, want %v", f.Payload, want)
+	}
+}
+
+func TestSendCloseInvalidCode(t *testing.T) {
+	c, _ := newTestConn(t)
+	for _, code := range []uint16{0, 999, CloseAbnormalClosure, 1015, 2999, 5000} {
+		if err := c.sendClose(code, ""); err == nil {
+			t.Errorf("sendClose(%d) error = nil, want error", code)
+		}
+	}
+	if got := c.State(); got != StateOpen {
+		t.Errorf("State() = %v after rejected closes, want open", got)
+	}
+}
+
+func TestConnApplicationCloseCode(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	echo := make(chan Frame, 1)
+	go func() {
+		writeClientFrame(t, peer, true, OpClose, []byte{0x0F, 0xA1, 'a', 'p', 'p'})
+		f, _, _ := readFrame(peer.Reader)
+		echo <- f
+	}()
+
+	_, err := c.ReadMessage()
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != 4001 || closeErr.Text != "app" {
+		t.Fatalf("ReadMessage() error = %v, want close 4001 %q", err, "app")
+	}
+	if f := <-echo; len(f.Payload) < 2 || binary.BigEndian.Uint16(f.Payload) != 4001 {
+		t.Errorf("Echoed close payload = %v, want code 4001", f.Payload)
+	}
+}
+
+func TestReadCloseInvalidCode(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	reply := make(chan Frame, 1)
+	go func() {
+		writeClientFrame(t, peer, true, OpClose, []byte{0x03, 0xEE})
+		f, _, _ := readFrame(peer.Reader)
+		reply <- f
+	}()
+
+	_, err := c.ReadMessage()
+	if _, ok := err.(*CloseError); ok || err == nil {
+		t.Fatalf("ReadMessage() error = %v, want protocol error for code 1006", err)
+	}
+	if f := <-reply; len(f.Payload) < 2 || binary.BigEndian.Uint16(f.Payload) != CloseProtocolError {
+		t.Errorf("Close reply payload = %v, want code 1002", f.Payload)
+	}
+}
+
+func TestReadEmptyCloseFrame(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	echo := make(chan Frame, 1)
+	go func() {
+		writeClientFrame(t, peer, true, OpClose, nil)
+		f, _, err := readFrame(peer.Reader)
+		if err != nil {
+			t.Errorf("readFrame() error = %v", err)
+		}
+		echo <- f
+	}()
+
+	_, err := c.ReadMessage()
+	closeErr, ok := err.(*CloseError)
+	if !ok {
+		t.Fatalf("ReadMessage() error = %v, want *CloseError", err)
+	}
+	if closeErr.Code != CloseNoStatusReceived {
+		t.Errorf("CloseError.Code = %d, want %d", closeErr.Code, CloseNoStatusReceived)
+	}
+
+	if f := <-echo; f.Opcode != OpClose || len(f.Payload) != 0 {
+		t.Errorf("Echoed frame opcode = %#x, payload = %v, want empty close", f.Opcode, f.Payload)
+	}
+}
+
+func TestConnWriteOrdering(t *testing.T) {
+	c, peer := newTestConn(t)
+	const count = 5000
+
+	go func() {
+		for i := 0; i < count; i++ {
+			if err := c.WriteMessage(OpText, []byte(strconv.Itoa(i))); err != nil {
+				t.Errorf("WriteMessage() error = %v", err)
+				return
+			}
+		}
+	}()
+
+	// A concurrent writer of control frames must not disturb the order of
+	// the data messages.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				if err := c.writeFrame(true, OpPing, nil); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for next := 0; next < count; {
+		f, _, err := readFrame(peer.Reader)
+		if err != nil {
+			t.Fatal("readFrame() error:", err)
+		}
+		if f.Opcode == OpPing {
+			continue
+		}
+		got, err := strconv.Atoi(string(f.Payload))
+		if err != nil {
+			t.Fatalf("Unexpected payload %q", f.Payload)
+		}
+		if got != next {
+			t.Fatalf("Received message %d, want %d", got, next)
+		}
+		next++
+	}
+}
+
+func TestConnSendFragment(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		steps := []struct {
+			opcode byte
+			data   string
+			fin    bool
+		}{
+			{OpText, "Hel", false},
+			{OpContinuation, "lo, ", false},
+			{OpContinuation, "World", true},
+		}
+		for i, step := range steps {
+			if err := c.SendFragment(step.opcode, []byte(step.data), step.fin); err != nil {
+				t.Errorf("SendFragment() step %d error = %v", i, err)
+				return
+			}
+			if i == 0 {
+				if err := c.WriteMessage(OpText, []byte("interleaved")); err == nil {
+					t.Error("WriteMessage() during fragmented message error = nil, want error")
+				}
+			}
+		}
+	}()
+
+	var opcode byte
+	var message []byte
+	for {
+		f, _, err := readFrame(peer.Reader)
+		if err != nil {
+			t.Fatal("readFrame() error:", err)
+		}
+		if opcode == 0 {
+			opcode = f.Opcode
+		} else if f.Opcode != OpContinuation {
+			t.Fatalf("Frame opcode = %#x, want continuation", f.Opcode)
+		}
+		message = append(message, f.Payload...)
+		if f.Fin {
+			break
+		}
+	}
+
+	<-done
+
+	if opcode != OpText || string(message) != "Hello, World" {
+		t.Errorf("Reassembled %#x %q, want text %q", opcode, message, "Hello, World")
+	}
+	if got := c.MessagesSent(); got != 1 {
+		t.Errorf("MessagesSent() = %d, want 1", got)
+	}
+}
+
+func TestConnSendFragmentInvalidSequence(t *testing.T) {
+	c, _ := newTestConn(t)
+
+	if err := c.SendFragment(OpContinuation, []byte("x"), true); err == nil {
+		t.Error("SendFragment(continuation) without start error = nil, want error")
+	}
+	if err := c.SendFragment(OpPing, nil, false); err == nil {
+		t.Error("SendFragment(ping) error = nil, want error")
+	}
+}
+
+func TestConnSimultaneousClose(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	// Both sides send a close frame before reading the other's.
+	sent := make(chan error, 1)
+	go func() {
+		sent <- c.sendClose(CloseNormalClosure, "server")
+	}()
+	go writeClientFrame(t, peer, true, OpClose, []byte{0x03, 0xE8, 'c'})
+
+	f, _, err := readFrame(peer.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if f.Opcode != OpClose {
+		t.Fatalf("Frame opcode = %#x, want close", f.Opcode)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal("sendClose() error:", err)
+	}
+
+	_, err = c.ReadMessage()
+	closeErr, ok := err.(*CloseError)
+	if !ok || closeErr.Code != CloseNormalClosure {
+		t.Fatalf("ReadMessage() error = %v, want close 1000", err)
+	}
+
+	// The peer's close is the reply to ours, so nothing is echoed and the
+	// socket is closed.
+	if f, _, err := readFrame(peer.Reader); err == nil {
+		t.Errorf("Received unexpected frame %#x after simultaneous close", f.Opcode)
+	}
+}
+
+func TestConnCloseEchoedOnce(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	go writeClientFrame(t, peer, true, OpClose, []byte{0x03, 0xE8})
+
+	echo := make(chan Frame, 1)
+	go func() {
+		f, _, err := readFrame(peer.Reader)
+		if err != nil {
+			t.Errorf("readFrame() error = %v", err)
+		}
+		echo <- f
+	}()
+
+	if _, err := c.ReadMessage(); err == nil {
+		t.Fatal("ReadMessage() error = nil, want *CloseError")
+	}
+	if f := <-echo; f.Opcode != OpClose {
+		t.Errorf("Echoed frame opcode = %#x, want close", f.Opcode)
+	}
+
+	// A second close attempt is a no-op.
+	if err := c.sendClose(CloseNormalClosure, ""); err != nil {
+		t.Errorf("Second sendClose() error = %v, want nil", err)
+	}
+}
+
+func TestConnOnMessageSize(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	type sample struct {
+		opcode byte
+		n      int
+	}
+	var got []sample
+	c.OnMessageSize = func(opcode byte, n int) {
+		got = append(got, sample{opcode, n})
+	}
+
+	go func() {
+		writeClientFrame(t, peer, true, OpText, []byte("hello"))
+		writeClientFrame(t, peer, true, OpBinary, make([]byte, 300))
+		writeClientFrame(t, peer, false, OpText, []byte("frag"))
+		writeClientFrame(t, peer, true, OpPing, nil)
+		writeClientFrame(t, peer, false, OpContinuation, []byte("mented"))
+		writeClientFrame(t, peer, true, OpContinuation, []byte("!"))
+	}()
+	go func() {
+		// Drain the automatic pong.
+		readFrame(peer.Reader)
+	}()
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.ReadMessage(); err != nil {
+			t.Fatal("ReadMessage() error:", err)
+		}
+	}
+
+	want := []sample{{OpText, 5}, {OpBinary, 300}, {OpText, 11}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("OnMessageSize samples = %v, want %v", got, want)
+	}
+}
+
+func TestConnMaxFragments(t *testing.T) {
+	c, peer := newTestConn(t)
+	c.MaxFragments = 3
+
+	closeFrame := make(chan Frame, 1)
+	go func() {
+		writeClientFrame(t, peer, false, OpText, []byte("a"))
+		for i := 0; i < 3; i++ {
+			writeClientFrame(t, peer, false, OpContinuation, []byte("b"))
+		}
+	}()
+	go func() {
+		f, _, _ := readFrame(peer.Reader)
+		closeFrame <- f
+	}()
+
+	_, err := c.ReadMessage()
+	if !errors.Is(err, ErrTooManyFragments) {
+		t.Fatalf("ReadMessage() error = %v, want ErrTooManyFragments", err)
+	}
+
+	f := <-closeFrame
+	if f.Opcode != OpClose || len(f.Payload) < 2 || binary.BigEndian.Uint16(f.Payload) != CloseMessageTooBig {
+		t.Errorf("Got frame %#x %v, want close 1009", f.Opcode, f.Payload)
+	}
+}
+
+func TestConnMaxFragmentsWithinLimit(t *testing.T) {
+	c, peer := newTestConn(t)
+	c.MaxFragments = 3
+
+	go func() {
+		writeClientFrame(t, peer, false, OpText, []byte("a"))
+		writeClientFrame(t, peer, false, OpContinuation, []byte("b"))
+		writeClientFrame(t, peer, true, OpContinuation, []byte("c"))
+	}()
+
+	msg, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal("ReadMessage() error:", err)
+	}
+	if string(msg.Data) != "abc" {
+		t.Errorf("ReadMessage() = %q, want %q", msg.Data, "abc")
+	}
+}
+
+func TestReadCloseReason(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	go func() {
+		writeClientFrame(t, peer, true, OpClose, append([]byte{0x03, 0xE8}, "héllo"...))
+		readFrame(peer.Reader)
+	}()
+
+	_, err := c.ReadMessage()
+	closeErr, ok := err.(*CloseError)
+	if !ok {
+		t.Fatalf("ReadMessage() error = %v, want *CloseError", err)
+	}
+	if closeErr.Code != CloseNormalClosure || closeErr.Text != "héllo" {
+		t.Errorf("CloseError = %d %q, want %d %q", closeErr.Code, closeErr.Text, CloseNormalClosure, "héllo")
+	}
+}
+
+func TestReadCloseReasonInvalidUTF8(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	reply := make(chan Frame, 1)
+	go func() {
+		writeClientFrame(t, peer, true, OpClose, []byte{0x03, 0xE8, 0xff, 0xfe})
+		f, _, _ := readFrame(peer.Reader)
+		reply <- f
+	}()
+
+	_, err := c.ReadMessage()
+	if err == nil {
+		t.Fatal("ReadMessage() succeeded with an invalid UTF-8 close reason")
+	}
+	if _, ok := err.(*CloseError); ok {
+		t.Fatalf("ReadMessage() error = %v, want protocol error", err)
+	}
+
+	f := <-reply
+	if f.Opcode != OpClose || len(f.Payload) < 2 || binary.BigEndian.Uint16(f.Payload) != CloseProtocolError {
+		t.Errorf("Got frame %#x %v, want close 1002", f.Opcode, f.Payload)
+	}
+}
+
+func TestSendCloseTruncatesReason(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	// 122 ASCII bytes followed by a 2-byte character that would straddle
+	// the 123-byte limit.
+	reason := strings.Repeat("a", 122) + "é"
+	go c.sendClose(CloseGoingAway, reason)
+
+	f, _, err := readFrame(peer.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if got, want := string(f.Payload[2:]), strings.Repeat("a", 122); got != want {
+		t.Errorf("Close reason = %q (%d bytes), want %d bytes", got, len(got), len(want))
+	}
+}
+
+func TestConnWriteAfterClose(t *testing.T) {
+	c, _ := newTestConn(t)
+
+	if got := c.State(); got != StateOpen {
+		t.Fatalf("State() = %v, want %v", got, StateOpen)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal("Close() error:", err)
+	}
+	if got := c.State(); got != StateClosed {
+		t.Errorf("State() = %v, want %v", got, StateClosed)
+	}
+
+	if err := c.WriteMessage(OpText, []byte("late")); !errors.Is(err, ErrClosed) {
+		t.Errorf("WriteMessage() error = %v, want ErrClosed", err)
+	}
+	if err := c.SendFragment(OpText, []byte("late"), true); !errors.Is(err, ErrClosed) {
+		t.Errorf("SendFragment() error = %v, want ErrClosed", err)
+	}
+	if _, err := c.ReadMessage(); !errors.Is(err, ErrClosed) {
+		t.Errorf("ReadMessage() error = %v, want ErrClosed", err)
+	}
+}
+
+func TestConnReadAfterCloseFrame(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	go func() {
+		payload := binary.BigEndian.AppendUint16(nil, CloseGoingAway)
+		writeClientFrame(t, peer, true, OpClose, append(payload, "bye"...))
+		// Trailing garbage after the close must never be parsed.
+		peer.Write([]byte{0xff, 0xff, 0xff})
+		peer.Flush()
+	}()
+	go readFrame(peer.Reader)
+
+	for i := 0; i < 3; i++ {
+		_, err := c.ReadMessage()
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != CloseGoingAway || closeErr.Text != "bye" {
+			t.Errorf("ReadMessage() call %d error = %v, want the peer's close", i+1, err)
+		}
+	}
+}
+
+func TestConnWriteAfterCloseFrame(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	go readFrame(peer.Reader)
+	if err := c.sendClose(CloseNormalClosure, ""); err != nil {
+		t.Fatal("sendClose() error:", err)
+	}
+	if got := c.State(); got != StateClosing {
+		t.Errorf("State() = %v, want %v", got, StateClosing)
+	}
+	if err := c.WriteMessage(OpText, []byte("late")); !errors.Is(err, ErrClosed) {
+		t.Errorf("WriteMessage() error = %v, want ErrClosed", err)
+	}
+}
+
+func TestConnDoubleClose(t *testing.T) {
+	c, _ := newTestConn(t)
+
+	if err := c.Close(); err != nil {
+		t.Fatal("First Close() error:", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Second Close() error = %v, want nil", err)
+	}
+}
+
+// countingConn counts calls to Close on the wrapped connection.
+type countingConn struct {
+	net.Conn
+	closes atomic.Int32
+}
+
+func (c *countingConn) Close() error {
+	c.closes.Add(1)
+	return c.Conn.Close()
+}
+
+func TestConnCloseOnce(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	cc := &countingConn{Conn: server}
+	c := newConn(cc, bufio.NewReadWriter(bufio.NewReader(cc), bufio.NewWriter(cc)), nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Close()
+		}()
+	}
+	wg.Wait()
+
+	if n := cc.closes.Load(); n != 1 {
+		t.Errorf("Underlying Close called %d times, want 1", n)
+	}
+	if got := c.State(); got != StateClosed {
+		t.Errorf("State() = %v, want %v", got, StateClosed)
+	}
+}
+
+func TestConnTextSplitCharacter(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	go func() {
+		writeClientFrame(t, peer, false, OpText, []byte("caf\xc3"))
+		writeClientFrame(t, peer, true, OpContinuation, []byte("\xa9"))
+	}()
+
+	msg, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal("ReadMessage() error:", err)
+	}
+	if string(msg.Data) != "café" {
+		t.Errorf("ReadMessage() = %q, want %q", msg.Data, "café")
+	}
+}
+
+func TestConnTextInvalidSplit(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	reply := make(chan Frame, 1)
+	go func() {
+		writeClientFrame(t, peer, false, OpText, []byte("caf\xc3"))
+		writeClientFrame(t, peer, false, OpContinuation, []byte("e"))
+		f, _, _ := readFrame(peer.Reader)
+		reply <- f
+	}()
+
+	if _, err := c.ReadMessage(); err == nil {
+		t.Fatal("ReadMessage() accepted invalid UTF-8")
+	}
+	f := <-reply
+	if f.Opcode != OpClose || len(f.Payload) < 2 || binary.BigEndian.Uint16(f.Payload) != CloseInvalidPayload {
+		t.Errorf("Got frame %#x %v, want close 1007", f.Opcode, f.Payload)
+	}
+}
+
+func TestConnMaxFrameSize(t *testing.T) {
+	c, peer := newTestConn(t)
+	c.MaxFrameSize = 1024
+
+	reply := make(chan Frame, 1)
+	go func() {
+		// A header declaring a 1 GiB payload, with no payload following.
+		peer.Write([]byte{0x82, 0xFF, 0, 0, 0, 0, 0x40, 0, 0, 0, 1, 2, 3, 4})
+		peer.Flush()
+		f, _, _ := readFrame(peer.Reader)
+		reply <- f
+	}()
+
+	if _, err := c.ReadMessage(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("ReadMessage() error = %v, want ErrMessageTooLarge", err)
+	}
+	f := <-reply
+	if f.Opcode != OpClose || len(f.Payload) < 2 || binary.BigEndian.Uint16(f.Payload) != CloseMessageTooBig {
+		t.Errorf("Got frame %#x %v, want close 1009", f.Opcode, f.Payload)
+	}
+}
+
+func TestConnMaxMessageSize(t *testing.T) {
+	c, peer := newTestConn(t)
+	c.MaxFrameSize = 100
+	c.MaxMessageSize = 150
+
+	reply := make(chan Frame, 1)
+	go func() {
+		writeClientFrame(t, peer, false, OpBinary, make([]byte, 100))
+		writeClientFrame(t, peer, true, OpContinuation, make([]byte, 100))
+		f, _, _ := readFrame(peer.Reader)
+		reply <- f
+	}()
+
+	if _, err := c.ReadMessage(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("ReadMessage() error = %v, want ErrMessageTooLarge", err)
+	}
+	f := <-reply
+	if f.Opcode != OpClose || len(f.Payload) < 2 || binary.BigEndian.Uint16(f.Payload) != CloseMessageTooBig {
+		t.Errorf("Got frame %#x %v, want close 1009", f.Opcode, f.Payload)
+	}
+}
+
+// writeCountingConn is a net.Conn that discards writes, counting them.
+type writeCountingConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *writeCountingConn) Write(b []byte) (int, error) {
+	c.writes++
+	return len(b), nil
+}
+
+func newWriteCountingConn() (*Conn, *writeCountingConn) {
+	cc := &writeCountingConn{}
+	return newConn(cc, bufio.NewReadWriter(bufio.NewReader(cc), bufio.NewWriter(cc)), nil), cc
+}
+
+func TestConnWriteMessages(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	// Larger than the write buffer, so the batch reaches the wire in
+	// several writes.
+	msgs := []Message{
+		{OpText, bytes.Repeat([]byte("a"), 3000)},
+		{OpBinary, bytes.Repeat([]byte("b"), 3000)},
+		{OpText, []byte("c")},
+	}
+	errs := make(chan error, 2)
+	go func() { errs <- c.WriteMessages(msgs) }()
+
+	var got []Frame
+	f, _, err := readFrame(peer.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	got = append(got, f)
+
+	// The batch is under way; the ping has to wait for all of it.
+	go func() { errs <- c.Ping([]byte("ping")) }()
+	for len(got) < len(msgs)+1 {
+		f, _, err := readFrame(peer.Reader)
+		if err != nil {
+			t.Fatal("readFrame() error:", err)
+		}
+		got = append(got, f)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal("Write error:", err)
+		}
+	}
+
+	for i, msg := range msgs {
+		if got[i].Opcode != msg.Opcode || !bytes.Equal(got[i].Payload, msg.Data) {
+			t.Errorf("Frame %d = %#x with %d bytes, want message %d", i, got[i].Opcode, len(got[i].Payload), i)
+		}
+	}
+	if last := got[len(msgs)]; last.Opcode != OpPing {
+		t.Errorf("Frame after the batch has opcode %#x, want the ping", last.Opcode)
+	}
+}
+
+func TestConnWriteMessageNoFlush(t *testing.T) {
+	c, cc := newWriteCountingConn()
+
+	for i := range 3 {
+		if err := c.WriteMessageNoFlush(OpText, []byte("message "+strconv.Itoa(i))); err != nil {
+			t.Fatal("WriteMessageNoFlush() error:", err)
+		}
+	}
+	if cc.writes != 0 {
+		t.Fatalf("Network writes before Flush = %d, want 0", cc.writes)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal("Flush() error:", err)
+	}
+	if cc.writes != 1 {
+		t.Errorf("Network writes after Flush = %d, want 1", cc.writes)
+	}
+	if got := c.MessagesSent(); got != 3 {
+		t.Errorf("MessagesSent() = %d, want 3", got)
+	}
+
+	// A ping must not wait behind buffered messages.
+	if err := c.WriteMessageNoFlush(OpText, []byte("buffered")); err != nil {
+		t.Fatal("WriteMessageNoFlush() error:", err)
+	}
+	if err := c.writeFrame(true, OpPing, nil); err != nil {
+		t.Fatal("writeFrame() error:", err)
+	}
+	if cc.writes != 2 {
+		t.Errorf("Network writes after ping = %d, want 2", cc.writes)
+	}
+}
+
+func benchmarkWriteBurst(b *testing.B, write func(c *Conn, data []byte) error) {
+	c, _ := newWriteCountingConn()
+	data := make([]byte, 64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for range 16 {
+			if err := write(c, data); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := c.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteBurstFlushEach(b *testing.B) {
+	benchmarkWriteBurst(b, func(c *Conn, data []byte) error { return c.WriteMessage(OpBinary, data) })
+}
+
+func BenchmarkWriteBurstBatched(b *testing.B) {
+	benchmarkWriteBurst(b, func(c *Conn, data []byte) error { return c.WriteMessageNoFlush(OpBinary, data) })
+}
+
+func TestConnWriteTextBinary(t *testing.T) {
+	c, peer := newTestConn(t)
+	go func() {
+		if err := c.WriteText("Hello"); err != nil {
+			t.Errorf("WriteText() error: %v", err)
+		}
+		if err := c.WriteBinary([]byte{0x00, 0xff}); err != nil {
+			t.Errorf("WriteBinary() error: %v", err)
+		}
+	}()
+
+	for _, want := range []Frame{
+		{Opcode: OpText, Payload: []byte("Hello")},
+		{Opcode: OpBinary, Payload: []byte{0x00, 0xff}},
+	} {
+		f, _, err := readFrame(peer.Reader)
+		if err != nil {
+			t.Fatal("readFrame() error:", err)
+		}
+		if !f.Fin || f.Masked || f.Opcode != want.Opcode || string(f.Payload) != string(want.Payload) {
+			t.Errorf("Got fin=%v masked=%v opcode=%#x payload=%v, want unmasked final %#x %v",
+				f.Fin, f.Masked, f.Opcode, f.Payload, want.Opcode, want.Payload)
+		}
+	}
+
+	if err := c.WriteText("\xff"); !errors.Is(err, ErrInvalidUTF8) {
+		t.Errorf("WriteText(invalid) error = %v, want ErrInvalidUTF8", err)
+	}
+}
+
+func TestConnEmptyMessages(t *testing.T) {
+	for _, pool := range []BufferPool{nil, NewBufferPool()} {
+		c, peer := newTestConn(t)
+		c.BufferPool = pool
+
+		for _, opcode := range []byte{OpText, OpBinary} {
+			written := make(chan struct{})
+			go func() {
+				writeClientFrame(t, peer, true, opcode, nil)
+				close(written)
+			}()
+			msg, err := c.ReadMessage()
+			<-written
+			if err != nil {
+				t.Fatalf("ReadMessage() error: %v", err)
+			}
+			if msg.Opcode != opcode || msg.Data == nil || len(msg.Data) != 0 {
+				t.Errorf("ReadMessage() = %#x %#v, want empty non-nil %#x", msg.Opcode, msg.Data, opcode)
+			}
+
+			sent := make(chan error, 1)
+			go func() { sent <- c.WriteMessage(opcode, nil) }()
+			f, _, err := readFrame(peer.Reader)
+			if err := <-sent; err != nil {
+				t.Fatal("WriteMessage() error:", err)
+			}
+			if err != nil {
+				t.Fatal("readFrame() error:", err)
+			}
+			if !f.Fin || f.Opcode != opcode || len(f.Payload) != 0 {
+				t.Errorf("Got fin=%v opcode=%#x payload=%v, want empty %#x", f.Fin, f.Opcode, f.Payload, opcode)
+			}
+		}
+	}
+}
+
+func TestConnBinaryControlPayload(t *testing.T) {
+	c, peer := newTestConn(t)
+	// Every byte from 0xFF down, so the payload is not valid UTF-8.
+	payload := make([]byte, maxControlPayload)
+	for i := range payload {
+		payload[i] = byte(255 - i)
+	}
+
+	frames := make(chan Frame, 3)
+	go func() {
+		for {
+			f, _, err := readFrame(peer.Reader)
+			if err != nil {
+				return
+			}
+			frames <- f
+		}
+	}()
+	go func() {
+		writeClientFrame(t, peer, true, OpPing, payload)
+		writeClientFrame(t, peer, true, OpText, []byte("done"))
+	}()
+
+	if _, err := c.ReadMessage(); err != nil {
+		t.Fatal("ReadMessage() error:", err)
+	}
+	if f := <-frames; f.Opcode != OpPong || !bytes.Equal(f.Payload, payload) {
+		t.Errorf("Automatic reply = %#x %x, want pong %x", f.Opcode, f.Payload, payload)
+	}
+
+	if err := c.Ping(payload); err != nil {
+		t.Fatal("Ping() error:", err)
+	}
+	if f := <-frames; f.Opcode != OpPing || !bytes.Equal(f.Payload, payload) {
+		t.Errorf("Ping() sent %#x %x, want ping %x", f.Opcode, f.Payload, payload)
+	}
+	if err := c.Pong(payload); err != nil {
+		t.Fatal("Pong() error:", err)
+	}
+	if f := <-frames; f.Opcode != OpPong || !bytes.Equal(f.Payload, payload) {
+		t.Errorf("Pong() sent %#x %x, want pong %x", f.Opcode, f.Payload, payload)
+	}
+
+	tooLarge := make([]byte, maxControlPayload+1)
+	if err := c.Ping(tooLarge); !errors.Is(err, ErrControlTooLarge) {
+		t.Errorf("Ping() of %d bytes error = %v, want ErrControlTooLarge", len(tooLarge), err)
+	}
+	if err := c.Pong(tooLarge); !errors.Is(err, ErrControlTooLarge) {
+		t.Errorf("Pong() of %d bytes error = %v, want ErrControlTooLarge", len(tooLarge), err)
+	}
+}
+
+func TestConnFragmentedControlFrame(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	closeFrame := make(chan Frame, 1)
+	go writeClientFrame(t, peer, false, OpPing, []byte("frag"))
+	go func() {
+		f, _, _ := readFrame(peer.Reader)
+		closeFrame <- f
+	}()
+
+	if _, err := c.ReadMessage(); err == nil {
+		t.Fatal("ReadMessage() accepted a ping with FIN unset")
+	}
+	f := <-closeFrame
+	if f.Opcode != OpClose || len(f.Payload) < 2 || binary.BigEndian.Uint16(f.Payload) != CloseProtocolError {
+		t.Errorf("Got frame %#x %v, want a close with %d", f.Opcode, f.Payload, CloseProtocolError)
+	}
+}
+
+func TestConnProtocolErrorsCloseWith1002(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames []Frame
+	}{
+		{"unmasked frame", []Frame{{Fin: true, Opcode: OpText, Payload: []byte("hi")}}},
+		{"RSV1 without extension", []Frame{{Fin: true, Rsv1: true, Opcode: OpText, Payload: []byte("hi"), Masked: true}}},
+		{"unexpected continuation", []Frame{{Fin: true, Opcode: OpContinuation, Payload: []byte("hi"), Masked: true}}},
+		{"expected continuation", []Frame{
+			{Fin: false, Opcode: OpText, Payload: []byte("he"), Masked: true},
+			{Fin: true, Opcode: OpText, Payload: []byte("llo"), Masked: true},
+		}},
+		{"unknown opcode", []Frame{{Fin: true, Opcode: 0x3, Payload: []byte("hi"), Masked: true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, peer := newTestConn(t)
+
+			closeFrame := make(chan Frame, 1)
+			go func() {
+				for _, f := range tt.frames {
+					if _, err := writeFrame(peer.Writer, f); err != nil {
+						return
+					}
+				}
+				peer.Flush()
+			}()
+			go func() {
+				f, _, _ := readFrame(peer.Reader)
+				closeFrame <- f
+			}()
+
+			if _, err := c.ReadMessage(); err == nil {
+				t.Fatal("ReadMessage() succeeded, want a protocol error")
+			}
+			f := <-closeFrame
+			if f.Opcode != OpClose || len(f.Payload) < 2 || binary.BigEndian.Uint16(f.Payload) != CloseProtocolError {
+				t.Errorf("Got frame %#x %v, want a close with %d", f.Opcode, f.Payload, CloseProtocolError)
+			}
+		})
+	}
+}
+
+func TestConnLenientControlFrames(t *testing.T) {
+	payload := bytes.Repeat([]byte("p"), 130)
+
+	t.Run("off", func(t *testing.T) {
+		c, peer := newTestConn(t)
+		go writeClientFrame(t, peer, true, OpPing, payload)
+		if _, err := c.ReadMessage(); err == nil {
+			t.Fatalf("ReadMessage() accepted a %d-byte ping", len(payload))
+		}
+	})
+
+	t.Run("on", func(t *testing.T) {
+		c, peer := newTestConn(t)
+		c.LenientControlFrames = true
+
+		pong := make(chan Frame, 1)
+		go func() {
+			f, _, _ := readFramePooled(peer.Reader, nil, 0, true)
+			pong <- f
+		}()
+		go func() {
+			writeClientFrame(t, peer, true, OpPing, payload)
+			writeClientFrame(t, peer, true, OpText, []byte("done"))
+		}()
+
+		msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal("ReadMessage() error:", err)
+		}
+		if string(msg.Data) != "done" {
+			t.Errorf("ReadMessage() = %q, want %q", msg.Data, "done")
+		}
+		if f := <-pong; f.Opcode != OpPong || !bytes.Equal(f.Payload, payload) {
+			t.Errorf("Automatic reply = %#x with %d bytes, want pong with %d", f.Opcode, len(f.Payload), len(payload))
+		}
+	})
+}
+
+// shortWriteConn is a net.Conn whose first write sends only half its data
+// before failing, leaving a partial frame behind.
+type shortWriteConn struct {
+	net.Conn
+	mu     sync.Mutex
+	failed bool
+	sent   bytes.Buffer
+}
+
+func (c *shortWriteConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failed {
+		return c.sent.Write(b)
+	}
+	c.failed = true
+	n, _ := c.sent.Write(b[:len(b)/2])
+	return n, errors.New("connection reset")
+}
+
+func (c *shortWriteConn) Close() error { return nil }
+
+func TestConnPartialWrite(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(c *Conn) error
+	}{
+		{"WriteMessage", func(c *Conn) error { return c.WriteMessage(OpText, []byte("hello")) }},
+		{"greet", greet},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := &shortWriteConn{}
+			c := newConn(sc, bufio.NewReadWriter(bufio.NewReader(sc), bufio.NewWriter(sc)), nil)
+
+			if err := tt.write(c); err == nil {
+				t.Fatal("Write succeeded despite a failing connection")
+			}
+			if got := c.State(); got != StateClosed {
+				t.Errorf("State() = %v, want %v", got, StateClosed)
+			}
+			partial := sc.sent.Len()
+			if err := c.WriteMessage(OpText, []byte("more")); !errors.Is(err, ErrClosed) {
+				t.Errorf("WriteMessage() after failed write error = %v, want ErrClosed", err)
+			}
+			if err := c.Ping(nil); !errors.Is(err, ErrClosed) {
+				t.Errorf("Ping() after failed write error = %v, want ErrClosed", err)
+			}
+			if sc.sent.Len() != partial {
+				t.Errorf("Sent %d more bytes after the partial frame", sc.sent.Len()-partial)
+			}
+		})
+	}
+}
+
+func TestConnCloseNow(t *testing.T) {
+	c, peer := newTestConn(t)
+	// A CloseNow that waited for the reply would hang the test.
+	c.CloseGracePeriod = time.Hour
+
+	frames := make(chan Frame, 1)
+	go func() {
+		f, _, err := readFrame(peer.Reader)
+		if err != nil {
+			t.Error("Reading close frame:", err)
+		}
+		frames <- f
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- c.CloseNow(CloseGoingAway, "shutting down") }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("CloseNow() error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("CloseNow() waited for the peer's reply")
+	}
+
+	f := <-frames
+	closeErr, err := parseClosePayload(f.Payload)
+	if f.Opcode != OpClose || err != nil || closeErr.Code != CloseGoingAway || closeErr.Text != "shutting down" {
+		t.Errorf("Sent %#x %q, want close %d %q", f.Opcode, f.Payload, CloseGoingAway, "shutting down")
+	}
+	if got := c.State(); got != StateClosed {
+		t.Errorf("State() = %v, want %v", got, StateClosed)
+	}
+	if _, err := peer.ReadByte(); err == nil {
+		t.Error("Peer could still read after CloseNow")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+// handlers are the callbacks registered with OnText and friends for Listen.
+type handlers struct {
+	text   func(data []byte)
+	binary func(data []byte)
+	ping   func(payload []byte)
+	pong   func(payload []byte)
+	close  func(code uint16, reason string)
+}
+
+// OnText registers fn to receive the data of each text message read by
+// Listen. Like the other On methods, it must be called before Listen, and
+// registering again replaces the previous callback. Messages or frames
+// without a callback are dropped.
+func (c *Conn) OnText(fn func(data []byte)) {
+	c.handlers.text = fn
+}
+
+// OnBinary registers fn to receive the data of each binary message read by
+// Listen.
+func (c *Conn) OnBinary(fn func(data []byte)) {
+	c.handlers.binary = fn
+}
+
+// OnPing registers fn to observe pings. Listen answers them whether or not
+// a callback is registered.
+func (c *Conn) OnPing(fn func(payload []byte)) {
+	c.handlers.ping = fn
+}
+
+// OnPong registers fn to observe pongs.
+func (c *Conn) OnPong(fn func(payload []byte)) {
+	c.handlers.pong = fn
+}
+
+// OnClose registers fn to receive the peer's close frame. Listen echoes
+// the close before calling it.
+func (c *Conn) OnClose(fn func(code uint16, reason string)) {
+	c.handlers.close = fn
+}
+
+// Listen reads from the connection until it closes, passing each message
+// and control frame to the callback registered for its type. Callbacks run
+// on the calling goroutine, one at a time and in the order the peer sent
+// the frames. Listen returns nil once the peer has closed the connection,
+// and the read error otherwise. It must not be mixed with ReadMessage.
+func (c *Conn) Listen() error {
+	for {
+		ev, err := c.ReadEvent()
+		if err != nil {
+			return err
+		}
+		h := c.handlers
+		switch ev.Type {
+		case EventData:
+			fn := h.text
+			if ev.Message.Opcode == OpBinary {
+				fn = h.binary
+			}
+			if fn != nil {
+				fn(ev.Message.Data)
+			}
+		case EventPing:
+			if h.ping != nil {
+				h.ping(ev.Payload)
+			}
+		case EventPong:
+			if h.pong != nil {
+				h.pong(ev.Payload)
+			}
+		case EventClose:
+			if h.close != nil {
+				h.close(ev.Close.Code, ev.Close.Text)
+			}
+			return nil
+		}
+	}
+}
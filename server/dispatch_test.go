@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestConnListen(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	var got []string
+	c.OnText(func(data []byte) { got = append(got, "text "+string(data)) })
+	c.OnBinary(func(data []byte) { got = append(got, "binary "+string(data)) })
+	c.OnPing(func(payload []byte) { got = append(got, "ping "+string(payload)) })
+	c.OnClose(func(code uint16, reason string) { got = append(got, "close "+reason) })
+
+	go func() {
+		for {
+			if _, _, err := readFrame(peer.Reader); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		writeClientFrame(t, peer, true, OpText, []byte("one"))
+		writeClientFrame(t, peer, true, OpBinary, []byte("two"))
+		writeClientFrame(t, peer, true, OpPing, []byte("three"))
+		writeClientFrame(t, peer, true, OpPong, []byte("ignored"))
+		writeClientFrame(t, peer, true, OpText, []byte("four"))
+		writeClientFrame(t, peer, true, OpClose, append([]byte{0x03, 0xE8}, "bye"...))
+	}()
+
+	if err := c.Listen(); err != nil {
+		t.Fatal("Listen() error:", err)
+	}
+	want := []string{"text one", "binary two", "ping three", "text four", "close bye"}
+	if len(got) != len(want) {
+		t.Fatalf("Callbacks = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Callback %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
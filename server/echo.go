@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+// Echo returns a handler for Handler that sends every data message back to
+// the peer until it closes the connection. The reply keeps the message's
+// opcode unless remap is non-nil, in which case it is sent with
+// remap(msg) instead.
+func Echo(remap func(msg Message) byte) func(*Conn) error {
+	return func(c *Conn) error {
+		for {
+			msg, err := c.ReadMessage()
+			var closeErr *CloseError
+			if errors.As(err, &closeErr) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			opcode := msg.Opcode
+			if remap != nil {
+				opcode = remap(msg)
+			}
+			if err := c.WriteMessage(opcode, msg.Data); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// SwapTextBinary is a remap function for Echo that answers text with binary
+// and binary with text. Binary data that is not valid UTF-8 stays binary,
+// since sending it as text would violate the protocol.
+func SwapTextBinary(msg Message) byte {
+	switch {
+	case msg.Opcode == OpText:
+		return OpBinary
+	case msg.Opcode == OpBinary && utf8.Valid(msg.Data):
+		return OpText
+	}
+	return msg.Opcode
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEchoSwapTextBinary(t *testing.T) {
+	srv := httptest.NewServer(Handler(Echo(SwapTextBinary)))
+	defer srv.Close()
+
+	resp, rw := dialTestServer(t, srv, "/ws", nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	tests := []struct {
+		opcode byte
+		data   string
+		want   byte
+	}{
+		{OpText, "héllo", OpBinary},
+		{OpBinary, "plain", OpText},
+		{OpBinary, "\xff\xfe", OpBinary},
+	}
+	for _, tt := range tests {
+		writeClientFrame(t, rw, true, tt.opcode, []byte(tt.data))
+		f, _, err := readFrame(rw.Reader)
+		if err != nil {
+			t.Fatal("readFrame() error:", err)
+		}
+		if f.Opcode != tt.want || string(f.Payload) != tt.data {
+			t.Errorf("Echo of %#x %q = %#x %q, want %#x", tt.opcode, tt.data, f.Opcode, f.Payload, tt.want)
+		}
+	}
+}
+
+func TestEchoPreservesOpcode(t *testing.T) {
+	srv := httptest.NewServer(Handler(Echo(nil)))
+	defer srv.Close()
+
+	_, rw := dialTestServer(t, srv, "/ws", nil)
+	writeClientFrame(t, rw, true, OpBinary, []byte{1, 2, 3})
+	f, _, err := readFrame(rw.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if f.Opcode != OpBinary || string(f.Payload) != "\x01\x02\x03" {
+		t.Errorf("Got %#x %v, want binary [1 2 3]", f.Opcode, f.Payload)
+	}
+
+	writeClientFrame(t, rw, true, OpClose, []byte{0x03, 0xE8})
+	f, _, err = readFrame(rw.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if f.Opcode != OpClose {
+		t.Errorf("Got opcode %#x, want close", f.Opcode)
+	}
+}
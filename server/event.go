@@ -0,0 +1,69 @@
+package main
+
+import "errors"
+
+// EventType says what kind of frame an Event reports.
+type EventType int
+
+// Event types returned by ReadEvent.
+const (
+	EventData EventType = iota
+	EventPing
+	EventPong
+	EventClose
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventData:
+		return "data"
+	case EventPing:
+		return "ping"
+	case EventPong:
+		return "pong"
+	case EventClose:
+		return "close"
+	}
+	return "unknown"
+}
+
+// Event is a data message or control frame read by ReadEvent. Message is
+// set for EventData, Payload for EventPing and EventPong, and Close for
+// EventClose.
+type Event struct {
+	Type    EventType
+	Message Message
+	Payload []byte
+	Close   *CloseError
+}
+
+// errEventPending ends a read that has queued a control event.
+var errEventPending = errors.New("Control event pending")
+
+// ReadEvent is ReadMessage for applications that want to see control
+// frames too, such as monitoring tools. It returns each data message,
+// ping, pong and close in the order the peer sent them; a control frame
+// arriving between the fragments of a message is reported before that
+// message. Pings are still answered and closes echoed as by ReadMessage.
+// After the close event, ReadEvent returns the *CloseError as ReadMessage
+// does. It must not be mixed with ReadMessage on the same connection.
+func (c *Conn) ReadEvent() (Event, error) {
+	if len(c.events) == 0 {
+		msg, err := c.readMessage(func(ev Event) {
+			c.events = append(c.events, ev)
+		})
+		switch {
+		case err == nil:
+			c.events = append(c.events, Event{Type: EventData, Message: msg})
+		case errors.Is(err, errEventPending):
+		case len(c.events) > 0 && c.events[len(c.events)-1].Type == EventClose:
+			// The read ended with the peer's close; report it first.
+		default:
+			c.events = nil
+			return Event{}, err
+		}
+	}
+	ev := c.events[0]
+	c.events = c.events[1:]
+	return ev, nil
+}
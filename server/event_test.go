@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestConnReadEvent(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	replies := make(chan Frame, 2)
+	go func() {
+		for {
+			f, _, err := readFrame(peer.Reader)
+			if err != nil {
+				return
+			}
+			replies <- f
+		}
+	}()
+	go func() {
+		writeClientFrame(t, peer, true, OpText, []byte("first"))
+		writeClientFrame(t, peer, true, OpPing, []byte("ping"))
+		writeClientFrame(t, peer, false, OpBinary, []byte{1})
+		writeClientFrame(t, peer, true, OpPong, []byte("pong"))
+		writeClientFrame(t, peer, true, OpContinuation, []byte{2})
+		writeClientFrame(t, peer, true, OpClose, []byte{0x03, 0xE8})
+	}()
+
+	want := []Event{
+		{Type: EventData, Message: Message{Opcode: OpText, Data: []byte("first")}},
+		{Type: EventPing, Payload: []byte("ping")},
+		{Type: EventPong, Payload: []byte("pong")},
+		{Type: EventData, Message: Message{Opcode: OpBinary, Data: []byte{1, 2}}},
+		{Type: EventClose, Close: &CloseError{Code: CloseNormalClosure}},
+	}
+	for i, w := range want {
+		ev, err := c.ReadEvent()
+		if err != nil {
+			t.Fatalf("ReadEvent() %d error: %v", i, err)
+		}
+		if ev.Type != w.Type || ev.Message.Opcode != w.Message.Opcode ||
+			!bytes.Equal(ev.Message.Data, w.Message.Data) || !bytes.Equal(ev.Payload, w.Payload) {
+			t.Errorf("ReadEvent() %d = %v %+v %q, want %v %+v %q", i, ev.Type, ev.Message, ev.Payload, w.Type, w.Message, w.Payload)
+		}
+		if (ev.Close == nil) != (w.Close == nil) || ev.Close != nil && ev.Close.Code != w.Close.Code {
+			t.Errorf("ReadEvent() %d close = %v, want %v", i, ev.Close, w.Close)
+		}
+	}
+
+	if f := <-replies; f.Opcode != OpPong || string(f.Payload) != "ping" {
+		t.Errorf("Reply = %#x %q, want pong %q", f.Opcode, f.Payload, "ping")
+	}
+	if f := <-replies; f.Opcode != OpClose {
+		t.Errorf("Reply = %#x, want the close echoed", f.Opcode)
+	}
+
+	var closeErr *CloseError
+	if _, err := c.ReadEvent(); !errors.As(err, &closeErr) {
+		t.Errorf("ReadEvent() after close error = %v, want *CloseError", err)
+	}
+}
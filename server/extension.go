@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Extension is a WebSocket extension (RFC 6455 section 9) negotiated during
+// the handshake that transforms whole message payloads.
+type Extension interface {
+	// Name is the extension token used in Sec-WebSocket-Extensions.
+	Name() string
+	// Negotiate is called with the trimmed parameters of a client offer
+	// for Name. It returns the extension's entry for the response header
+	// and whether the offer is accepted.
+	Negotiate(params []string) (string, bool)
+	// Encode transforms an outbound message in place.
+	Encode(c *Conn, m *ExtensionMessage) error
+	// Decode reverses Encode for an inbound message in place.
+	Decode(c *Conn, m *ExtensionMessage) error
+}
+
+// ExtensionMessage is a complete message as seen by an Extension, together
+// with the RSV1 bit of its first frame.
+type ExtensionMessage struct {
+	Opcode  byte
+	Rsv1    bool
+	Payload []byte
+}
+
+// negotiateExtensions selects, in order, the extensions from available that
+// the client offered and accepted. It returns them together with the
+// Sec-WebSocket-Extensions response value listing them in the same order.
+func negotiateExtensions(r *http.Request, available []Extension) ([]Extension, string) {
+	offers := parseExtensionOffers(r.Header)
+
+	var accepted []Extension
+	var response []string
+	for _, ext := range available {
+		for _, offer := range offers {
+			if offer[0] != ext.Name() {
+				continue
+			}
+			if value, ok := ext.Negotiate(offer[1:]); ok {
+				accepted = append(accepted, ext)
+				response = append(response, value)
+				break
+			}
+		}
+	}
+	return accepted, strings.Join(response, ", ")
+}
+
+// parseExtensionOffers splits every Sec-WebSocket-Extensions header value
+// into offers, each being the extension name followed by its parameters.
+func parseExtensionOffers(h http.Header) [][]string {
+	var offers [][]string
+	for _, value := range h.Values("Sec-WebSocket-Extensions") {
+		for _, offer := range strings.Split(value, ",") {
+			params := strings.Split(offer, ";")
+			for i := range params {
+				params[i] = strings.TrimSpace(params[i])
+			}
+			if params[0] != "" {
+				offers = append(offers, params)
+			}
+		}
+	}
+	return offers
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// reverseExtension is a test extension that reverses payload bytes.
+type reverseExtension struct{}
+
+func (reverseExtension) Name() string { return "x-reverse" }
+
+func (reverseExtension) Negotiate(params []string) (string, bool) { return "x-reverse", true }
+
+func (reverseExtension) Encode(c *Conn, m *ExtensionMessage) error {
+	m.Payload = reversed(m.Payload)
+	return nil
+}
+
+func (reverseExtension) Decode(c *Conn, m *ExtensionMessage) error {
+	m.Payload = reversed(m.Payload)
+	return nil
+}
+
+func reversed(b []byte) []byte {
+	out := slices.Clone(b)
+	slices.Reverse(out)
+	return out
+}
+
+func TestNegotiateExtensionsOrder(t *testing.T) {
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Add("Sec-WebSocket-Extensions", "x-reverse, x-unknown")
+	req.Header.Add("Sec-WebSocket-Extensions", "permessage-deflate; client_max_window_bits")
+
+	u := NewUpgrader()
+	u.EnableCompression = true
+	u.Extensions = append(u.Extensions, reverseExtension{})
+	exts, value := negotiateExtensions(req, u.extensions(req))
+	if len(exts) != 2 || exts[0].Name() != "permessage-deflate" || exts[1].Name() != "x-reverse" {
+		t.Fatalf("Negotiated %v, want [permessage-deflate x-reverse]", exts)
+	}
+	want := "permessage-deflate; server_no_context_takeover; client_no_context_takeover, x-reverse"
+	if value != want {
+		t.Errorf("Response header = %q, want %q", value, want)
+	}
+
+	// Extensions belong to the Upgrader; another one is unaffected.
+	other := NewUpgrader()
+	other.EnableCompression = true
+	if exts, _ := negotiateExtensions(req, other.extensions(req)); len(exts) != 1 || exts[0].Name() != "permessage-deflate" {
+		t.Errorf("Other Upgrader negotiated %v, want [permessage-deflate]", exts)
+	}
+}
+
+func TestExtensionPipelineOrder(t *testing.T) {
+	c, peer := newTestConn(t)
+	c.setExtensions([]Extension{deflateExtension{}, reverseExtension{}})
+
+	data := []byte(strings.Repeat("pipeline order matters ", 30))
+
+	// Outbound: compress first, then reverse the compressed bytes.
+	go c.WriteMessage(OpText, data)
+	f, _, err := readFrame(peer.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if !f.Rsv1 {
+		t.Fatal("Frame sent without RSV1")
+	}
+	inflated, err := decompressMessage(reversed(f.Payload), 0)
+	if err != nil {
+		t.Fatal("Outbound payload is not reverse(deflate(data)):", err)
+	}
+	if !bytes.Equal(inflated, data) {
+		t.Error("Outbound payload does not decode to the original")
+	}
+
+	// Inbound: undo the reverse first, then inflate.
+	compressed, err := compressMessage(data)
+	if err != nil {
+		t.Fatal("compressMessage() error:", err)
+	}
+	go func() {
+		writeFrame(peer.Writer, Frame{Fin: true, Rsv1: true, Opcode: OpText, Payload: reversed(compressed), Masked: true})
+		peer.Flush()
+	}()
+	msg, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal("ReadMessage() error:", err)
+	}
+	if !bytes.Equal(msg.Data, data) {
+		t.Error("Inbound message does not decode to the original")
+	}
+}
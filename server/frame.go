@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Opcodes defined by RFC 6455 section 5.2.
+const (
+	OpContinuation byte = 0x0
+	OpText         byte = 0x1
+	OpBinary       byte = 0x2
+	OpClose        byte = 0x8
+	OpPing         byte = 0x9
+	OpPong         byte = 0xA
+)
+
+// maxControlPayload is the largest payload a control frame may carry.
+const maxControlPayload = 125
+
+// Frame is a single WebSocket frame as it appears on the wire.
+type Frame struct {
+	Fin     bool
+	Rsv1    bool
+	Opcode  byte
+	Masked  bool
+	MaskKey [4]byte
+	Payload []byte
+
+	// buf is the pooled buffer backing Payload, if it came from a
+	// BufferPool.
+	buf *[]byte
+}
+
+func isControl(opcode byte) bool {
+	return opcode&0x8 != 0
+}
+
+// ParseFrameHeader parses the frame header at the start of b without
+// consuming a reader, which is convenient for fuzzing and for inspecting
+// captured traffic. headerLen is the number of bytes the header occupies,
+// including the extended length and the mask key, so the payload starts at
+// b[headerLen]. Only the header's structure is checked; reserved bits and
+// control frame limits are left to the caller.
+func ParseFrameHeader(b []byte) (opcode byte, fin, masked bool, payloadLen uint64, headerLen int, err error) {
+	if len(b) < 2 {
+		return 0, false, false, 0, 0, fmt.Errorf("Frame header truncated")
+	}
+	fin = b[0]&0x80 != 0
+	opcode = b[0] & 0x0F
+	masked = b[1]&0x80 != 0
+	payloadLen = uint64(b[1] & 0x7F)
+	headerLen = 2
+
+	switch payloadLen {
+	case 126:
+		headerLen += 2
+	case 127:
+		headerLen += 8
+	}
+	if masked {
+		headerLen += 4
+	}
+	if len(b) < headerLen {
+		return 0, false, false, 0, 0, fmt.Errorf("Frame header truncated")
+	}
+
+	switch payloadLen {
+	case 126:
+		payloadLen = uint64(binary.BigEndian.Uint16(b[2:]))
+	case 127:
+		payloadLen = binary.BigEndian.Uint64(b[2:])
+	}
+	return opcode, fin, masked, payloadLen, headerLen, nil
+}
+
+// readFrame reads one frame from r, unmasking the payload if needed. It
+// returns the frame and the number of bytes it occupied on the wire.
+func readFrame(r *bufio.Reader) (Frame, int, error) {
+	return readFramePooled(r, nil, 0, false)
+}
+
+// errFrameTooLarge is returned by readFramePooled when a frame declares a
+// payload longer than allowed.
+var errFrameTooLarge = errors.New("Frame payload too large")
+
+// readFramePooled is readFrame with the payload taken from pool. The caller
+// owns the payload and may hand it back with putBuffer(pool, f.buf) once
+// done with it.
+// A frame declaring more than maxPayload bytes fails with errFrameTooLarge
+// before anything is allocated for it; zero means no limit. lenientControl
+// lifts the 125-byte limit on control frame payloads.
+func readFramePooled(r *bufio.Reader, pool BufferPool, maxPayload int64, lenientControl bool) (Frame, int, error) {
+	var f Frame
+	var scratch [8]byte
+	header := scratch[:2]
+	if _, err := io.ReadFull(r, header); err != nil {
+		return f, 0, err
+	}
+	n := 2
+
+	f.Fin = header[0]&0x80 != 0
+	f.Opcode = header[0] & 0x0F
+	f.Masked = header[1]&0x80 != 0
+	payloadLen := uint64(header[1] & 0x7F)
+
+	// RSV1 is used by permessage-deflate and validated by the caller; the
+	// other reserved bits have no negotiated meaning.
+	f.Rsv1 = header[0]&0x40 != 0
+	if header[0]&0x30 != 0 {
+		return f, n, fmt.Errorf("Reserved bits set without a negotiated extension")
+	}
+
+	switch payloadLen {
+	case 126:
+		ext := scratch[:2]
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return f, n, err
+		}
+		n += 2
+		payloadLen = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := scratch[:8]
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return f, n, err
+		}
+		n += 8
+		payloadLen = binary.BigEndian.Uint64(ext)
+		if payloadLen>>63 != 0 {
+			return f, n, fmt.Errorf("Frame length has the most significant bit set")
+		}
+	}
+	if maxPayload > 0 && payloadLen > uint64(maxPayload) {
+		return f, n, errFrameTooLarge
+	}
+
+	if isControl(f.Opcode) && payloadLen > maxControlPayload && !lenientControl {
+		return f, n, fmt.Errorf("Control frame payload too long")
+	}
+
+	if f.Masked {
+		if _, err := io.ReadFull(r, f.MaskKey[:]); err != nil {
+			return f, n, err
+		}
+		n += 4
+	}
+
+	payload, buf, err := readPayload(r, pool, payloadLen)
+	if err != nil {
+		return f, n, err
+	}
+	f.Payload, f.buf = payload, buf
+	n += len(f.Payload)
+
+	if f.Masked {
+		maskBytes(f.MaskKey, f.Payload)
+	}
+	return f, n, nil
+}
+
+// payloadChunk is the largest payload allocated up front. Longer payloads
+// are read in growing chunks, so a frame declaring a huge length with
+// nothing behind it fails before much memory is allocated.
+const payloadChunk = 64 << 10
+
+// readPayload reads an n-byte frame payload from r, borrowing the buffer
+// from pool when it is allocated up front. buf is the pooled buffer, or nil.
+func readPayload(r io.Reader, pool BufferPool, n uint64) (payload []byte, buf *[]byte, err error) {
+	if n <= payloadChunk {
+		payload, buf := getBuffer(pool, int(n))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			putBuffer(pool, buf)
+			return nil, nil, err
+		}
+		return payload, buf, nil
+	}
+	if n > math.MaxInt {
+		return nil, nil, errFrameTooLarge
+	}
+	payload, err = io.ReadAll(io.LimitReader(r, int64(n)))
+	if err != nil {
+		return nil, nil, err
+	}
+	if uint64(len(payload)) < n {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return payload, nil, nil
+}
+
+// writeFrame writes f to w without flushing. Client frames must be masked;
+// server frames must not. A masked frame gets a fresh random mask key. It
+// returns the number of bytes written.
+func writeFrame(w *bufio.Writer, f Frame) (int, error) {
+	return writeFramePooled(w, f, nil)
+}
+
+// writeFramePooled is writeFrame with the encoded frame assembled in a
+// buffer borrowed from pool.
+func writeFramePooled(w *bufio.Writer, f Frame, pool BufferPool) (int, error) {
+	b0 := f.Opcode
+	if f.Fin {
+		b0 |= 0x80
+	}
+	if f.Rsv1 {
+		b0 |= 0x40
+	}
+	scratch, buf := getBuffer(pool, FrameLen(len(f.Payload), f.Masked))
+	defer putBuffer(pool, buf)
+	frame := append(scratch[:0], b0)
+
+	var b1 byte
+	if f.Masked {
+		b1 = 0x80
+	}
+	payload := f.Payload
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, b1|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, b1|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, b1|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if f.Masked {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return 0, err
+		}
+		frame = append(frame, key[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		maskBytes(key, frame[start:])
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	return w.Write(frame)
+}
+
+// FrameLen returns the number of bytes a frame with a payloadLen-byte
+// payload occupies on the wire: the two fixed header bytes, the extended
+// length if any, the mask key if masked, and the payload itself. It lets
+// callers size a buffer for an encoded frame up front.
+func FrameLen(payloadLen int, masked bool) int {
+	n := 2 + payloadLen
+	switch {
+	case payloadLen > 0xFFFF:
+		n += 8
+	case payloadLen > 125:
+		n += 2
+	}
+	if masked {
+		n += 4
+	}
+	return n
+}
+
+// maskBytes XORs b in place with key as described in RFC 6455 section 5.3.
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+func benchmarkWriteFrame(b *testing.B, pool BufferPool) {
+	w := bufio.NewWriter(io.Discard)
+	f := Frame{Fin: true, Opcode: OpBinary, Payload: make([]byte, 4096)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := writeFramePooled(w, f, pool); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteFrame(b *testing.B) { benchmarkWriteFrame(b, nil) }
+
+func BenchmarkWriteFramePooled(b *testing.B) { benchmarkWriteFrame(b, NewBufferPool()) }
+
+func benchmarkReadFrame(b *testing.B, pool BufferPool) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writeFrame(w, Frame{Fin: true, Opcode: OpBinary, Payload: make([]byte, 4096), Masked: true})
+	w.Flush()
+	wire := buf.Bytes()
+
+	r := bytes.NewReader(wire)
+	br := bufio.NewReader(r)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(wire)
+		br.Reset(r)
+		f, _, err := readFramePooled(br, pool, 0, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		putBuffer(pool, f.buf)
+	}
+}
+
+func BenchmarkReadFrame(b *testing.B) { benchmarkReadFrame(b, nil) }
+
+func BenchmarkReadFramePooled(b *testing.B) { benchmarkReadFrame(b, NewBufferPool()) }
+
+func TestConnBufferPool(t *testing.T) {
+	c, peer := newTestConn(t)
+	c.BufferPool = NewBufferPool()
+
+	go func() {
+		writeClientFrame(t, peer, false, OpText, []byte("he"))
+		writeClientFrame(t, peer, true, OpPing, []byte("p"))
+		writeClientFrame(t, peer, true, OpContinuation, []byte("llo"))
+	}()
+	pong := make(chan Frame, 1)
+	go func() {
+		f, _, _ := readFrame(peer.Reader)
+		pong <- f
+	}()
+
+	msg, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal("ReadMessage() error:", err)
+	}
+	if string(msg.Data) != "hello" {
+		t.Errorf("ReadMessage() = %q, want %q", msg.Data, "hello")
+	}
+	if f := <-pong; f.Opcode != OpPong || string(f.Payload) != "p" {
+		t.Errorf("Got frame %#x %q, want pong %q", f.Opcode, f.Payload, "p")
+	}
+}
+
+func TestEmptyFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		masked  bool
+		wireLen int
+	}{
+		{"Unmasked", false, 2},
+		{"Masked", true, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := bufio.NewWriter(&buf)
+			n, err := writeFrame(w, Frame{Fin: true, Opcode: OpText, Masked: tt.masked})
+			if err != nil {
+				t.Fatal("writeFrame() error:", err)
+			}
+			w.Flush()
+			if n != tt.wireLen || buf.Len() != tt.wireLen {
+				t.Errorf("writeFrame() wrote %d bytes (%d buffered), want %d", n, buf.Len(), tt.wireLen)
+			}
+
+			f, n, err := readFrame(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatal("readFrame() error:", err)
+			}
+			if n != tt.wireLen || f.Masked != tt.masked || len(f.Payload) != 0 {
+				t.Errorf("readFrame() = masked %v, %d payload bytes, %d wire bytes", f.Masked, len(f.Payload), n)
+			}
+		})
+	}
+}
+
+func TestReadEmptyMaskedFrame(t *testing.T) {
+	// A masked text frame with a mask key and no payload bytes.
+	input := []byte{0x81, 0x80, 0x12, 0x34, 0x56, 0x78}
+	f, n, err := readFrame(bufio.NewReader(bytes.NewReader(input)))
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if n != len(input) || !f.Masked || len(f.Payload) != 0 {
+		t.Errorf("readFrame() = masked %v, %d payload bytes, %d wire bytes", f.Masked, len(f.Payload), n)
+	}
+	if f.MaskKey != [4]byte{0x12, 0x34, 0x56, 0x78} {
+		t.Errorf("MaskKey = %v", f.MaskKey)
+	}
+}
+
+func TestParseFrameHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      []byte
+		opcode     byte
+		fin        bool
+		masked     bool
+		payloadLen uint64
+		headerLen  int
+	}{
+		{"7-bit unmasked", []byte{0x81, 0x05, 'H', 'e'}, OpText, true, false, 5, 2},
+		{"7-bit masked", []byte{0x82, 0x85, 1, 2, 3, 4}, OpBinary, true, true, 5, 6},
+		{"16-bit unmasked", []byte{0x01, 0x7E, 0x01, 0x00}, OpText, false, false, 256, 4},
+		{"16-bit masked", []byte{0x82, 0xFE, 0xFF, 0xFF, 1, 2, 3, 4}, OpBinary, true, true, 65535, 8},
+		{"64-bit unmasked", []byte{0x80, 0x7F, 0, 0, 0, 0, 0, 0x01, 0x00, 0x00}, OpContinuation, true, false, 65536, 10},
+		{"64-bit masked", []byte{0x82, 0xFF, 0, 0, 0, 1, 0, 0, 0, 0, 1, 2, 3, 4}, OpBinary, true, true, 1 << 32, 14},
+		{"Control", []byte{0x89, 0x80, 1, 2, 3, 4}, OpPing, true, true, 0, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opcode, fin, masked, payloadLen, headerLen, err := ParseFrameHeader(tt.input)
+			if err != nil {
+				t.Fatal("ParseFrameHeader() error:", err)
+			}
+			if opcode != tt.opcode || fin != tt.fin || masked != tt.masked {
+				t.Errorf("opcode, fin, masked = %#x, %v, %v, want %#x, %v, %v",
+					opcode, fin, masked, tt.opcode, tt.fin, tt.masked)
+			}
+			if payloadLen != tt.payloadLen || headerLen != tt.headerLen {
+				t.Errorf("payloadLen, headerLen = %d, %d, want %d, %d",
+					payloadLen, headerLen, tt.payloadLen, tt.headerLen)
+			}
+		})
+	}
+}
+
+func TestParseFrameHeaderTruncated(t *testing.T) {
+	for _, input := range [][]byte{
+		nil,
+		{0x81},
+		{0x81, 0x7E, 0x01},
+		{0x81, 0x7F, 0, 0, 0, 0, 0, 0, 0},
+		{0x81, 0x85, 1, 2, 3},
+	} {
+		if _, _, _, _, _, err := ParseFrameHeader(input); err == nil {
+			t.Errorf("ParseFrameHeader(%v) succeeded on a truncated header", input)
+		}
+	}
+}
+
+func TestFrameLen(t *testing.T) {
+	tests := []struct {
+		payloadLen int
+		masked     bool
+		want       int
+	}{
+		{0, false, 2},
+		{0, true, 6},
+		{125, false, 127},
+		{125, true, 131},
+		{126, false, 130},
+		{126, true, 134},
+		{0xFFFF, false, 0xFFFF + 4},
+		{0xFFFF, true, 0xFFFF + 8},
+		{0x10000, false, 0x10000 + 10},
+		{0x10000, true, 0x10000 + 14},
+	}
+	for _, tt := range tests {
+		got := FrameLen(tt.payloadLen, tt.masked)
+		if got != tt.want {
+			t.Errorf("FrameLen(%d, %v) = %d, want %d", tt.payloadLen, tt.masked, got, tt.want)
+		}
+
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		n, err := writeFrame(w, Frame{Fin: true, Opcode: OpBinary, Masked: tt.masked, Payload: make([]byte, tt.payloadLen)})
+		if err != nil {
+			t.Fatal("writeFrame() error:", err)
+		}
+		if n != got {
+			t.Errorf("writeFrame() wrote %d bytes for payload %d, FrameLen = %d", n, tt.payloadLen, got)
+		}
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	// Seeds from the client's TestReadTextMessage cases, plus frames with
+	// extended lengths.
+	for _, seed := range [][]byte{
+		{0x81, 0x05, 'H', 'e', 'l', 'l', 'o'},
+		{0x00, 0x05, 'H', 'e', 'l', 'l', 'o'},
+		{0x82, 0x05, 'H', 'e', 'l', 'l', 'o'},
+		{0x81, 0x80, 0x00, 0x00, 0x00, 0x00},
+		{0x81, 0x00},
+		{0x81, 0x7E, 0x00, 0x7E},
+		{0x82, 0x7F, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xAB, 0xCD},
+		{0x89, 0x85, 0x01, 0x02, 0x03, 0x04, 'p', 'i', 'n', 'g', '!'},
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frame, n, err := readFrame(bufio.NewReader(bytes.NewReader(data)))
+		if n > len(data) {
+			t.Fatalf("readFrame() consumed %d bytes of %d", n, len(data))
+		}
+		if err != nil {
+			return
+		}
+		_, _, _, payloadLen, headerLen, err := ParseFrameHeader(data)
+		if err != nil {
+			t.Fatalf("readFrame() accepted a header ParseFrameHeader rejects: %v", err)
+		}
+		if uint64(len(frame.Payload)) != payloadLen || headerLen+len(frame.Payload) != n {
+			t.Fatalf("readFrame() payload %d bytes, n %d; header says %d + %d", len(frame.Payload), n, headerLen, payloadLen)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// WriteGzip gzips b and sends it as a binary message. This compresses the
+// application payload itself and is unrelated to permessage-deflate; the
+// peer must gunzip it, for example with ReadGzip.
+func (c *Conn) WriteGzip(b []byte) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return c.WriteMessage(OpBinary, buf.Bytes())
+}
+
+// ReadGzip reads the next message, which must be binary, and returns its
+// gunzipped contents. A payload that is not valid gzip is an error that
+// leaves the connection open. Decompressing more than MaxMessageSize bytes
+// closes the connection with 1009 like an oversized message, so a small
+// gzip bomb cannot exhaust memory.
+func (c *Conn) ReadGzip() ([]byte, error) {
+	msg, err := c.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if msg.Opcode != OpBinary {
+		return nil, fmt.Errorf("Gzip payload in a non-binary message")
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(msg.Data))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid gzip payload: %w", err)
+	}
+	var r io.Reader = zr
+	if c.MaxMessageSize > 0 {
+		r = io.LimitReader(zr, c.MaxMessageSize+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid gzip payload: %w", err)
+	}
+	if c.MaxMessageSize > 0 && int64(len(data)) > c.MaxMessageSize {
+		return nil, c.failTooLarge()
+	}
+	return data, nil
+}
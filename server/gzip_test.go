@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestConnGzipRoundTrip(t *testing.T) {
+	c, peer := newTestConn(t)
+	data := []byte(strings.Repeat("gzip me please ", 100))
+
+	go c.WriteGzip(data)
+	f, _, err := readFrame(peer.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if f.Opcode != OpBinary || len(f.Payload) >= len(data) {
+		t.Fatalf("Got opcode %#x with %d bytes, want a compressed binary message", f.Opcode, len(f.Payload))
+	}
+
+	go writeClientFrame(t, peer, true, OpBinary, f.Payload)
+	got, err := c.ReadGzip()
+	if err != nil {
+		t.Fatal("ReadGzip() error:", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("ReadGzip() does not match the original")
+	}
+}
+
+func TestConnReadGzipCorrupt(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(strings.Repeat("payload ", 50)))
+	zw.Close()
+	corrupt := bytes.Clone(buf.Bytes())
+	corrupt[len(corrupt)/2] ^= 0xff
+
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"Not gzip", []byte("plain bytes")},
+		{"Corrupted body", corrupt},
+		{"Truncated", buf.Bytes()[:buf.Len()-4]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, peer := newTestConn(t)
+			go writeClientFrame(t, peer, true, OpBinary, tt.payload)
+			if _, err := c.ReadGzip(); err == nil {
+				t.Error("ReadGzip() accepted a corrupt payload")
+			}
+			if got := c.State(); got != StateOpen {
+				t.Errorf("State() = %v, want %v", got, StateOpen)
+			}
+		})
+	}
+}
+
+func TestConnReadGzipLimit(t *testing.T) {
+	c, peer := newTestConn(t)
+	c.MaxMessageSize = 1 << 10
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(make([]byte, 1<<20))
+	zw.Close()
+
+	go func() {
+		writeClientFrame(t, peer, true, OpBinary, buf.Bytes())
+		readFrame(peer.Reader)
+	}()
+	if _, err := c.ReadGzip(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("ReadGzip() error = %v, want ErrMessageTooLarge", err)
+	}
+}
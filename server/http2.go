@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// isExtendedConnect reports whether r is an RFC 8441 WebSocket handshake.
+func isExtendedConnect(r *http.Request) bool {
+	return r.ProtoMajor == 2 &&
+		r.Method == http.MethodConnect &&
+		r.Header.Get(":protocol") == "websocket"
+}
+
+// upgradeHTTP2 completes an extended CONNECT handshake validate has
+// checked. There is no Sec-WebSocket-Key exchange over HTTP/2; a 200
+// response accepts the stream.
+func (u *Upgrader) upgradeHTTP2(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	exts, extensions := negotiateExtensions(r, u.extensions(r))
+	if extensions != "" {
+		w.Header().Set("Sec-WebSocket-Extensions", extensions)
+	}
+	subprotocol := u.selectSubprotocol(r)
+	if subprotocol != "" {
+		w.Header().Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		return nil, fmt.Errorf("Could not flush HTTP/2 response: %w", err)
+	}
+
+	sc := &streamConn{body: r.Body, w: w, rc: rc, remote: r.RemoteAddr}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		sc.local = addr
+	}
+	rw := bufio.NewReadWriter(bufio.NewReader(sc), bufio.NewWriter(sc))
+	c := newConn(sc, rw, r)
+	c.setExtensions(exts)
+	c.subprotocol = subprotocol
+	return c, nil
+}
+
+// streamConn adapts an HTTP/2 request body and response writer to net.Conn
+// so the regular frame reader and writer can run over the stream. The
+// stream ends when the handler returns.
+type streamConn struct {
+	body      io.ReadCloser
+	w         io.Writer
+	rc        *http.ResponseController
+	local     net.Addr
+	remote    string
+	closeOnce sync.Once
+}
+
+func (sc *streamConn) Read(p []byte) (int, error) {
+	return sc.body.Read(p)
+}
+
+func (sc *streamConn) Write(p []byte) (int, error) {
+	n, err := sc.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, sc.rc.Flush()
+}
+
+func (sc *streamConn) Close() error {
+	var err error
+	sc.closeOnce.Do(func() {
+		err = sc.body.Close()
+	})
+	return err
+}
+
+func (sc *streamConn) LocalAddr() net.Addr {
+	return sc.local
+}
+
+func (sc *streamConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", sc.remote)
+	return addr
+}
+
+func (sc *streamConn) SetDeadline(t time.Time) error {
+	if err := sc.rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return sc.rc.SetWriteDeadline(t)
+}
+
+func (sc *streamConn) SetReadDeadline(t time.Time) error {
+	return sc.rc.SetReadDeadline(t)
+}
+
+func (sc *streamConn) SetWriteDeadline(t time.Time) error {
+	return sc.rc.SetWriteDeadline(t)
+}
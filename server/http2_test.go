@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestHTTP2ExtendedConnect(t *testing.T) {
+	// The HTTP/2 server reads GODEBUG once at startup, so run the test in
+	// a child process with extended CONNECT enabled.
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHTTP2ExtendedConnect$", "-test.v")
+		cmd.Env = append(os.Environ(), "GODEBUG=http2xconnect=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Child test failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	u := NewUpgrader()
+	u.EnableHTTP2 = true
+
+	srv := httptest.NewUnstartedServer(u.Handler(func(c *Conn) error {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage() error = %v", err)
+			return err
+		}
+		return c.WriteMessage(msg.Opcode, append([]byte("echo: "), msg.Data...))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{
+		RootCAs:    srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs,
+		NextProtos: []string{"h2"},
+	})
+	if err != nil {
+		t.Fatal("TLS dial error:", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	conn.Write([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"))
+	writeH2Frame(conn, h2Settings, 0, 0, nil)
+
+	var headers []byte
+	for _, hf := range [][2]string{
+		{":method", "CONNECT"},
+		{":protocol", "websocket"},
+		{":scheme", "https"},
+		{":path", "/ws"},
+		{":authority", srv.Listener.Addr().String()},
+		{"origin", "http://localhost:8080"},
+		{"sec-websocket-version", "13"},
+	} {
+		headers = appendHpackLiteral(headers, hf[0], hf[1])
+	}
+	writeH2Frame(conn, h2Headers, h2FlagEndHeaders, 1, headers)
+
+	var wsFrame bytes.Buffer
+	bw := bufio.NewWriter(&wsFrame)
+	writeFrame(bw, Frame{Fin: true, Opcode: OpText, Payload: []byte("over h2"), Masked: true})
+	bw.Flush()
+	writeH2Frame(conn, h2Data, 0, 1, wsFrame.Bytes())
+
+	var data []byte
+	for {
+		typ, flags, stream, payload, err := readH2Frame(br)
+		if err != nil {
+			t.Fatal("HTTP/2 read error:", err)
+		}
+		switch {
+		case typ == h2Settings && flags&h2FlagAck == 0:
+			writeH2Frame(conn, h2Settings, h2FlagAck, 0, nil)
+		case typ == h2Headers && stream == 1:
+			// 0x88 is the HPACK static table entry for ":status: 200".
+			if len(payload) == 0 || payload[0] != 0x88 {
+				t.Fatalf("Response headers %x, want :status 200", payload)
+			}
+		case typ == h2Data && stream == 1:
+			data = append(data, payload...)
+			f, _, err := readFrame(bufio.NewReader(bytes.NewReader(data)))
+			if err != nil {
+				continue
+			}
+			if got, want := string(f.Payload), "echo: over h2"; got != want {
+				t.Errorf("Payload = %q, want %q", got, want)
+			}
+			return
+		case typ == h2RSTStream || typ == h2GoAway:
+			t.Fatalf("Server aborted the stream with frame type %d", typ)
+		}
+	}
+}
+
+// HTTP/2 frame types and flags used by the minimal client in
+// TestHTTP2ExtendedConnect. net/http's client refuses to send the
+// ":protocol" pseudo-header, so the test speaks the framing directly.
+const (
+	h2Data      = 0x0
+	h2Headers   = 0x1
+	h2RSTStream = 0x3
+	h2Settings  = 0x4
+	h2GoAway    = 0x7
+
+	h2FlagAck        = 0x1
+	h2FlagEndHeaders = 0x4
+)
+
+func writeH2Frame(w io.Writer, typ, flags byte, stream uint32, payload []byte) error {
+	header := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ, flags}
+	header = binary.BigEndian.AppendUint32(header, stream)
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+func readH2Frame(r io.Reader) (typ, flags byte, stream uint32, payload []byte, err error) {
+	header := make([]byte, 9)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+	typ, flags = header[3], header[4]
+	stream = binary.BigEndian.Uint32(header[5:]) & 0x7fffffff
+	payload = make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	return
+}
+
+// appendHpackLiteral encodes a header as an HPACK literal without indexing
+// and without Huffman coding. Names and values must be under 127 bytes.
+func appendHpackLiteral(b []byte, name, value string) []byte {
+	b = append(b, 0x00, byte(len(name)))
+	b = append(b, name...)
+	b = append(b, byte(len(value)))
+	return append(b, value...)
+}
+
+func TestHTTP2ExtendedConnectDisabled(t *testing.T) {
+	req := httptest.NewRequest(http.MethodConnect, "/ws", nil)
+	req.ProtoMajor = 2
+	req.Header.Set(":protocol", "websocket")
+	req.Header.Set("Origin", "http://localhost:8080")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	rr := httptest.NewRecorder()
+	wsHandler(rr, req)
+
+	// Without HTTP/2 support a CONNECT is just a non-GET handshake.
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Status = %d, want %d", rr.Code, http.StatusMethodNotAllowed)
+	}
+}
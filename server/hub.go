@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Defaults for Hub.Workers and Hub.Timeout.
+const (
+	DefaultHubWorkers       = 64
+	DefaultBroadcastTimeout = 5 * time.Second
+)
+
+// Hub is a set of connections that messages can be broadcast to. It is
+// safe for concurrent use; connections may be added and removed while a
+// broadcast is running.
+type Hub struct {
+	// Workers bounds how many writes a Broadcast runs at once, and with
+	// it the goroutines and memory a broadcast to many clients can use.
+	// Timeout bounds a whole Broadcast. Zero selects DefaultHubWorkers and
+	// DefaultBroadcastTimeout.
+	Workers int
+	Timeout time.Duration
+
+	mu    sync.Mutex
+	conns map[*Conn]struct{}
+}
+
+// NewHub returns an empty Hub with the default settings.
+func NewHub() *Hub {
+	return &Hub{conns: map[*Conn]struct{}{}}
+}
+
+// Add adds c to the hub.
+func (h *Hub) Add(c *Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns == nil {
+		h.conns = map[*Conn]struct{}{}
+	}
+	h.conns[c] = struct{}{}
+}
+
+// Remove removes c from the hub. Removing a connection that is not in the
+// hub does nothing.
+func (h *Hub) Remove(c *Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.conns, c)
+}
+
+// Len returns the number of connections in the hub.
+func (h *Hub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.conns)
+}
+
+// snapshot returns the current connections, so that a broadcast does not
+// hold mu while writing.
+func (h *Hub) snapshot() []*Conn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	conns := make([]*Conn, 0, len(h.conns))
+	for c := range h.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// Broadcast sends a message to every connection in the hub, writing to up
+// to Workers of them concurrently so that one slow client does not hold up
+// the rest. A connection whose write fails, or has not completed when
+// Timeout runs out, is closed and removed from the hub. Connections still
+// waiting for a worker when Timeout runs out are not written to but stay in
+// the hub, since they were only late in the queue; they are reported as not
+// delivered. Broadcast returns once every write has finished or the timeout
+// has passed, with the failures joined into one error.
+func (h *Hub) Broadcast(opcode byte, data []byte) error {
+	workers := h.Workers
+	if workers <= 0 {
+		workers = DefaultHubWorkers
+	}
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultBroadcastTimeout
+	}
+
+	type result struct {
+		c   *Conn
+		err error
+	}
+	conns := h.snapshot()
+	results := make(chan result, len(conns))
+
+	// started records the connections a worker has picked up. Once
+	// stopped is set at the timeout, no further writes are started.
+	var mu sync.Mutex
+	started := make(map[*Conn]bool, len(conns))
+	stopped := false
+	stop := make(chan struct{})
+	go func() {
+		sem := make(chan struct{}, workers)
+		for _, c := range conns {
+			select {
+			case sem <- struct{}{}:
+			case <-stop:
+				return
+			}
+			mu.Lock()
+			if stopped {
+				mu.Unlock()
+				return
+			}
+			started[c] = true
+			mu.Unlock()
+			go func() {
+				err := c.WriteMessage(opcode, data)
+				<-sem
+				results <- result{c, err}
+			}()
+		}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	pending := make(map[*Conn]bool, len(conns))
+	for _, c := range conns {
+		pending[c] = true
+	}
+	var errs []error
+	for len(pending) > 0 {
+		select {
+		case r := <-results:
+			delete(pending, r.c)
+			if r.err != nil {
+				h.drop(r.c)
+				errs = append(errs, r.err)
+			}
+		case <-timer.C:
+			mu.Lock()
+			stopped = true
+			close(stop)
+			mu.Unlock()
+			// Closing unblocks the stuck writes, which frees their
+			// workers; the results they still send are buffered.
+			for c := range pending {
+				if !started[c] {
+					errs = append(errs, fmt.Errorf("Broadcast to %s not delivered before the timeout", c.conn.RemoteAddr()))
+					continue
+				}
+				h.drop(c)
+				errs = append(errs, fmt.Errorf("Broadcast to %s timed out", c.conn.RemoteAddr()))
+			}
+			return errors.Join(errs...)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// drop removes c from the hub and closes it.
+func (h *Hub) drop(c *Conn) {
+	h.Remove(c)
+	c.Close()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHubBroadcastSlowClient(t *testing.T) {
+	hub := NewHub()
+	hub.Timeout = 300 * time.Millisecond
+
+	// The slow client never reads, so writes to it block.
+	slow, _ := newTestConn(t)
+	hub.Add(slow)
+
+	start := time.Now()
+	received := make(chan time.Duration, 3)
+	for i := 0; i < 3; i++ {
+		c, peer := newTestConn(t)
+		hub.Add(c)
+		go func() {
+			f, _, err := readFrame(peer.Reader)
+			if err == nil && string(f.Payload) == "news" {
+				received <- time.Since(start)
+			}
+		}()
+	}
+
+	if err := hub.Broadcast(OpText, []byte("news")); err == nil {
+		t.Error("Broadcast() reported no error for the stuck client")
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case d := <-received:
+			if d >= hub.Timeout {
+				t.Errorf("Fast client got the message after %v, held up by the slow one", d)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Fast client never got the message")
+		}
+	}
+
+	if got := hub.Len(); got != 3 {
+		t.Errorf("Len() = %d after the broadcast, want 3", got)
+	}
+	if got := slow.State(); got != StateClosed {
+		t.Errorf("Slow client state = %v, want %v", got, StateClosed)
+	}
+}
+
+func TestHubConcurrentChanges(t *testing.T) {
+	hub := NewHub()
+	hub.Workers = 2
+
+	for i := 0; i < 8; i++ {
+		c, peer := newTestConn(t)
+		hub.Add(c)
+		go func() {
+			for {
+				if _, _, err := readFrame(peer.Reader); err != nil {
+					return
+				}
+			}
+		}()
+		// Membership changes while broadcasts are running.
+		go hub.Remove(c)
+		go hub.Broadcast(OpBinary, []byte{byte(i)})
+	}
+	if err := hub.Broadcast(OpText, []byte("last")); err != nil {
+		t.Error("Broadcast() error:", err)
+	}
+}
+
+func TestHubBroadcastTimeoutSkipsQueued(t *testing.T) {
+	hub := NewHub()
+	hub.Workers = 1
+	hub.Timeout = 100 * time.Millisecond
+
+	// Neither client reads. The single worker blocks on whichever comes
+	// first, so the other is still queued when the timeout runs out.
+	a, _ := newTestConn(t)
+	b, _ := newTestConn(t)
+	hub.Add(a)
+	hub.Add(b)
+
+	if err := hub.Broadcast(OpText, []byte("news")); err == nil {
+		t.Error("Broadcast() reported no error after the timeout")
+	}
+	if got := hub.Len(); got != 1 {
+		t.Errorf("Len() = %d after the broadcast, want 1", got)
+	}
+	closed := 0
+	for _, c := range []*Conn{a, b} {
+		if c.State() == StateClosed {
+			closed++
+		}
+	}
+	if closed != 1 {
+		t.Errorf("%d clients closed, want only the one being written to", closed)
+	}
+}
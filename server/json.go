@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// JSONMode selects how WriteJSONValues frames several JSON values.
+//
+// JSONPerMessage sends every value as its own text message, so the peer can
+// process each one as soon as it arrives, at the cost of a frame header
+// per value. JSONNewlineDelimited packs all values into a single text
+// message as newline-delimited JSON (NDJSON), which saves frames and
+// syscalls for bursts of small objects, but the peer only sees the batch
+// once the whole message has arrived.
+type JSONMode int
+
+const (
+	JSONPerMessage JSONMode = iota
+	JSONNewlineDelimited
+)
+
+// WriteJSON encodes v as JSON and sends it as a single text message.
+func (c *Conn) WriteJSON(v any) error {
+	return c.WriteJSONValues(JSONPerMessage, v)
+}
+
+// WriteJSONValues encodes values as JSON and sends them framed according to
+// mode.
+func (c *Conn) WriteJSONValues(mode JSONMode, values ...any) error {
+	switch mode {
+	case JSONPerMessage:
+		for _, v := range values {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if err := c.WriteMessage(OpText, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	case JSONNewlineDelimited:
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, v := range values {
+			// Encode terminates every value with a newline.
+			if err := enc.Encode(v); err != nil {
+				return err
+			}
+		}
+		return c.WriteMessage(OpText, buf.Bytes())
+	default:
+		return fmt.Errorf("Unknown JSON mode %d", mode)
+	}
+}
+
+// ReadJSON reads the next message and decodes it as a single JSON value
+// into v.
+func (c *Conn) ReadJSON(v any) error {
+	msg, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(msg.Data, v)
+}
+
+// ReadJSONValues reads the next message and returns every JSON value it
+// contains. It accepts both a single value and newline-delimited JSON, so
+// it pairs with either WriteJSONValues mode.
+func (c *Conn) ReadJSONValues() ([]json.RawMessage, error) {
+	msg, err := c.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	var values []json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(msg.Data))
+	for {
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			if errors.Is(err, io.EOF) {
+				return values, nil
+			}
+			return values, err
+		}
+		values = append(values, v)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type logEntry struct {
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+}
+
+var logEntries = []any{
+	logEntry{"info", "started"},
+	logEntry{"warn", "slow request"},
+	logEntry{"error", "line\nbreak"},
+}
+
+func TestWriteJSONValuesPerMessage(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	go c.WriteJSONValues(JSONPerMessage, logEntries...)
+
+	for i, want := range logEntries {
+		f, _, err := readFrame(peer.Reader)
+		if err != nil {
+			t.Fatal("readFrame() error:", err)
+		}
+		var got logEntry
+		if err := json.Unmarshal(f.Payload, &got); err != nil {
+			t.Fatalf("Message %d is not a single JSON value: %v", i, err)
+		}
+		if got != want {
+			t.Errorf("Message %d = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestWriteJSONValuesNewlineDelimited(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	go c.WriteJSONValues(JSONNewlineDelimited, logEntries...)
+
+	f, _, err := readFrame(peer.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(f.Payload), "\n"), "\n")
+	if len(lines) != len(logEntries) {
+		t.Fatalf("Got %d lines, want %d: %q", len(lines), len(logEntries), f.Payload)
+	}
+	for i, line := range lines {
+		var got logEntry
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("Line %d: %v", i, err)
+		}
+		if got != logEntries[i] {
+			t.Errorf("Line %d = %+v, want %+v", i, got, logEntries[i])
+		}
+	}
+}
+
+func TestReadJSONValuesBothModes(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	go func() {
+		writeClientFrame(t, peer, true, OpText, []byte(`{"level":"info","msg":"one"}`))
+		writeClientFrame(t, peer, true, OpText, []byte("{\"level\":\"info\",\"msg\":\"a\"}\n{\"level\":\"warn\",\"msg\":\"b\"}\n"))
+	}()
+
+	values, err := c.ReadJSONValues()
+	if err != nil || len(values) != 1 {
+		t.Fatalf("ReadJSONValues() = %d values, %v, want 1 value", len(values), err)
+	}
+
+	values, err = c.ReadJSONValues()
+	if err != nil {
+		t.Fatal("ReadJSONValues() error:", err)
+	}
+	var got []logEntry
+	for _, v := range values {
+		var e logEntry
+		if err := json.Unmarshal(v, &e); err != nil {
+			t.Fatal("Unmarshal error:", err)
+		}
+		got = append(got, e)
+	}
+	want := []logEntry{{"info", "a"}, {"warn", "b"}}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("ReadJSONValues() = %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteReadJSON(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	go writeClientFrame(t, peer, true, OpText, []byte(`{"level":"debug","msg":"hi"}`))
+	var got logEntry
+	if err := c.ReadJSON(&got); err != nil {
+		t.Fatal("ReadJSON() error:", err)
+	}
+	if want := (logEntry{"debug", "hi"}); got != want {
+		t.Errorf("ReadJSON() = %+v, want %+v", got, want)
+	}
+
+	go c.WriteJSON(logEntry{"info", "bye"})
+	f, _, err := readFrame(peer.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if string(f.Payload) != `{"level":"info","msg":"bye"}` {
+		t.Errorf("WriteJSON() payload = %s", f.Payload)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// AsNetConn returns a net.Conn that carries a byte stream over c, for
+// libraries that expect a plain connection. Each Write is sent as one
+// binary message; Read returns the bytes of incoming binary messages,
+// spreading a message over several Reads if the buffer is too small.
+// Deadlines apply to the underlying connection. A close frame from the
+// peer reads as io.EOF, and a text message is an error.
+func (c *Conn) AsNetConn() net.Conn {
+	return &netConn{c: c}
+}
+
+type netConn struct {
+	c *Conn
+
+	readMu  sync.Mutex
+	pending []byte
+}
+
+func (nc *netConn) Read(p []byte) (int, error) {
+	nc.readMu.Lock()
+	defer nc.readMu.Unlock()
+
+	for len(nc.pending) == 0 {
+		msg, err := nc.c.ReadMessage()
+		var closeErr *CloseError
+		if errors.As(err, &closeErr) || errors.Is(err, ErrClosed) {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if msg.Opcode != OpBinary {
+			return 0, fmt.Errorf("Unexpected text message on a byte stream")
+		}
+		nc.pending = msg.Data
+	}
+	n := copy(p, nc.pending)
+	nc.pending = nc.pending[n:]
+	return n, nil
+}
+
+func (nc *netConn) Write(p []byte) (int, error) {
+	if err := nc.c.WriteMessage(OpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close performs the closing handshake with 1000.
+func (nc *netConn) Close() error {
+	err := nc.c.CloseGracefully(CloseNormalClosure, "")
+	if errors.Is(err, ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (nc *netConn) LocalAddr() net.Addr  { return nc.c.conn.LocalAddr() }
+func (nc *netConn) RemoteAddr() net.Addr { return nc.c.conn.RemoteAddr() }
+
+func (nc *netConn) SetDeadline(t time.Time) error {
+	nc.c.SetReadDeadline(t)
+	return nc.c.conn.SetDeadline(t)
+}
+
+func (nc *netConn) SetReadDeadline(t time.Time) error  { return nc.c.SetReadDeadline(t) }
+func (nc *netConn) SetWriteDeadline(t time.Time) error { return nc.c.conn.SetWriteDeadline(t) }
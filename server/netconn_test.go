@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAsNetConnRequestResponse(t *testing.T) {
+	c, peer := newTestConn(t)
+	nc := c.AsNetConn()
+
+	// A line-based protocol running on top of the adapter: the server reads
+	// a request line and answers with it upper-cased.
+	go func() {
+		line, err := bufio.NewReader(nc).ReadString('\n')
+		if err != nil {
+			t.Errorf("ReadString() error = %v", err)
+			return
+		}
+		io.WriteString(nc, strings.ToUpper(line))
+	}()
+
+	// The request is split over two messages to exercise buffering.
+	writeClientFrame(t, peer, true, OpBinary, []byte("hello "))
+	writeClientFrame(t, peer, true, OpBinary, []byte("tunnel\n"))
+
+	f, _, err := readFrame(peer.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if f.Opcode != OpBinary || string(f.Payload) != "HELLO TUNNEL\n" {
+		t.Errorf("Got %#x %q, want binary %q", f.Opcode, f.Payload, "HELLO TUNNEL\n")
+	}
+}
+
+func TestAsNetConnShortReadsAndEOF(t *testing.T) {
+	c, peer := newTestConn(t)
+	nc := c.AsNetConn()
+
+	go func() {
+		writeClientFrame(t, peer, true, OpBinary, []byte("abcdef"))
+		writeClientFrame(t, peer, true, OpClose, []byte{0x03, 0xE8})
+		readFrame(peer.Reader)
+	}()
+
+	buf := make([]byte, 4)
+	var got []byte
+	for {
+		n, err := nc.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("Read() error:", err)
+		}
+	}
+	if string(got) != "abcdef" {
+		t.Errorf("Read %q, want %q", got, "abcdef")
+	}
+}
+
+func TestAsNetConnDeadline(t *testing.T) {
+	c, _ := newTestConn(t)
+	nc := c.AsNetConn()
+
+	nc.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := nc.Read(make([]byte, 1))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() error = %v, want deadline exceeded", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// OriginMatcher matches Origin header values against a set of patterns
+// compiled once up front. A pattern is scheme://host[:port] where the host
+// may start with "*." to match any subdomain and the port may be "*" to
+// match any port. Schemes must match exactly, and a missing port stands for
+// the scheme's default port.
+type OriginMatcher struct {
+	patterns []originPattern
+}
+
+type originPattern struct {
+	scheme string
+	host   string // lower case; "*.example.com" matches any subdomain
+	port   string // "*" matches any port
+}
+
+// NewOriginMatcher compiles patterns such as "https://*.example.com" or
+// "http://localhost:*".
+func NewOriginMatcher(patterns ...string) (*OriginMatcher, error) {
+	m := &OriginMatcher{}
+	for _, pattern := range patterns {
+		scheme, rest, ok := strings.Cut(pattern, "://")
+		if !ok || scheme == "" || rest == "" {
+			return nil, fmt.Errorf("Invalid origin pattern %q", pattern)
+		}
+		host, port := rest, ""
+		if h, p, err := net.SplitHostPort(rest); err == nil {
+			host, port = h, p
+		}
+		if port == "" {
+			port = defaultPort(scheme)
+		}
+		if strings.Contains(strings.TrimPrefix(host, "*."), "*") || strings.ContainsAny(host, "/?#") {
+			return nil, fmt.Errorf("Invalid origin pattern %q", pattern)
+		}
+		m.patterns = append(m.patterns, originPattern{
+			scheme: strings.ToLower(scheme),
+			host:   strings.ToLower(host),
+			port:   port,
+		})
+	}
+	return m, nil
+}
+
+// MustOriginMatcher is like NewOriginMatcher but panics if a pattern is
+// invalid. It simplifies initializing package-level matchers.
+func MustOriginMatcher(patterns ...string) *OriginMatcher {
+	m, err := NewOriginMatcher(patterns...)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Match reports whether origin matches any of the compiled patterns.
+func (m *OriginMatcher) Match(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = defaultPort(scheme)
+	}
+
+	for _, p := range m.patterns {
+		if p.scheme != scheme {
+			continue
+		}
+		if p.port != "*" && p.port != port {
+			continue
+		}
+		if suffix, ok := strings.CutPrefix(p.host, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if p.host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultPort returns the port implied by an origin scheme.
+func defaultPort(scheme string) string {
+	switch strings.ToLower(scheme) {
+	case "http", "ws":
+		return "80"
+	case "https", "wss":
+		return "443"
+	}
+	return ""
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestOriginMatcher(t *testing.T) {
+	m, err := NewOriginMatcher(
+		"https://*.example.com",
+		"http://localhost:*",
+		"https://app.test",
+		"http://exact.test:8080",
+	)
+	if err != nil {
+		t.Fatal("NewOriginMatcher() error:", err)
+	}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://api.example.com", true},
+		{"https://a.b.example.com", true},
+		{"https://example.com", false},
+		{"http://api.example.com", false},
+		{"https://api.example.com.evil.com", false},
+		{"https://evilexample.com", false},
+		{"http://localhost:3000", true},
+		{"http://localhost", true},
+		{"https://localhost:3000", false},
+		{"https://app.test", true},
+		{"https://app.test:443", true},
+		{"https://app.test:8443", false},
+		{"http://exact.test:8080", true},
+		{"http://exact.test", false},
+		{"HTTPS://API.EXAMPLE.COM", true},
+		{"", false},
+		{"null", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			if got := m.Match(tt.origin); got != tt.want {
+				t.Errorf("Match(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOriginMatcherInvalidPattern(t *testing.T) {
+	for _, pattern := range []string{"example.com", "https://", "https://api.*.example.com", "https://example.com/path"} {
+		if _, err := NewOriginMatcher(pattern); err == nil {
+			t.Errorf("NewOriginMatcher(%q) error = nil, want error", pattern)
+		}
+	}
+}
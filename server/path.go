@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// cleanPath normalizes an absolute request path: repeated slashes and "."
+// segments are collapsed, and a trailing slash is kept. ok is false for a
+// path containing a ".." segment, which has no business in a WebSocket
+// URL and could make a prefix check on the raw path disagree with the
+// handler that serves it.
+func cleanPath(p string) (cleaned string, ok bool) {
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return "", false
+		}
+	}
+	if p == "" || p[0] != '/' {
+		p = "/" + p
+	}
+	cleaned = path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned, true
+}
+
+// normalizePath cleans r.URL.Path in place, rejecting traversal attempts
+// with 400 Bad Request. Upgrade runs it before hijacking, so handlers and
+// Conn.Path see the cleaned path.
+func normalizePath(w http.ResponseWriter, r *http.Request) error {
+	cleaned, ok := cleanPath(r.URL.Path)
+	if !ok {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return fmt.Errorf("Path traversal in %q", r.URL.Path)
+	}
+	if cleaned != r.URL.Path {
+		r.URL.Path = cleaned
+		r.URL.RawPath = ""
+	}
+	return nil
+}
+
+// CleanPath returns a handler that normalizes the request path with
+// cleanPath before passing the request to h, and rejects paths containing
+// ".." with 400 Bad Request. Upgrade does the same on its own, but only
+// after the mux has routed the raw path; wrapping the ServeMux lets
+// routing and Request.PathValue see the cleaned path as well:
+//
+//	http.ListenAndServe(addr, CleanPath(mux))
+func CleanPath(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cleaned, ok := cleanPath(r.URL.Path)
+		if !ok {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if cleaned != r.URL.Path {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = cleaned
+			r2.URL.RawPath = ""
+			r = r2
+		}
+		h.ServeHTTP(w, r)
+	})
+}
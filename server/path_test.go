@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+		ok   bool
+	}{
+		{"/ws", "/ws", true},
+		{"/ws//acme", "/ws/acme", true},
+		{"//ws/./acme/", "/ws/acme/", true},
+		{"/", "/", true},
+		{"", "/", true},
+		{"/ws/../admin", "", false},
+		{"/ws/..", "", false},
+		{"/ws/..acme", "/ws/..acme", true},
+	}
+	for _, tt := range tests {
+		got, ok := cleanPath(tt.path)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("cleanPath(%q) = %q, %v, want %q, %v", tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCleanPathHandler(t *testing.T) {
+	tenants := make(chan string, 1)
+	mux := http.NewServeMux()
+	mux.Handle("/ws/{tenant}", Handler(func(c *Conn) error {
+		tenants <- c.PathValue("tenant") + " " + c.Path()
+		return nil
+	}))
+	mux.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Traversal reached the /admin handler")
+	})
+	srv := httptest.NewServer(CleanPath(mux))
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		want   string
+	}{
+		{"Repeated slashes", "//ws//acme", http.StatusSwitchingProtocols, "acme /ws/acme"},
+		{"Traversal", "/ws/../admin", http.StatusBadRequest, ""},
+		{"Encoded traversal", "/ws/%2e%2e/admin", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, _ := dialTestServer(t, srv, tt.path, nil)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.want != "" {
+				if got := <-tenants; got != tt.want {
+					t.Errorf("Handler saw %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestUpgraderNormalizesPath(t *testing.T) {
+	paths := make(chan string, 1)
+	srv := httptest.NewServer(NewUpgrader().Handler(func(c *Conn) error {
+		paths <- c.Path()
+		return nil
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		want   string
+	}{
+		{"Repeated slashes", "/ws//acme", http.StatusSwitchingProtocols, "/ws/acme"},
+		{"Traversal", "/ws/../admin", http.StatusBadRequest, ""},
+		{"Encoded traversal", "/ws/%2e%2e/admin", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, _ := dialTestServer(t, srv, tt.path, nil)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.want != "" {
+				if got := <-paths; got != tt.want {
+					t.Errorf("Path() = %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
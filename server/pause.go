@@ -0,0 +1,35 @@
+package main
+
+// Pause stops ReadMessage from consuming the connection: calls made while
+// paused block until Resume. Incoming data then piles up in the socket
+// buffers until TCP flow control stalls the peer, which is useful when the
+// application's downstream is full. A message already being read is
+// finished. Pings are not answered while paused.
+func (c *Conn) Pause() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.resumed == nil {
+		c.resumed = make(chan struct{})
+	}
+}
+
+// Resume lets ReadMessage consume the connection again after Pause.
+func (c *Conn) Resume() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.resumed != nil {
+		close(c.resumed)
+		c.resumed = nil
+	}
+}
+
+// waitResumed blocks while reading is paused. Close resumes reading so
+// that blocked readers return.
+func (c *Conn) waitResumed() {
+	c.pauseMu.Lock()
+	resumed := c.resumed
+	c.pauseMu.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+}
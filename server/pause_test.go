@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConnPauseResume(t *testing.T) {
+	c, peer := newTestConn(t)
+	c.Pause()
+
+	received := make(chan Message, 1)
+	go func() {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage() error: %v", err)
+		}
+		received <- msg
+	}()
+
+	// With nothing reading the pipe this write blocks until Resume.
+	go writeClientFrame(t, peer, true, OpText, []byte("Hello"))
+
+	select {
+	case msg := <-received:
+		t.Fatalf("ReadMessage() returned %q while paused", msg.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	c.Resume()
+	select {
+	case msg := <-received:
+		if string(msg.Data) != "Hello" {
+			t.Errorf("ReadMessage() = %q, want %q", msg.Data, "Hello")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadMessage() still blocked after Resume")
+	}
+}
+
+func TestConnClosePaused(t *testing.T) {
+	c, _ := newTestConn(t)
+	c.Pause()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.ReadMessage()
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	c.Close()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("ReadMessage() error = %v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadMessage() still blocked after Close")
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import "slices"
+
+// OriginPolicy narrows the capabilities negotiated with clients whose
+// Origin matches Origins, for example to offer a debug subprotocol only to
+// internal tools. Capabilities outside the policy are never negotiated for
+// those clients, even if the Upgrader supports them.
+type OriginPolicy struct {
+	Origins *OriginMatcher
+
+	// Subprotocols and Extensions list the subprotocol and extension names
+	// allowed for matching origins. An empty list allows none.
+	Subprotocols []string
+	Extensions   []string
+}
+
+// policyFor returns the first of u.OriginPolicies matching origin, or nil
+// if none does and the Upgrader's own settings apply unchanged.
+func (u *Upgrader) policyFor(origin string) *OriginPolicy {
+	for i := range u.OriginPolicies {
+		if u.OriginPolicies[i].Origins.Match(origin) {
+			return &u.OriginPolicies[i]
+		}
+	}
+	return nil
+}
+
+// allowsSubprotocol reports whether p may negotiate subprotocol. A nil
+// policy allows everything.
+func (p *OriginPolicy) allowsSubprotocol(subprotocol string) bool {
+	return p == nil || slices.Contains(p.Subprotocols, subprotocol)
+}
+
+// allowsExtension reports whether p may negotiate the named extension. A
+// nil policy allows everything.
+func (p *OriginPolicy) allowsExtension(name string) bool {
+	return p == nil || slices.Contains(p.Extensions, name)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginPolicySubprotocols(t *testing.T) {
+	u := NewUpgrader()
+	u.AllowedOrigins = MustOriginMatcher("https://*.example.com")
+	u.Subprotocols = []string{"debug", "chat"}
+	u.EnableCompression = true
+	u.OriginPolicies = []OriginPolicy{
+		{
+			Origins:      MustOriginMatcher("https://tools.example.com"),
+			Subprotocols: []string{"debug", "chat"},
+			Extensions:   []string{"permessage-deflate"},
+		},
+		{
+			Origins:      MustOriginMatcher("https://*.example.com"),
+			Subprotocols: []string{"chat"},
+		},
+	}
+	srv := httptest.NewServer(u.Handler(func(c *Conn) error { return nil }))
+	defer srv.Close()
+
+	tests := []struct {
+		origin      string
+		subprotocol string
+		deflate     bool
+	}{
+		{"https://tools.example.com", "debug", true},
+		{"https://www.example.com", "chat", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			resp, _ := dialTestServer(t, srv, "/ws", http.Header{
+				"Origin":                   {tt.origin},
+				"Sec-Websocket-Protocol":   {"debug, chat"},
+				"Sec-Websocket-Extensions": {"permessage-deflate"},
+			})
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+			}
+			if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != tt.subprotocol {
+				t.Errorf("Sec-WebSocket-Protocol = %q, want %q", got, tt.subprotocol)
+			}
+			if got := resp.Header.Get("Sec-WebSocket-Extensions") != ""; got != tt.deflate {
+				t.Errorf("permessage-deflate negotiated = %v, want %v", got, tt.deflate)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// closeBadGateway is the close code IANA registers for a gateway whose
+// upstream failed.
+const closeBadGateway uint16 = 1014
+
+// upstreamDialTimeout bounds connecting and handshaking with the upstream.
+const upstreamDialTimeout = 10 * time.Second
+
+// ProxyHandler returns DefaultUpgrader.ProxyHandler(upstreamURL).
+func ProxyHandler(upstreamURL string) http.HandlerFunc {
+	return DefaultUpgrader.ProxyHandler(upstreamURL)
+}
+
+// ProxyHandler returns an http.HandlerFunc that connects each client to
+// the WebSocket server at upstreamURL (ws:// or wss://) and relays
+// messages both ways, keeping their opcodes, until either side closes.
+// The close code and reason are passed on to the other side. The client's
+// Origin is forwarded upstream. The upstream is only dialed once the
+// request has passed every check Upgrade makes, so a request that would be
+// rejected never opens an upstream connection. If the upstream cannot be
+// reached the handshake fails with 502 Bad Gateway.
+func (u *Upgrader) ProxyHandler(upstreamURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		hs, err := u.validate(w, r)
+		if err != nil {
+			u.handshakeDone(start, err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), upstreamDialTimeout)
+		defer cancel()
+		upstream, err := dialUpstream(ctx, upstreamURL, r.Header.Get("Origin"))
+		if err != nil {
+			log.Println("Error dialing upstream:", err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			u.handshakeDone(start, err)
+			return
+		}
+		defer upstream.Close()
+		u.configure(upstream)
+
+		c, err := u.accept(w, r, hs)
+		u.handshakeDone(start, err)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		done := make(chan struct{}, 2)
+		go func() {
+			relay(upstream, c, CloseGoingAway)
+			done <- struct{}{}
+		}()
+		go func() {
+			relay(c, upstream, closeBadGateway)
+			done <- struct{}{}
+		}()
+
+		// Once one side has closed, give the other CloseGracePeriod to
+		// answer before tearing both down.
+		<-done
+		select {
+		case <-done:
+		case <-time.After(u.CloseGracePeriod):
+		}
+	}
+}
+
+// relay copies messages from src to dst until src closes or fails. A close
+// from src is passed on to dst; any other failure closes dst with
+// failCode.
+func relay(dst, src *Conn, failCode uint16) {
+	for {
+		msg, err := src.ReadMessage()
+		var closeErr *CloseError
+		if errors.As(err, &closeErr) {
+			dst.sendClose(closeErr.Code, closeErr.Text)
+			return
+		}
+		if err != nil {
+			dst.sendClose(failCode, "")
+			return
+		}
+		if err := dst.WriteMessage(msg.Opcode, msg.Data); err != nil {
+			src.sendClose(failCode, "")
+			return
+		}
+	}
+}
+
+// dialUpstream performs the client side of the opening handshake with the
+// server at rawURL and returns a client-role Conn.
+func dialUpstream(ctx context.Context, rawURL, origin string) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid upstream URL: %w", err)
+	}
+	host, scheme := u.Host, "http"
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "wss":
+		scheme = "https"
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported upstream scheme %q", u.Scheme)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname(), NextProtos: []string{"http/1.1"}})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := upstreamHandshake(conn, u, scheme, origin)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// upstreamHandshake sends the opening handshake request over conn and
+// checks the server's response.
+func upstreamHandshake(conn net.Conn, u *url.URL, scheme, origin string) (*Conn, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	secWebSocketKey := base64.StdEncoding.EncodeToString(key)
+
+	target := *u
+	target.Scheme = scheme
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", secWebSocketKey)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("Error writing upstream handshake: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading upstream handshake: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("Upstream answered %s", resp.Status)
+	}
+	if !headerContainsToken(resp.Header, "Upgrade", "websocket") {
+		return nil, fmt.Errorf("Upstream handshake response missing Upgrade: websocket")
+	}
+	if !headerContainsToken(resp.Header, "Connection", "upgrade") {
+		return nil, fmt.Errorf("Upstream handshake response missing Connection: Upgrade")
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != computeAcceptKey(secWebSocketKey) {
+		return nil, fmt.Errorf("Upstream sent an invalid Sec-WebSocket-Accept")
+	}
+
+	c := newConn(conn, bufio.NewReadWriter(br, bufio.NewWriter(conn)), nil)
+	c.client = true
+	return c, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProxyHandler(t *testing.T) {
+	upstream := httptest.NewServer(NewUpgrader().Handler(Echo(nil)))
+	defer upstream.Close()
+	proxy := httptest.NewServer(NewUpgrader().ProxyHandler("ws" + strings.TrimPrefix(upstream.URL, "http") + "/echo"))
+	defer proxy.Close()
+
+	resp, rw := dialTestServer(t, proxy, "/", nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	for _, want := range []Frame{
+		{Opcode: OpText, Payload: []byte("Hello")},
+		{Opcode: OpBinary, Payload: []byte{0x00, 0xff}},
+	} {
+		writeClientFrame(t, rw, true, want.Opcode, want.Payload)
+		f, _, err := readFrame(rw.Reader)
+		if err != nil {
+			t.Fatal("readFrame() error:", err)
+		}
+		if f.Masked || f.Opcode != want.Opcode || string(f.Payload) != string(want.Payload) {
+			t.Errorf("Got masked=%v %#x %q, want %#x %q", f.Masked, f.Opcode, f.Payload, want.Opcode, want.Payload)
+		}
+	}
+
+	// The close is answered with the client's own code.
+	writeClientFrame(t, rw, true, OpClose, []byte{0x0F, 0xA1})
+	f, _, err := readFrame(rw.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if f.Opcode != OpClose || len(f.Payload) < 2 || binary.BigEndian.Uint16(f.Payload) != 4001 {
+		t.Errorf("Got %#x %v, want close 4001", f.Opcode, f.Payload)
+	}
+}
+
+func TestProxyHandlerUpstreamDown(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	proxy := httptest.NewServer(NewUpgrader().ProxyHandler("ws" + strings.TrimPrefix(upstream.URL, "http") + "/echo"))
+	defer proxy.Close()
+
+	resp, _ := dialTestServer(t, proxy, "/", nil)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Status = %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+	upstream.Close()
+}
+
+func TestProxyHandlerRejectsBeforeDialing(t *testing.T) {
+	dialed := make(chan struct{}, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dialed <- struct{}{}
+		NewUpgrader().Handler(Echo(nil))(w, r)
+	}))
+	defer upstream.Close()
+
+	u := NewUpgrader()
+	u.Authenticate = func(r *http.Request) (any, error) {
+		if r.Header.Get("Authorization") != "Bearer ok" {
+			return nil, errors.New("invalid token")
+		}
+		return "ok", nil
+	}
+	proxy := httptest.NewServer(u.ProxyHandler("ws" + strings.TrimPrefix(upstream.URL, "http") + "/echo"))
+	defer proxy.Close()
+
+	authorized := http.Header{"Authorization": {"Bearer ok"}, "Origin": {"http://localhost:8080"}}
+	tests := []struct {
+		name   string
+		do     func() (*http.Response, error)
+		status int
+	}{
+		{"Plain GET", func() (*http.Response, error) {
+			req, _ := http.NewRequest("GET", proxy.URL, nil)
+			req.Header = authorized
+			return http.DefaultClient.Do(req)
+		}, http.StatusBadRequest},
+		{"Disallowed origin", func() (*http.Response, error) {
+			header := authorized.Clone()
+			header.Set("Origin", "http://evil.example")
+			resp, _ := dialTestServer(t, proxy, "/", header)
+			return resp, nil
+		}, http.StatusForbidden},
+		{"Unauthenticated", func() (*http.Response, error) {
+			resp, _ := dialTestServer(t, proxy, "/", nil)
+			return resp, nil
+		}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.do()
+			if err != nil {
+				t.Fatal("Request error:", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("Status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+	select {
+	case <-dialed:
+		t.Error("Upstream dialed for a rejected request")
+	default:
+	}
+}
+
+func TestUpstreamHandshakeHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"Missing Upgrade", "Connection: Upgrade\r\n"},
+		{"Missing Connection", "Upgrade: websocket\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			go func() {
+				req, err := http.ReadRequest(bufio.NewReader(server))
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(server, "HTTP/1.1 101 Switching Protocols\r\n%sSec-WebSocket-Accept: %s\r\n\r\n",
+					tt.header, computeAcceptKey(req.Header.Get("Sec-WebSocket-Key")))
+			}()
+
+			u, _ := url.Parse("ws://upstream.example/ws")
+			if _, err := upstreamHandshake(client, u, "http", ""); err == nil {
+				t.Error("upstreamHandshake() error = nil, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SendQueueSize is the capacity of the outbound queue Start and ServeConn
+// give each connection.
+const SendQueueSize = 256
+
+// ErrSendQueueFull is returned by PumpConn.Send when the peer is not
+// reading fast enough to drain the outbound queue.
+var ErrSendQueueFull = errors.New("Send queue full")
+
+// PumpConn is a connection driven by ServeConn. Its read pump delivers
+// inbound messages to the handler and its write pump drains a bounded
+// queue filled by Send, so Send may be called from any goroutine.
+type PumpConn struct {
+	*Conn
+
+	send     chan<- Message
+	done     <-chan struct{}
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+// ServeConn upgrades r using DefaultUpgrader and serves the connection
+// with DefaultUpgrader.ServeConn.
+func ServeConn(h *Hub, w http.ResponseWriter, r *http.Request, handler func(c *PumpConn, msg Message) error) (*PumpConn, error) {
+	return DefaultUpgrader.ServeConn(h, w, r, handler)
+}
+
+// ServeConn upgrades the request, adds the connection to h and starts the
+// read and write pumps of Conn.Start for it, then returns without waiting
+// for them to finish. handler is called from the read pump for every
+// inbound data message; it may reply through c.Send. If it returns an
+// error, the connection is closed with the code closeCodeFor derives from
+// it, 1011 (internal error) unless it is a *CloseError. Stop closes the
+// connection with 1000 (normal closure). Once the pumps have shut down,
+// the connection is removed from h again. h may be nil.
+func (u *Upgrader) ServeConn(h *Hub, w http.ResponseWriter, r *http.Request, handler func(c *PumpConn, msg Message) error) (*PumpConn, error) {
+	conn, err := u.Upgrade(w, r)
+	if err != nil {
+		return nil, err
+	}
+	c := &PumpConn{Conn: conn, quit: make(chan struct{})}
+	if h != nil {
+		h.Add(conn)
+	}
+	c.send, c.done = conn.startPumps(func(msg Message) error {
+		return handler(c, msg)
+	}, c.quit, func() {
+		if h != nil {
+			h.Remove(conn)
+		}
+	})
+	return c, nil
+}
+
+// Send queues msg for the write pump. It never blocks: if the queue is
+// full it returns ErrSendQueueFull, and once the connection is shut down
+// it returns ErrClosed.
+func (c *PumpConn) Send(msg Message) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	select {
+	case c.send <- msg:
+		return nil
+	case <-c.done:
+		return ErrClosed
+	default:
+		return ErrSendQueueFull
+	}
+}
+
+// Stop starts the closing handshake with 1000 (normal closure) once the
+// messages already queued by Send have been written. It does not wait for
+// the handshake to finish; Done is closed when it has. It is safe to call
+// more than once and from any goroutine.
+func (c *PumpConn) Stop() {
+	c.quitOnce.Do(func() { close(c.quit) })
+}
+
+// Done returns a channel that is closed once both pumps have shut down.
+func (c *PumpConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Start runs a read pump and a write pump for c and returns without
+// waiting for them. The read pump calls handler for every inbound data
+// message. The write pump sends every message put on the returned send
+// channel; closing it starts the closing handshake with 1000 (normal
+// closure). done is closed once the connection has shut down, whether
+// because send was closed, the peer closed, or either pump failed. Do not
+// send after done is closed, as nothing drains the channel any more.
+func (c *Conn) Start(handler func(Message)) (send chan<- Message, done <-chan struct{}) {
+	return c.startPumps(func(msg Message) error {
+		handler(msg)
+		return nil
+	}, nil, nil)
+}
+
+// startPumps implements Start and ServeConn. An error from handler closes
+// the connection gracefully with the code closeCodeFor derives from it.
+// Closing quit has the same effect as closing the returned queue. onStop,
+// if set, runs once the connection has shut down, before stopped is
+// closed.
+func (c *Conn) startPumps(handler func(Message) error, quit <-chan struct{}, onStop func()) (queue chan Message, stopped chan struct{}) {
+	queue = make(chan Message, SendQueueSize)
+	stopped = make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			c.Close()
+			if onStop != nil {
+				onStop()
+			}
+			close(stopped)
+		})
+	}
+
+	go func() {
+		defer stop()
+		for {
+			msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := handler(msg); err != nil {
+				c.CloseGracefully(closeCodeFor(err))
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case msg, ok := <-queue:
+				if !ok {
+					c.closeFromWritePump(stopped, stop)
+					return
+				}
+				if err := c.WriteMessage(msg.Opcode, msg.Data); err != nil {
+					stop()
+					return
+				}
+			case <-quit:
+				c.closeFromWritePump(stopped, stop)
+				return
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	return queue, stopped
+}
+
+// closeFromWritePump sends a 1000 close frame and waits for the read pump
+// to see the peer's reply, which stops it. It doesn't wait longer than
+// CloseGracePeriod.
+func (c *Conn) closeFromWritePump(stopped <-chan struct{}, stop func()) {
+	if c.sendClose(CloseNormalClosure, "") != nil {
+		stop()
+		return
+	}
+	select {
+	case <-stopped:
+	case <-time.After(c.CloseGracePeriod):
+		stop()
+	}
+}
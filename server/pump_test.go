@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeConnEcho(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeConn(nil, w, r, func(c *PumpConn, msg Message) error {
+			return c.Send(Message{Opcode: msg.Opcode, Data: []byte(strings.ToUpper(string(msg.Data)))})
+		})
+	}))
+	defer srv.Close()
+
+	resp, rw := dialTestServer(t, srv, "/ws", nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	for _, word := range []string{"hello", "pump", "world"} {
+		writeClientFrame(t, rw, true, OpText, []byte(word))
+		f, _, err := readFrame(rw.Reader)
+		if err != nil {
+			t.Fatal("readFrame() error:", err)
+		}
+		if want := strings.ToUpper(word); f.Opcode != OpText || string(f.Payload) != want {
+			t.Errorf("Got frame %#x %q, want text %q", f.Opcode, f.Payload, want)
+		}
+	}
+
+	writeClientFrame(t, rw, true, OpClose, []byte{0x03, 0xE8})
+	f, _, err := readFrame(rw.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if f.Opcode != OpClose {
+		t.Errorf("Got opcode %#x, want close", f.Opcode)
+	}
+}
+
+func TestPumpConnSendAfterClose(t *testing.T) {
+	conns := make(chan *PumpConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := ServeConn(nil, w, r, func(*PumpConn, Message) error { return nil })
+		if err == nil {
+			conns <- c
+		}
+	}))
+	defer srv.Close()
+
+	_, rw := dialTestServer(t, srv, "/ws", nil)
+	c := <-conns
+	writeClientFrame(t, rw, true, OpClose, []byte{0x03, 0xE8})
+
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Pumps did not shut down after close")
+	}
+	if err := c.Send(Message{Opcode: OpText, Data: []byte("late")}); err == nil {
+		t.Error("Send() after close succeeded")
+	}
+}
+
+func TestServeConnHub(t *testing.T) {
+	hub := NewHub()
+	u := NewUpgrader()
+	u.CloseGracePeriod = 50 * time.Millisecond
+	conns := make(chan *PumpConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.ServeConn(hub, w, r, func(c *PumpConn, msg Message) error {
+			if string(msg.Data) == "fail" {
+				return errors.New("handler failed")
+			}
+			return nil
+		})
+		if err == nil {
+			conns <- c
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		end  func(c *PumpConn, rw *bufio.ReadWriter)
+		want uint16
+	}{
+		{"Stop", func(c *PumpConn, rw *bufio.ReadWriter) { c.Stop() }, CloseNormalClosure},
+		{"Handler error", func(c *PumpConn, rw *bufio.ReadWriter) {
+			writeClientFrame(t, rw, true, OpText, []byte("fail"))
+		}, CloseInternalError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, rw := dialTestServer(t, srv, "/ws", nil)
+			c := <-conns
+			if got := hub.Len(); got != 1 {
+				t.Fatalf("Hub.Len() = %d after upgrade, want 1", got)
+			}
+
+			tt.end(c, rw)
+			f, _, err := readFrame(rw.Reader)
+			if err != nil {
+				t.Fatal("readFrame() error:", err)
+			}
+			if f.Opcode != OpClose || len(f.Payload) < 2 || binary.BigEndian.Uint16(f.Payload) != tt.want {
+				t.Fatalf("Got %#x %v, want close %d", f.Opcode, f.Payload, tt.want)
+			}
+			writeClientFrame(t, rw, true, OpClose, f.Payload[:2])
+
+			select {
+			case <-c.Done():
+			case <-time.After(time.Second):
+				t.Fatal("Pumps did not shut down after the closing handshake")
+			}
+			if got := hub.Len(); got != 0 {
+				t.Errorf("Hub.Len() = %d after shutdown, want 0", got)
+			}
+		})
+	}
+}
+
+func TestConnStartEcho(t *testing.T) {
+	c, peer := newTestConn(t)
+	var send chan<- Message
+	send, done := c.Start(func(msg Message) {
+		send <- msg
+	})
+
+	for _, payload := range []string{"one", "two"} {
+		writeClientFrame(t, peer, true, OpText, []byte(payload))
+		f, _, err := readFrame(peer.Reader)
+		if err != nil {
+			t.Fatal("readFrame() error:", err)
+		}
+		if f.Opcode != OpText || string(f.Payload) != payload {
+			t.Errorf("Echo = %#x %q, want text %q", f.Opcode, f.Payload, payload)
+		}
+	}
+
+	// Closing send starts a clean close; answering it shuts down.
+	close(send)
+	f, _, err := readFrame(peer.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if f.Opcode != OpClose || len(f.Payload) < 2 || f.Payload[0] != 0x03 || f.Payload[1] != 0xE8 {
+		t.Fatalf("Got %#x %v, want close 1000", f.Opcode, f.Payload)
+	}
+	writeClientFrame(t, peer, true, OpClose, f.Payload)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("done not closed after the closing handshake")
+	}
+	if got := c.State(); got != StateClosed {
+		t.Errorf("State() = %v, want closed", got)
+	}
+}
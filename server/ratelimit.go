@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter admits at most Limit handshakes per client IP in each Window.
+// Counts are kept per fixed window and forgotten when it ends.
+type RateLimiter struct {
+	Limit  int
+	Window time.Duration
+
+	mu    sync.Mutex
+	start time.Time
+	count map[string]int
+}
+
+// NewRateLimiter returns a RateLimiter admitting limit handshakes per IP per
+// window.
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{Limit: limit, Window: window}
+}
+
+// Allow reports whether another handshake from key is admitted, counting it
+// if so.
+func (l *RateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.count == nil || now.Sub(l.start) >= l.Window {
+		l.start = now
+		l.count = map[string]int{}
+	}
+	if l.count[key] >= l.Limit {
+		return false
+	}
+	l.count[key]++
+	return true
+}
+
+// rateLimit applies u.RateLimiter to r, writing the rejection response if
+// the client is over its limit.
+func (u *Upgrader) rateLimit(w http.ResponseWriter, r *http.Request) bool {
+	if u.RateLimiter == nil || u.RateLimiter.Allow(u.ClientIP(r)) {
+		return true
+	}
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	return false
+}
+
+// ClientIP returns the IP address of the client that sent r. When the
+// immediate peer is one of u.TrustedProxies, the address is taken from
+// X-Forwarded-For, skipping trusted proxies from the right, or failing that
+// from X-Real-IP. Otherwise those headers are ignored, since any client
+// can set them.
+func (u *Upgrader) ClientIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	if !u.trustedProxy(peer) {
+		return peer
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !u.trustedProxy(hops[i]) {
+			if _, err := netip.ParseAddr(hops[i]); err == nil {
+				return hops[i]
+			}
+			break
+		}
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		if _, err := netip.ParseAddr(realIP); err == nil {
+			return realIP
+		}
+	}
+	return peer
+}
+
+// trustedProxy reports whether ip falls within u.TrustedProxies.
+func (u *Upgrader) trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range u.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
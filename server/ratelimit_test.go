@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	u := NewUpgrader()
+	u.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		want       string
+	}{
+		{"Direct", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"Untrusted peer", "203.0.113.7:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.7"},
+		{"Trusted proxy", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"Proxy chain", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"192.0.2.9, 198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"X-Real-IP", "10.0.0.1:1234", http.Header{"X-Real-Ip": {"198.51.100.1"}}, "198.51.100.1"},
+		{"Garbage", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"not an ip"}}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			if got := u.ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterForwardedFor(t *testing.T) {
+	u := NewUpgrader()
+	u.RateLimiter = NewRateLimiter(1, time.Hour)
+	u.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	srv := httptest.NewServer(u.Handler(func(c *Conn) error { return nil }))
+	defer srv.Close()
+
+	// All requests come from the same trusted proxy, so only the
+	// forwarded address tells the clients apart.
+	tests := []struct {
+		client string
+		want   int
+	}{
+		{"198.51.100.1", http.StatusSwitchingProtocols},
+		{"198.51.100.2", http.StatusSwitchingProtocols},
+		{"198.51.100.1", http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		resp, _ := dialTestServer(t, srv, "/ws", http.Header{"X-Forwarded-For": {tt.client}})
+		if resp.StatusCode != tt.want {
+			t.Errorf("Status for %s = %d, want %d", tt.client, resp.StatusCode, tt.want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+var errHeaderTooLarge = errors.New("Request header fields too large")
+
+// Serve runs DefaultUpgrader.Serve(l, fn).
+func Serve(l net.Listener, fn func(*Conn) error) error {
+	return DefaultUpgrader.Serve(l, fn)
+}
+
+// ServeRaw runs DefaultUpgrader.ServeRaw(conn, fn).
+func ServeRaw(conn net.Conn, fn func(*Conn) error) {
+	DefaultUpgrader.ServeRaw(conn, fn)
+}
+
+// Serve accepts connections on l (for example a Unix socket listener) and
+// runs ServeRaw for each of them in its own goroutine.
+func (u *Upgrader) Serve(l net.Listener, fn func(*Conn) error) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go u.ServeRaw(conn, fn)
+	}
+}
+
+// ServeRaw reads a handshake request straight from conn, upgrades it and
+// passes the resulting connection to fn. When fn returns, the connection is
+// closed gracefully with a code derived from its result, exactly as by
+// Handler. conn is also closed if the handshake fails. A handshake body is
+// only accepted with Content-Length; a chunked request is rejected with
+// 400 Bad Request.
+func (u *Upgrader) ServeRaw(conn net.Conn, fn func(*Conn) error) {
+	defer conn.Close()
+
+	u.configureSocket(conn)
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	r, err := readRequest(rw.Reader, u.MaxHeaderLineLength, u.MaxHeaderCount)
+	if err != nil {
+		w := newRawResponseWriter(conn, rw)
+		if errors.Is(err, errHeaderTooLarge) {
+			http.Error(w, "Request Header Fields Too Large", http.StatusRequestHeaderFieldsTooLarge)
+		} else {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+		}
+		return
+	}
+	r.RemoteAddr = conn.RemoteAddr().String()
+	if len(r.TransferEncoding) > 0 {
+		// A chunked body is not read here, and its bytes would be taken
+		// for the first frames.
+		http.Error(newRawResponseWriter(conn, rw), "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength > 0 {
+		// readRequest stopped after the headers; the body is still in rw.
+		r.Body = &rawBody{
+			r:              io.LimitReader(rw.Reader, r.ContentLength),
+			rw:             rw,
+			expectContinue: headerContainsToken(r.Header, "Expect", "100-continue"),
+		}
+	}
+
+	c, err := u.Upgrade(newRawResponseWriter(conn, rw), r)
+	if err != nil {
+		return
+	}
+	u.serve(r, c, fn)
+}
+
+// readRequest reads a request line and headers from br, rejecting any line
+// longer than maxLine bytes and more than maxCount headers.
+func readRequest(br *bufio.Reader, maxLine, maxCount int) (*http.Request, error) {
+	var buf bytes.Buffer
+	for count := 0; ; count++ {
+		if count > maxCount {
+			return nil, errHeaderTooLarge
+		}
+		line, err := readLine(br, maxLine)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
+	return http.ReadRequest(bufio.NewReader(&buf))
+}
+
+// readLine reads up to and including the next '\n', failing with
+// errHeaderTooLarge once more than max bytes have been read.
+func readLine(br *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := br.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > max {
+			return nil, errHeaderTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return line, err
+	}
+}
+
+// rawBody reads a request body following headers read by readRequest. If
+// the client waits for permission to send it, the first Read sends 100
+// Continue, as net/http does.
+type rawBody struct {
+	r              io.Reader
+	rw             *bufio.ReadWriter
+	expectContinue bool
+}
+
+func (b *rawBody) Read(p []byte) (int, error) {
+	if b.expectContinue {
+		b.expectContinue = false
+		b.rw.WriteString("HTTP/1.1 100 Continue\r\n\r\n")
+		if err := b.rw.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return b.r.Read(p)
+}
+
+func (b *rawBody) Close() error {
+	return nil
+}
+
+// rawResponseWriter is a minimal http.ResponseWriter and http.Hijacker
+// writing an HTTP/1.1 response directly to a network connection.
+type rawResponseWriter struct {
+	conn        net.Conn
+	rw          *bufio.ReadWriter
+	header      http.Header
+	wroteHeader bool
+}
+
+func newRawResponseWriter(conn net.Conn, rw *bufio.ReadWriter) *rawResponseWriter {
+	return &rawResponseWriter{conn: conn, rw: rw, header: http.Header{}}
+}
+
+func (w *rawResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *rawResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code != http.StatusSwitchingProtocols {
+		w.header.Set("Connection", "close")
+	}
+	fmt.Fprintf(w.rw, "HTTP/1.1 %s %s\r\n", strconv.Itoa(code), http.StatusText(code))
+	w.header.Write(w.rw)
+	w.rw.WriteString("\r\n")
+	w.rw.Flush()
+}
+
+func (w *rawResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.rw.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, w.rw.Flush()
+}
+
+func (w *rawResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if err := w.rw.Flush(); err != nil {
+		return nil, nil, err
+	}
+	return w.conn, w.rw, nil
+}
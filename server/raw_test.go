@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveRawPipe runs ServeRaw on one end of an in-memory pipe, writes request
+// from the other end and returns the parsed response.
+func serveRawPipe(t *testing.T, request string, fn func(*Conn) error) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	go ServeRaw(server, fn)
+	go client.Write([]byte(request))
+
+	br := bufio.NewReader(client)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal("ReadResponse error:", err)
+	}
+	return resp, br
+}
+
+const rawHandshake = "GET /ws HTTP/1.1\r\n" +
+	"Host: localhost:8080\r\n" +
+	"Origin: http://localhost:8080\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n"
+
+func TestServeRawHandshake(t *testing.T) {
+	resp, br := serveRawPipe(t, rawHandshake+"\r\n", func(c *Conn) error {
+		return c.WriteMessage(OpText, []byte("raw"))
+	})
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if got, want := resp.Header.Get("Sec-WebSocket-Accept"), computeAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != want {
+		t.Errorf("Sec-WebSocket-Accept = %q, want %q", got, want)
+	}
+
+	f, _, err := readFrame(br)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if string(f.Payload) != "raw" {
+		t.Errorf("Payload = %q, want %q", f.Payload, "raw")
+	}
+}
+
+func TestServeRawTooManyHeaders(t *testing.T) {
+	var b strings.Builder
+	b.WriteString(rawHandshake)
+	for i := 0; i <= DefaultMaxHeaderCount; i++ {
+		fmt.Fprintf(&b, "X-Filler-%d: x\r\n", i)
+	}
+	b.WriteString("\r\n")
+
+	resp, _ := serveRawPipe(t, b.String(), func(c *Conn) error {
+		t.Error("Handler called for oversized request")
+		return nil
+	})
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Status = %d, want %d", resp.StatusCode, http.StatusRequestHeaderFieldsTooLarge)
+	}
+}
+
+func TestServeRawHeaderLineTooLong(t *testing.T) {
+	request := rawHandshake + "X-Big: " + strings.Repeat("a", DefaultMaxHeaderLineLength) + "\r\n\r\n"
+
+	resp, _ := serveRawPipe(t, request, func(c *Conn) error {
+		t.Error("Handler called for oversized request")
+		return nil
+	})
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Status = %d, want %d", resp.StatusCode, http.StatusRequestHeaderFieldsTooLarge)
+	}
+}
+
+func TestServeRawChunkedBody(t *testing.T) {
+	// Masked text frame "hi" hidden in the chunk data.
+	request := rawHandshake +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"8\r\n\x81\x82\x00\x00\x00\x00hi\r\n" +
+		"0\r\n\r\n"
+
+	resp, _ := serveRawPipe(t, request, func(c *Conn) error {
+		t.Error("Handler called for chunked request")
+		return nil
+	})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestServeRawCloseCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want uint16
+	}{
+		{"Success", nil, CloseNormalClosure},
+		{"Close error", &CloseError{Code: ClosePolicyViolation, Text: "no"}, ClosePolicyViolation},
+		{"Other error", fmt.Errorf("boom"), CloseInternalError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, br := serveRawPipe(t, rawHandshake+"\r\n", func(c *Conn) error {
+				c.CloseGracePeriod = 10 * time.Millisecond
+				return tt.err
+			})
+			f, _, err := readFrame(br)
+			if err != nil {
+				t.Fatal("readFrame() error:", err)
+			}
+			if f.Opcode != OpClose || len(f.Payload) < 2 || binary.BigEndian.Uint16(f.Payload) != tt.want {
+				t.Errorf("Got frame %#x %v, want a close with %d", f.Opcode, f.Payload, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ReadRawFrame reads the next frame exactly as the peer sent it: control
+// frames and fragments are returned individually, nothing is reassembled,
+// decompressed or validated, and pings are not answered. It is meant for
+// debugging proxies and protocol analysis and must not be mixed with
+// ReadMessage on the same connection. The payload is unmasked unless
+// KeepRawMask is set. MaxFrameSize still applies.
+func (c *Conn) ReadRawFrame() (Frame, error) {
+	if c.State() == StateClosed {
+		return Frame{}, ErrClosed
+	}
+	f, n, err := readFramePooled(c.rw.Reader, nil, c.MaxFrameSize, c.LenientControlFrames)
+	c.bytesReceived.Add(int64(n))
+	if errors.Is(err, errFrameTooLarge) {
+		return Frame{}, fmt.Errorf("Frame exceeds MaxFrameSize: %w", err)
+	}
+	if err != nil {
+		return Frame{}, err
+	}
+	if f.Masked && c.KeepRawMask {
+		maskBytes(f.MaskKey, f.Payload)
+	}
+	return f, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestConnReadRawFrame(t *testing.T) {
+	c, peer := newTestConn(t)
+	frames := []Frame{
+		{Fin: false, Opcode: OpText, Payload: []byte("Hel")},
+		{Fin: true, Opcode: OpPing, Payload: []byte("ping")},
+		{Fin: false, Opcode: OpContinuation, Payload: []byte("lo ")},
+		{Fin: true, Opcode: OpContinuation, Payload: []byte("World")},
+	}
+	go func() {
+		for _, f := range frames {
+			writeClientFrame(t, peer, f.Fin, f.Opcode, f.Payload)
+		}
+	}()
+
+	for i, want := range frames {
+		got, err := c.ReadRawFrame()
+		if err != nil {
+			t.Fatalf("ReadRawFrame() #%d error: %v", i, err)
+		}
+		if got.Fin != want.Fin || got.Opcode != want.Opcode || !got.Masked {
+			t.Errorf("Frame #%d: fin=%v opcode=%#x masked=%v, want fin=%v opcode=%#x masked=true",
+				i, got.Fin, got.Opcode, got.Masked, want.Fin, want.Opcode)
+		}
+		if !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("Frame #%d payload = %q, want %q", i, got.Payload, want.Payload)
+		}
+	}
+}
+
+func TestConnReadRawFrameKeepMask(t *testing.T) {
+	c, peer := newTestConn(t)
+	c.KeepRawMask = true
+	payload := []byte("Hello")
+	go writeClientFrame(t, peer, true, OpText, payload)
+
+	f, err := c.ReadRawFrame()
+	if err != nil {
+		t.Fatal("ReadRawFrame() error:", err)
+	}
+	if bytes.Equal(f.Payload, payload) {
+		t.Fatalf("Payload = %q, want it still masked", f.Payload)
+	}
+	maskBytes(f.MaskKey, f.Payload)
+	if !bytes.Equal(f.Payload, payload) {
+		t.Errorf("Unmasked payload = %q, want %q", f.Payload, payload)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "errors"
+
+// ReadAll reads data messages until the connection closes and returns them
+// in order. A close with 1000 or 1001 ends the stream cleanly and yields a
+// nil error; any other close or read error is returned along with the
+// messages collected so far. If limit is positive it bounds the total size
+// of the collected messages, closing the connection with 1009 when
+// exceeded; MaxMessageSize still bounds each message on its own.
+func (c *Conn) ReadAll(limit int64) ([]Message, error) {
+	var msgs []Message
+	var total int64
+	for {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			var closeErr *CloseError
+			if errors.As(err, &closeErr) && (closeErr.Code == CloseNormalClosure || closeErr.Code == CloseGoingAway) {
+				return msgs, nil
+			}
+			return msgs, err
+		}
+		total += int64(len(msg.Data))
+		if limit > 0 && total > limit {
+			return msgs, c.failTooLarge()
+		}
+		msgs = append(msgs, msg)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestConnReadAll(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	go func() {
+		writeClientFrame(t, peer, true, OpText, []byte("one"))
+		writeClientFrame(t, peer, true, OpBinary, []byte("two"))
+		writeClientFrame(t, peer, true, OpText, []byte("three"))
+		writeClientFrame(t, peer, true, OpClose, binary.BigEndian.AppendUint16(nil, CloseNormalClosure))
+		// Drain the close reply.
+		readFrame(peer.Reader)
+	}()
+
+	msgs, err := c.ReadAll(0)
+	if err != nil {
+		t.Fatal("ReadAll() error:", err)
+	}
+	want := []Message{{OpText, []byte("one")}, {OpBinary, []byte("two")}, {OpText, []byte("three")}}
+	if fmt.Sprint(msgs) != fmt.Sprint(want) {
+		t.Errorf("ReadAll() = %v, want %v", msgs, want)
+	}
+}
+
+func TestConnReadAllAbnormalClose(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	go func() {
+		writeClientFrame(t, peer, true, OpText, []byte("one"))
+		writeClientFrame(t, peer, true, OpClose, binary.BigEndian.AppendUint16(nil, 1011))
+		readFrame(peer.Reader)
+	}()
+
+	msgs, err := c.ReadAll(0)
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != 1011 {
+		t.Errorf("ReadAll() error = %v, want a close with 1011", err)
+	}
+	if len(msgs) != 1 || string(msgs[0].Data) != "one" {
+		t.Errorf("ReadAll() = %v, want the message before the close", msgs)
+	}
+}
+
+func TestConnReadAllLimit(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	go func() {
+		writeClientFrame(t, peer, true, OpText, []byte("12345"))
+		writeClientFrame(t, peer, true, OpText, []byte("67890"))
+		readFrame(peer.Reader)
+	}()
+
+	msgs, err := c.ReadAll(8)
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("ReadAll() error = %v, want ErrMessageTooLarge", err)
+	}
+	if len(msgs) != 1 {
+		t.Errorf("ReadAll() returned %d messages, want 1", len(msgs))
+	}
+}
+
+func TestConnReadAllLimitIndependentOfMaxMessageSize(t *testing.T) {
+	c, peer := newTestConn(t)
+	c.MaxMessageSize = 8
+
+	go func() {
+		writeClientFrame(t, peer, true, OpText, []byte("12345"))
+		writeClientFrame(t, peer, true, OpText, []byte("67890"))
+		writeClientFrame(t, peer, true, OpClose, binary.BigEndian.AppendUint16(nil, CloseNormalClosure))
+		readFrame(peer.Reader)
+	}()
+
+	msgs, err := c.ReadAll(0)
+	if err != nil {
+		t.Fatal("ReadAll() error:", err)
+	}
+	if len(msgs) != 2 {
+		t.Errorf("ReadAll() returned %d messages, want 2", len(msgs))
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// idleTimeoutError is returned by ReadMessage when the read deadline
+// expires between messages, before any byte of the next frame has been
+// read. Pings and pongs read before it have been handled, so the stream is
+// still in sync and the connection may be read again. It unwraps to
+// os.ErrDeadlineExceeded like any other read timeout.
+type idleTimeoutError struct {
+	err error
+}
+
+func (e *idleTimeoutError) Error() string { return e.err.Error() }
+func (e *idleTimeoutError) Unwrap() error { return e.err }
+
+// ReadMessageTimeout is ReadMessage for polling loops, bounded as a whole
+// by d as well as by any deadline set with SetReadDeadline, which is
+// restored afterwards. If no message starts arriving in time, because the
+// peer is silent or sends only pings and pongs, it returns ok=false and a
+// nil error and the connection remains usable. If the time runs out in
+// the middle of a message, the stream cannot be resumed, so the connection
+// is closed and the timeout returned.
+func (c *Conn) ReadMessageTimeout(d time.Duration) (msg Message, ok bool, err error) {
+	deadline := time.Now().Add(d)
+	var previous time.Time
+	if nanos := c.readDeadline.Load(); nanos != 0 {
+		previous = time.Unix(0, nanos)
+		if previous.Before(deadline) {
+			deadline = previous
+		}
+	}
+	c.conn.SetReadDeadline(deadline)
+	defer c.conn.SetReadDeadline(previous)
+
+	msg, err = c.ReadMessage()
+	var idle *idleTimeoutError
+	if errors.As(err, &idle) {
+		return Message{}, false, nil
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		c.Close()
+	}
+	if err != nil {
+		return Message{}, false, err
+	}
+	return msg, true, nil
+}
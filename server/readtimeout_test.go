@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConnReadMessageTimeout(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	start := time.Now()
+	_, ok, err := c.ReadMessageTimeout(50 * time.Millisecond)
+	if err != nil || ok {
+		t.Fatalf("ReadMessageTimeout() = ok %v, error %v, want no message and no error", ok, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("ReadMessageTimeout() took %v, want about 50ms", elapsed)
+	}
+
+	// The connection is still usable in both directions.
+	go writeClientFrame(t, peer, true, OpText, []byte("late"))
+	msg, ok, err := c.ReadMessageTimeout(time.Second)
+	if err != nil || !ok {
+		t.Fatalf("ReadMessageTimeout() = ok %v, error %v, want a message", ok, err)
+	}
+	if string(msg.Data) != "late" {
+		t.Errorf("ReadMessageTimeout() = %q, want %q", msg.Data, "late")
+	}
+
+	go c.WriteMessage(OpText, []byte("reply"))
+	f, _, err := readFrame(peer.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if string(f.Payload) != "reply" {
+		t.Errorf("Payload = %q, want %q", f.Payload, "reply")
+	}
+}
+
+func TestConnReadMessageTimeoutAfterPing(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	pongs := make(chan Frame, 1)
+	go func() {
+		writeClientFrame(t, peer, true, OpPing, []byte("hi"))
+		f, _, _ := readFrame(peer.Reader)
+		pongs <- f
+	}()
+
+	start := time.Now()
+	_, ok, err := c.ReadMessageTimeout(100 * time.Millisecond)
+	if err != nil || ok {
+		t.Fatalf("ReadMessageTimeout() = ok %v, error %v, want no message and no error", ok, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ReadMessageTimeout() took %v after the peer went quiet", elapsed)
+	}
+	if f := <-pongs; f.Opcode != OpPong {
+		t.Errorf("Reply = %#x, want a pong", f.Opcode)
+	}
+	if got := c.State(); got != StateOpen {
+		t.Errorf("State() = %v, want %v", got, StateOpen)
+	}
+}
+
+func TestConnReadMessageTimeoutPartialMessage(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	go writeClientFrame(t, peer, false, OpText, []byte("first half"))
+	_, ok, err := c.ReadMessageTimeout(100 * time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) || ok {
+		t.Fatalf("ReadMessageTimeout() = ok %v, error %v, want a timeout", ok, err)
+	}
+	if got := c.State(); got != StateClosed {
+		t.Errorf("State() = %v, want %v after a timeout mid-message", got, StateClosed)
+	}
+}
+
+func TestConnReadMessageTimeoutRestoresDeadline(t *testing.T) {
+	c, _ := newTestConn(t)
+	c.SetReadDeadline(time.Now().Add(150 * time.Millisecond))
+
+	if _, ok, err := c.ReadMessageTimeout(50 * time.Millisecond); err != nil || ok {
+		t.Fatalf("ReadMessageTimeout() = ok %v, error %v, want no message and no error", ok, err)
+	}
+
+	// The earlier deadline still applies to a plain read.
+	start := time.Now()
+	if _, err := c.ReadMessage(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("ReadMessage() error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ReadMessage() took %v, want the restored deadline to end it", elapsed)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestConnRecordsRoundTrip(t *testing.T) {
+	c, peer := newTestConn(t)
+	records := [][]byte{[]byte("first"), {}, []byte("third record"), {0x00, 0xff}}
+
+	go c.WriteRecords(records)
+	f, _, err := readFrame(peer.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if f.Opcode != OpBinary || !f.Fin {
+		t.Fatalf("Got opcode %#x, fin %v, want a single binary frame", f.Opcode, f.Fin)
+	}
+
+	// Send the packed message back and unpack it.
+	go writeClientFrame(t, peer, true, OpBinary, f.Payload)
+	got, err := c.ReadRecords()
+	if err != nil {
+		t.Fatal("ReadRecords() error:", err)
+	}
+	if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", records) {
+		t.Errorf("ReadRecords() = %q, want %q", got, records)
+	}
+}
+
+func TestUnpackRecordsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"Truncated prefix", []byte{0, 0, 1}},
+		{"Length past end", []byte{0, 0, 0, 5, 'a', 'b'}},
+		{"Second length past end", []byte{0, 0, 0, 1, 'a', 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := unpackRecords(tt.data); err == nil {
+				t.Errorf("unpackRecords(%v) succeeded", tt.data)
+			}
+		})
+	}
+}
+
+func TestReadRecordsRejectsText(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	go writeClientFrame(t, peer, true, OpText, []byte{0, 0, 0, 0})
+	if _, err := c.ReadRecords(); err == nil {
+		t.Error("ReadRecords() accepted a text message")
+	}
+}
@@ -1,96 +1,97 @@
 package main
 
 import (
-	"bufio"
 	"crypto/sha1"
 	"encoding/base64"
+	"errors"
+	"flag"
 	"fmt"
+	"hash"
 	"log"
 	"net/http"
+	"strings"
 )
 
-const magicString = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+// magicString is the GUID RFC 6455 appends to Sec-WebSocket-Key when
+// computing Sec-WebSocket-Accept. It is a variable only so that tests can
+// simulate peers that get it wrong.
+var magicString = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 
 func computeAcceptKey(secWebSocketKey string) string {
-	const magicString = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
-	h := sha1.New()
+	return computeAcceptKeyHash(sha1.New, secWebSocketKey)
+}
+
+// computeAcceptKeyHash is computeAcceptKey with the SHA-1 that RFC 6455
+// mandates replaced by newHash, for experimenting with peers that differ.
+func computeAcceptKeyHash(newHash func() hash.Hash, secWebSocketKey string) string {
+	h := newHash()
 	h.Write([]byte(secWebSocketKey + magicString))
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
-func wsHandler(w http.ResponseWriter, r *http.Request) {
-
-	allowedOrigin := "http://localhost:8080" // Change this to your allowed origin
-	origin := r.Header.Get("Origin")
-	if origin != allowedOrigin {
-		log.Printf("Origin not allowed: %q\n", origin)
-		http.Error(w, "Origin not allowed", http.StatusForbidden)
-		return
-	}
-
-	if r.Header.Get("Upgrade") != "websocket" {
-		http.Error(w, "Not a valid WebSocket handshake", http.StatusBadRequest)
-		return
-	}
-
-	// Check for proper WebSocket version
-	if r.Header.Get("Sec-WebSocket-Version") != "13" {
-		http.Error(w, "WebSocket version not supported", http.StatusUpgradeRequired)
-		return
-	}
-
-	secWebSocketKey := r.Header.Get("Sec-WebSocket-Key")
-	if secWebSocketKey == "" {
-		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
-		return
-	}
-
-	secWebSocketAccept := computeAcceptKey(secWebSocketKey)
-
-	header := w.Header()
-	header.Set("Upgrade", "websocket")
-	header.Set("Connection", "Upgrade")
-	header.Set("Sec-WebSocket-Accept", secWebSocketAccept)
-	w.WriteHeader(http.StatusSwitchingProtocols)
-
-	hijacker, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
-		return
-	}
-	conn, rw, err := hijacker.Hijack()
-	if err != nil {
-		http.Error(w, "Could not hijack connection: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer conn.Close()
-
+// greet is the default /ws handler: it greets every client with a single
+// "Hello World" text message. Handler then closes the connection with a
+// proper closing handshake, so the greeting is never cut off by the socket
+// closing early. If the connection is already closed the write fails with
+// ErrClosed, which is returned without logging; Handler then has nothing
+// left to close.
+func greet(c *Conn) error {
 	message := "Hello World"
-	if err := sendTextMessage(rw.Writer, message); err != nil {
-		log.Println("Error sending message:", err)
-		return
+	if err := c.WriteText(message); err != nil {
+		if !errors.Is(err, ErrClosed) {
+			log.Println("Error sending message:", err)
+		}
+		return err
 	}
 	log.Println("Sent:", message)
+	return nil
 }
 
-func sendTextMessage(w *bufio.Writer, message string) error {
-	payloadLen := len(message)
-	if payloadLen > 125 {
-		return fmt.Errorf("Message too long")
-	}
+// wsHandler serves greet with the default settings.
+var wsHandler = Handler(greet)
 
-	frame := []byte{0x81}
-	frame = append(frame, byte(payloadLen))
-	frame = append(frame, []byte(message)...)
+// IsWebSocketUpgrade reports whether r looks like a WebSocket opening
+// handshake: its Connection header contains the "upgrade" token and its
+// Upgrade header names "websocket", both compared case-insensitively. It
+// lets the same path serve plain HTTP and WebSocket clients.
+func IsWebSocketUpgrade(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") &&
+		headerContainsToken(r.Header, "Upgrade", "websocket")
+}
 
-	if _, err := w.Write(frame); err != nil {
-		return err
+// headerContainsToken reports whether any comma-separated value of the
+// named header equals token, ignoring case.
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, t := range headerValues(h, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerValues returns the comma-separated elements of every line of the
+// named header, trimmed and without empty ones. Repeated header lines and a
+// single combined line therefore read the same, as RFC 9110 requires.
+func headerValues(h http.Header, name string) []string {
+	var values []string
+	for _, line := range h.Values(name) {
+		for _, v := range strings.Split(line, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
 	}
-	return w.Flush()
+	return values
 }
 
 func main() {
-	http.HandleFunc("/ws", wsHandler)
-	fmt.Println("WebSocket server started on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	addr := flag.String("addr", ":8080", "address to listen on")
+	flag.Parse()
+
+	upgrader := NewUpgrader()
+	http.HandleFunc("/ws", upgrader.Handler(greet))
+	http.HandleFunc("/echo", upgrader.Handler(Echo(nil)))
+	fmt.Println("WebSocket server started on", *addr)
+	log.Fatal(http.ListenAndServe(*addr, CleanPath(http.DefaultServeMux)))
 }
@@ -3,10 +3,18 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestComputeAcceptKey(t *testing.T) {
@@ -24,6 +32,27 @@ func TestComputeAcceptKey(t *testing.T) {
 	}
 }
 
+func TestComputeAcceptKeyCustomGUID(t *testing.T) {
+	secWebSocketKey := "dGhlIHNhbXBsZSBub25jZQ=="
+	standard := computeAcceptKey(secWebSocketKey)
+
+	defer func(guid string) { magicString = guid }(magicString)
+	magicString = "00000000-0000-0000-0000-000000000000"
+	if got := computeAcceptKey(secWebSocketKey); got == standard {
+		t.Errorf("computeAcceptKey() with a custom GUID = %q, the same as with the RFC GUID", got)
+	}
+}
+
+func TestComputeAcceptKeyHash(t *testing.T) {
+	secWebSocketKey := "dGhlIHNhbXBsZSBub25jZQ=="
+	if got, want := computeAcceptKeyHash(sha1.New, secWebSocketKey), computeAcceptKey(secWebSocketKey); got != want {
+		t.Errorf("computeAcceptKeyHash(sha1.New) = %q, want %q", got, want)
+	}
+	if got := computeAcceptKeyHash(sha256.New, secWebSocketKey); got == computeAcceptKey(secWebSocketKey) {
+		t.Errorf("computeAcceptKeyHash(sha256.New) = %q, the same as with SHA-1", got)
+	}
+}
+
 func TestWsHandlerOriginNotAllowed(t *testing.T) {
 	// Test that the handler rejects requests from disallowed origins
 	req := httptest.NewRequest("GET", "/ws", nil)
@@ -61,11 +90,32 @@ func TestWsHandlerNotWebSocketRequest(t *testing.T) {
 	}
 }
 
+func TestWsHandlerMethodNotAllowed(t *testing.T) {
+	req := httptest.NewRequest("POST", "/ws", nil)
+	req.Header.Set("Origin", "http://localhost:8080")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	rr := httptest.NewRecorder()
+	wsHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusMethodNotAllowed {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusMethodNotAllowed)
+	}
+	if got := rr.Header().Get("Allow"); got != "GET" {
+		t.Errorf("Allow = %q, want %q", got, "GET")
+	}
+}
+
 func TestWsHandlerMissingSecWebSocketKey(t *testing.T) {
 	// Test that the handler rejects requests without Sec-WebSocket-Key
 	req := httptest.NewRequest("GET", "/ws", nil)
 	req.Header.Set("Origin", "http://localhost:8080")
 	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
 	// Missing Sec-WebSocket-Key header
 
 	rr := httptest.NewRecorder()
@@ -77,6 +127,25 @@ func TestWsHandlerMissingSecWebSocketKey(t *testing.T) {
 	}
 }
 
+func TestWsHandlerUnsupportedVersion(t *testing.T) {
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Origin", "http://localhost:8080")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+
+	rr := httptest.NewRecorder()
+	wsHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusUpgradeRequired {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusUpgradeRequired)
+	}
+	if got := rr.Header().Get("Sec-WebSocket-Version"); got != "13" {
+		t.Errorf("Sec-WebSocket-Version = %q, want %q", got, "13")
+	}
+}
+
 func TestWsHandlerHijackingNotSupported(t *testing.T) {
 	// Test that the handler handles hijacking not supported
 	// This is a bit tricky to test since httptest.ResponseRecorder doesn't implement http.Hijacker
@@ -88,6 +157,36 @@ func TestWsHandlerHijackingNotSupported(t *testing.T) {
 	t.Skip("Skipping hijacking not supported test - difficult to implement without custom ResponseWriter")
 }
 
+// hijackRecorder is an httptest.ResponseRecorder that supports Hijack.
+// Everything written to the hijacked connection is kept in out; reads
+// from it see EOF.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	out bytes.Buffer
+}
+
+func newHijackRecorder() *hijackRecorder {
+	return &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+}
+
+func (r *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn := &recordingConn{out: &r.out}
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+// recordingConn is the net.Conn handed out by hijackRecorder.
+type recordingConn struct {
+	net.Conn
+	out *bytes.Buffer
+}
+
+func (c *recordingConn) Read(b []byte) (int, error)         { return 0, io.EOF }
+func (c *recordingConn) Write(b []byte) (int, error)        { return c.out.Write(b) }
+func (c *recordingConn) Close() error                       { return nil }
+func (c *recordingConn) SetDeadline(t time.Time) error      { return nil }
+func (c *recordingConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *recordingConn) SetWriteDeadline(t time.Time) error { return nil }
+
 func TestWsHandlerSuccessfulHandshake(t *testing.T) {
 	// Test a successful WebSocket handshake
 	req := httptest.NewRequest("GET", "/ws", nil)
@@ -96,123 +195,299 @@ func TestWsHandlerSuccessfulHandshake(t *testing.T) {
 	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
 	req.Header.Set("Sec-WebSocket-Version", "13")
 
-	rr := httptest.NewRecorder()
+	rr := newHijackRecorder()
 	wsHandler(rr, req)
 
-	// Check status code
-	if status := rr.Code; status != http.StatusSwitchingProtocols {
-		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusSwitchingProtocols)
-	}
-
-	// Check headers
-	headers := rr.Header()
-	if upgrade := headers.Get("Upgrade"); upgrade != "websocket" {
-		t.Errorf("Upgrade header = %v, want %v", upgrade, "websocket")
-	}
-
-	if connection := headers.Get("Connection"); connection != "Upgrade" {
-		t.Errorf("Connection header = %v, want %v", connection, "Upgrade")
-	}
-
-	// Check Sec-WebSocket-Accept
-	expectedAcceptKey := computeAcceptKey("dGhlIHNhbXBsZSBub25jZQ==")
-	if accept := headers.Get("Sec-WebSocket-Accept"); accept != expectedAcceptKey {
-		t.Errorf("Sec-WebSocket-Accept header = %v, want %v", accept, expectedAcceptKey)
+	// The response is written byte for byte, with RFC 6455 casing and
+	// header order.
+	want := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + computeAcceptKey("dGhlIHNhbXBsZSBub25jZQ==") + "\r\n" +
+		"\r\n"
+	if got := rr.out.String(); !strings.HasPrefix(got, want) {
+		t.Errorf("Response starts %q, want %q", got[:min(len(got), len(want))], want)
 	}
 }
 
-func TestSendTextMessage(t *testing.T) {
-	// Test sending a text message
-	var buf bytes.Buffer
-	writer := bufio.NewWriter(&buf)
+func TestUpgraderResponseHeaderOrder(t *testing.T) {
+	u := NewUpgrader()
+	u.Subprotocols = []string{"chat.v1"}
+	u.EnableCompression = true
 
-	message := "Hello, WebSocket!"
-	err := sendTextMessage(writer, message)
-	if err != nil {
-		t.Errorf("sendTextMessage() error = %v, want nil", err)
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Origin", "http://localhost:8080")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", "chat.v1")
+	req.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate")
+
+	rr := newHijackRecorder()
+	// Headers set before the upgrade, say by middleware, follow the
+	// handshake headers.
+	rr.Header().Set("X-Request-Id", "42")
+	if _, err := u.Upgrade(rr, req); err != nil {
+		t.Fatal("Upgrade() error:", err)
 	}
 
-	// Check that data was written
-	if buf.Len() == 0 {
-		t.Error("sendTextMessage() wrote no data")
+	want := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + computeAcceptKey("dGhlIHNhbXBsZSBub25jZQ==") + "\r\n" +
+		"Sec-WebSocket-Protocol: chat.v1\r\n" +
+		"Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n" +
+		"X-Request-Id: 42\r\n" +
+		"\r\n"
+	if got := rr.out.String(); got != want {
+		t.Errorf("Response = %q, want %q", got, want)
 	}
+}
 
-	// Verify the frame structure
-	data := buf.Bytes()
-	if len(data) == 0 {
-		t.Fatal("No data written")
+// TestGreet tests that greet sends "Hello World" as a single text frame
+// through the Conn write path.
+func TestGreet(t *testing.T) {
+	c, peer := newTestConn(t)
+
+	raw := make(chan []byte, 1)
+	go func() {
+		data := make([]byte, 13)
+		io.ReadFull(peer, data)
+		raw <- data
+	}()
+	if err := greet(c); err != nil {
+		t.Fatal("greet() error:", err)
 	}
 
+	data := <-raw
 	// Check first byte (FIN + opcode)
 	if data[0] != 0x81 {
 		t.Errorf("First byte = %x, want %x", data[0], 0x81)
 	}
-
-	// Check payload length
-	expectedLen := len(message)
-	if int(data[1]) != expectedLen {
-		t.Errorf("Payload length byte = %d, want %d", data[1], expectedLen)
+	// Check payload length (should be 11 for "Hello World")
+	if data[1] != 11 {
+		t.Errorf("Payload length byte = %d, want %d", data[1], 11)
 	}
+	if payload := string(data[2:]); payload != "Hello World" {
+		t.Errorf("Payload = %v, want %v", payload, "Hello World")
+	}
+	if got := c.MessagesSent(); got != 1 {
+		t.Errorf("MessagesSent() = %d, want 1", got)
+	}
+}
 
-	// Check payload
-	payload := string(data[2:])
-	if payload != message {
-		t.Errorf("Payload = %v, want %v", payload, message)
+func TestGreetAfterClose(t *testing.T) {
+	c, _ := newTestConn(t)
+	c.Close()
+	if err := greet(c); !errors.Is(err, ErrClosed) {
+		t.Errorf("greet() error = %v, want ErrClosed", err)
+	}
+	if got := c.MessagesSent(); got != 0 {
+		t.Errorf("MessagesSent() = %d, want 0", got)
 	}
 }
 
-func TestSendTextMessageTooLong(t *testing.T) {
-	// Test sending a message that's too long
-	var buf bytes.Buffer
-	writer := bufio.NewWriter(&buf)
+// dialTestServer performs a client handshake against srv at path and returns
+// the handshake response together with a ReadWriter for exchanging frames.
+func dialTestServer(t *testing.T, srv *httptest.Server, path string, header http.Header) (*http.Response, *bufio.ReadWriter) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
 
-	// Create a message longer than 125 bytes
-	longMessage := strings.Repeat("a", 126)
-	err := sendTextMessage(writer, longMessage)
-	if err == nil {
-		t.Error("sendTextMessage() error = nil, want error for long message")
+	req, err := http.NewRequest("GET", srv.URL+path, nil)
+	if err != nil {
+		t.Fatal("NewRequest error:", err)
 	}
+	req.Header.Set("Origin", "http://localhost:8080")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal("Request write error:", err)
+	}
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	resp, err := http.ReadResponse(rw.Reader, req)
+	if err != nil {
+		t.Fatal("ReadResponse error:", err)
+	}
+	return resp, rw
 }
 
-// TestSendHelloWorldMessage tests that the specific "Hello World" message is properly formatted
-func TestSendHelloWorldMessage(t *testing.T) {
-	var buf bytes.Buffer
-	writer := bufio.NewWriter(&buf)
+func TestHandlerPathWildcard(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/ws/{tenant}", Handler(func(c *Conn) error {
+		return c.WriteMessage(OpText, []byte(c.Path()+" "+c.PathValue("tenant")))
+	}))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, rw := dialTestServer(t, srv, "/ws/acme", nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
 
-	message := "Hello World"
-	err := sendTextMessage(writer, message)
+	f, _, err := readFrame(rw.Reader)
 	if err != nil {
-		t.Errorf("sendTextMessage() error = %v, want nil", err)
+		t.Fatal("readFrame() error:", err)
+	}
+	if got, want := string(f.Payload), "/ws/acme acme"; got != want {
+		t.Errorf("Handler saw %q, want %q", got, want)
+	}
+}
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{
+			name:    "Standard handshake",
+			headers: map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"},
+			want:    true,
+		},
+		{
+			name:    "Mixed case",
+			headers: map[string]string{"Connection": "UPGRADE", "Upgrade": "WebSocket"},
+			want:    true,
+		},
+		{
+			name:    "Token within list",
+			headers: map[string]string{"Connection": "keep-alive, Upgrade", "Upgrade": "websocket"},
+			want:    true,
+		},
+		{
+			name:    "Missing Connection",
+			headers: map[string]string{"Upgrade": "websocket"},
+			want:    false,
+		},
+		{
+			name:    "Missing Upgrade",
+			headers: map[string]string{"Connection": "Upgrade"},
+			want:    false,
+		},
+		{
+			name:    "Other protocol",
+			headers: map[string]string{"Connection": "Upgrade", "Upgrade": "h2c"},
+			want:    false,
+		},
+		{
+			name:    "Plain request",
+			headers: map[string]string{"Connection": "keep-alive"},
+			want:    false,
+		},
 	}
 
-	// Flush the writer to ensure data is written to buffer
-	writer.Flush()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/ws", nil)
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			if got := IsWebSocketUpgrade(req); got != tt.want {
+				t.Errorf("IsWebSocketUpgrade() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
 
-	// Check that data was written
-	if buf.Len() == 0 {
-		t.Error("sendTextMessage() wrote no data")
+func TestConnRequestAfterUpgrade(t *testing.T) {
+	srv := httptest.NewServer(Handler(func(c *Conn) error {
+		r := c.Request()
+		return c.WriteMessage(OpText, []byte(r.Header.Get("X-Trace-Id")+" "+r.URL.Query().Get("room")))
+	}))
+	defer srv.Close()
+
+	header := http.Header{"X-Trace-Id": {"abc123"}}
+	resp, rw := dialTestServer(t, srv, "/ws?room=lobby", header)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
 	}
 
-	// Verify the frame structure
-	data := buf.Bytes()
-	if len(data) == 0 {
-		t.Fatal("No data written")
+	f, _, err := readFrame(rw.Reader)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
 	}
+	if got, want := string(f.Payload), "abc123 lobby"; got != want {
+		t.Errorf("Handler saw %q, want %q", got, want)
+	}
+}
 
-	// Check first byte (FIN + opcode)
-	if data[0] != 0x81 {
-		t.Errorf("First byte = %x, want %x", data[0], 0x81)
+func TestWsHandlerGreetingThenClose(t *testing.T) {
+	srv := httptest.NewServer(wsHandler)
+	defer srv.Close()
+
+	for i := 0; i < 20; i++ {
+		resp, rw := dialTestServer(t, srv, "/ws", nil)
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+		}
+
+		f, _, err := readFrame(rw.Reader)
+		if err != nil {
+			t.Fatal("readFrame() error:", err)
+		}
+		if f.Opcode != OpText || string(f.Payload) != "Hello World" {
+			t.Fatalf("Got frame %#x %q, want text %q", f.Opcode, f.Payload, "Hello World")
+		}
+
+		f, _, err = readFrame(rw.Reader)
+		if err != nil {
+			t.Fatal("readFrame() error:", err)
+		}
+		if f.Opcode != OpClose || len(f.Payload) < 2 || f.Payload[0] != 0x03 || f.Payload[1] != 0xE8 {
+			t.Fatalf("Got frame %#x %v, want close 1000", f.Opcode, f.Payload)
+		}
+
+		writeFrame(rw.Writer, Frame{Fin: true, Opcode: OpClose, Payload: f.Payload[:2], Masked: true})
+		rw.Flush()
+
+		if _, _, err := readFrame(rw.Reader); err == nil {
+			t.Fatal("Expected connection to be closed after close handshake")
+		}
 	}
+}
 
-	// Check payload length (should be 11 for "Hello World")
-	if data[1] != 11 {
-		t.Errorf("Payload length byte = %d, want %d", data[1], 11)
+func TestHandlerCloseCodes(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		code   uint16
+		reason string
+	}{
+		{"Nil", nil, CloseNormalClosure, ""},
+		{"Plain error", errors.New("database down"), CloseInternalError, ""},
+		{"Close error", &CloseError{Code: ClosePolicyViolation, Text: "banned"}, ClosePolicyViolation, "banned"},
+		{"Wrapped close error", fmt.Errorf("auth: %w", &CloseError{Code: CloseGoingAway}), CloseGoingAway, ""},
 	}
 
-	// Check payload
-	payload := string(data[2:])
-	if payload != message {
-		t.Errorf("Payload = %v, want %v", payload, message)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(Handler(func(c *Conn) error { return tt.err }))
+			defer srv.Close()
+
+			_, rw := dialTestServer(t, srv, "/ws", nil)
+			f, _, err := readFrame(rw.Reader)
+			if err != nil {
+				t.Fatal("readFrame() error:", err)
+			}
+			if f.Opcode != OpClose || len(f.Payload) < 2 {
+				t.Fatalf("Got frame %#x %v, want close", f.Opcode, f.Payload)
+			}
+			if code := binary.BigEndian.Uint16(f.Payload); code != tt.code {
+				t.Errorf("Close code = %d, want %d", code, tt.code)
+			}
+			if reason := string(f.Payload[2:]); reason != tt.reason {
+				t.Errorf("Close reason = %q, want %q", reason, tt.reason)
+			}
+		})
 	}
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// tcpConn returns the TCP connection under conn, looking through TLS, or
+// nil if there is none.
+func tcpConn(conn net.Conn) *net.TCPConn {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcp, _ := conn.(*net.TCPConn)
+	return tcp
+}
+
+// setSocketBuffers sets the kernel receive and send buffer sizes
+// (SO_RCVBUF and SO_SNDBUF) of conn. Zero sizes are left at the OS
+// default, and connections that are not TCP are left alone.
+func setSocketBuffers(conn net.Conn, read, write int) error {
+	tcp := tcpConn(conn)
+	if tcp == nil {
+		return nil
+	}
+	if read > 0 {
+		if err := tcp.SetReadBuffer(read); err != nil {
+			return err
+		}
+	}
+	if write > 0 {
+		if err := tcp.SetWriteBuffer(write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setKeepAlive enables TCP keepalive probes (SO_KEEPALIVE) on conn, sent
+// once the connection has been idle for idle and then every interval, so
+// a peer that vanished behind a NAT is noticed even while nothing is being
+// written. A zero idle leaves the socket's setting alone; a zero interval
+// uses the OS default. Connections that are not TCP are left alone.
+func setKeepAlive(conn net.Conn, idle, interval time.Duration) error {
+	tcp := tcpConn(conn)
+	if tcp == nil || idle <= 0 {
+		return nil
+	}
+	return tcp.SetKeepAliveConfig(net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     idle,
+		Interval: interval,
+	})
+}
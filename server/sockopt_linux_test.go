@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// keepAliveSettings reads back SO_KEEPALIVE, TCP_KEEPIDLE and
+// TCP_KEEPINTVL (in seconds) from conn.
+func keepAliveSettings(t *testing.T, conn net.Conn) (enabled bool, idle, interval int) {
+	t.Helper()
+	tcp := tcpConn(conn)
+	if tcp == nil {
+		t.Fatalf("Conn is %T, want a TCP connection", conn)
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		t.Fatal("SyscallConn error:", err)
+	}
+	var on int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if on, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); sockErr != nil {
+			return
+		}
+		if idle, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); sockErr != nil {
+			return
+		}
+		interval, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		t.Fatal("Getsockopt error:", err)
+	}
+	return on != 0, idle, interval
+}
+
+func TestUpgraderTCPKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen error:", err)
+	}
+	defer l.Close()
+
+	u := NewUpgrader()
+	u.TCPKeepAliveIdle = 42 * time.Second
+	u.TCPKeepAliveInterval = 7 * time.Second
+	accepted := make(chan net.Conn, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go u.Serve(l, func(c *Conn) error {
+		accepted <- c.conn
+		<-done
+		return nil
+	})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(rawHandshake + "\r\n")); err != nil {
+		t.Fatal("Write error:", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal("ReadResponse error:", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	enabled, idle, interval := keepAliveSettings(t, <-accepted)
+	if !enabled || idle != 42 || interval != 7 {
+		t.Errorf("Keepalive = enabled %v, idle %ds, interval %ds, want enabled, 42s, 7s", enabled, idle, interval)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestSetSocketBuffers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen error:", err)
+	}
+	defer l.Close()
+
+	u := NewUpgrader()
+	u.SocketReadBuffer = 64 << 10
+	u.SocketWriteBuffer = 64 << 10
+	go u.Serve(l, func(c *Conn) error {
+		if _, ok := c.conn.(*net.TCPConn); !ok {
+			t.Errorf("Conn is %T, want *net.TCPConn", c.conn)
+		}
+		if err := setSocketBuffers(c.conn, u.SocketReadBuffer, u.SocketWriteBuffer); err != nil {
+			t.Errorf("setSocketBuffers() error: %v", err)
+		}
+		return c.WriteMessage(OpText, []byte("tuned"))
+	})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(rawHandshake + "\r\n")); err != nil {
+		t.Fatal("Write error:", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal("ReadResponse error:", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	f, _, err := readFrame(br)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if string(f.Payload) != "tuned" {
+		t.Errorf("Payload = %q, want %q", f.Payload, "tuned")
+	}
+
+	// Connections that are not TCP are left alone.
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	if err := setSocketBuffers(server, 1024, 1024); err != nil {
+		t.Errorf("setSocketBuffers(pipe) error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// Defaults used by NewUpgrader.
+const (
+	DefaultMaxHeaderLineLength = 8 << 10
+	DefaultMaxHeaderCount      = 100
+	DefaultCloseGracePeriod    = time.Second
+	DefaultMaxHandshakeBody    = 4 << 10
+)
+
+// Upgrader holds everything that decides how handshakes are accepted and
+// how the resulting connections behave. Configure one, then mount the
+// handlers returned by its Handler method or call its Upgrade method
+// directly. Start from NewUpgrader rather than the zero value, and do not
+// modify an Upgrader while it is serving requests.
+type Upgrader struct {
+	// AllowedOrigins decides whether a handshake's Origin is acceptable.
+	AllowedOrigins *OriginMatcher
+
+	// Subprotocols lists the supported Sec-WebSocket-Protocol values in
+	// order of preference. The first one the client also offers is
+	// selected; if none match the handshake proceeds without one.
+	Subprotocols []string
+
+	// SubprotocolHandlers, if set, lets Handler route each connection by
+	// its negotiated subprotocol: the handler registered for it runs
+	// instead of the one passed to Handler, which remains the fallback
+	// for connections with any other subprotocol or none. Names still have
+	// to be listed in Subprotocols to be negotiated.
+	SubprotocolHandlers map[string]func(*Conn) error
+
+	// OriginPolicies restrict the subprotocols and extensions offered to
+	// particular origins. The first policy matching the request's Origin
+	// applies; origins matching none get everything configured here.
+	OriginPolicies []OriginPolicy
+
+	// WelcomeMessage, if non-nil, is sent to every client right after the
+	// handshake, as a WelcomeOpcode message (OpText if zero).
+	WelcomeMessage []byte
+	WelcomeOpcode  byte
+
+	// Extensions are the extensions Upgrade may negotiate, in pipeline
+	// order: they run in this order on outbound messages and in reverse
+	// order on inbound ones, so list compression before anything that
+	// should see compressed bytes (such as encryption). NewUpgrader
+	// includes permessage-deflate, which is only offered when
+	// EnableCompression is set.
+	Extensions []Extension
+
+	// EnableCompression accepts permessage-deflate (RFC 7692) when the
+	// client offers it. Messages shorter than CompressionThreshold bytes
+	// are still sent uncompressed.
+	EnableCompression    bool
+	CompressionThreshold int
+
+	// EnableHTTP2 accepts WebSocket over HTTP/2 (RFC 8441): an extended
+	// CONNECT request with ":protocol" set to "websocket". The frames are
+	// then carried on the HTTP/2 stream instead of a hijacked connection.
+	// Note that the Go HTTP/2 server only advertises extended CONNECT
+	// support when the process runs with GODEBUG=http2xconnect=1.
+	EnableHTTP2 bool
+
+	// Authenticate, if set, is called once the origin has been checked.
+	// Returning an error rejects the handshake with AuthFailureStatus;
+	// otherwise the returned identity is attached to the connection and
+	// available through Conn.Identity.
+	Authenticate      func(r *http.Request) (identity any, err error)
+	AuthFailureStatus int
+
+	// RateLimiter, if set, rejects handshakes from clients over their
+	// limit with 429 Too Many Requests. Clients are told apart by
+	// ClientIP, which honors X-Forwarded-For and X-Real-IP only from peers
+	// within TrustedProxies.
+	RateLimiter    *RateLimiter
+	TrustedProxies []netip.Prefix
+
+	// MaxFragments, MaxFrameSize, MaxMessageSize and BufferPool are
+	// copied to every new Conn.
+	MaxFragments   int
+	MaxFrameSize   int64
+	MaxMessageSize int64
+	BufferPool     BufferPool
+
+	// CloseGracePeriod bounds how long CloseGracefully waits for the peer
+	// to answer a close frame.
+	CloseGracePeriod time.Duration
+
+	// WriteTimeout and WriteThroughput are copied to every new Conn; see
+	// Conn.WriteTimeout.
+	WriteTimeout    time.Duration
+	WriteThroughput int64
+
+	// SocketReadBuffer and SocketWriteBuffer, if positive, set the kernel
+	// socket buffer sizes (SO_RCVBUF and SO_SNDBUF) of TCP connections.
+	// ServeRaw applies these and the keepalive settings below before
+	// reading the handshake; connections served through net/http get them
+	// once hijacked.
+	SocketReadBuffer  int
+	SocketWriteBuffer int
+
+	// TCPKeepAliveIdle, if positive, enables TCP keepalive probes on
+	// accepted connections, starting after that much idle time and
+	// repeated every TCPKeepAliveInterval (the OS default if zero). They
+	// detect dead peers at the socket level, independently of pings.
+	TCPKeepAliveIdle     time.Duration
+	TCPKeepAliveInterval time.Duration
+
+	// MaxHandshakeBody bounds the request body a handshake may carry.
+	// Such a body has no meaning and is discarded before the 101 is sent,
+	// which also answers clients waiting on Expect: 100-continue; a larger
+	// one is rejected with 413 Request Entity Too Large.
+	MaxHandshakeBody int64
+
+	// OnHandshakeComplete, if set, is called once every Upgrade finishes,
+	// successfully or not, with the time taken and the error if any. It
+	// can feed a handshake latency metric.
+	OnHandshakeComplete func(d time.Duration, err error)
+
+	// AccessLogFormat, unless AccessLogOff, makes Handler log one line per
+	// finished connection to AccessLogger, or the standard logger if nil.
+	// See AccessLogEntry for the fields.
+	AccessLogFormat AccessLogFormat
+	AccessLogger    *log.Logger
+
+	// Limits applied when reading a handshake request directly from a
+	// socket with ServeRaw. Requests served through net/http use its own
+	// limits.
+	MaxHeaderLineLength int
+	MaxHeaderCount      int
+}
+
+// NewUpgrader returns an Upgrader with the default settings: only the
+// http://localhost:8080 origin, no subprotocols, compression and HTTP/2
+// disabled.
+func NewUpgrader() *Upgrader {
+	return &Upgrader{
+		AllowedOrigins:       MustOriginMatcher("http://localhost:8080"),
+		Extensions:           []Extension{deflateExtension{}},
+		CompressionThreshold: DefaultCompressionThreshold,
+		AuthFailureStatus:    http.StatusUnauthorized,
+		MaxFragments:         DefaultMaxFragments,
+		MaxFrameSize:         DefaultMaxFrameSize,
+		MaxMessageSize:       DefaultMaxMessageSize,
+		CloseGracePeriod:     DefaultCloseGracePeriod,
+		MaxHandshakeBody:     DefaultMaxHandshakeBody,
+		MaxHeaderLineLength:  DefaultMaxHeaderLineLength,
+		MaxHeaderCount:       DefaultMaxHeaderCount,
+	}
+}
+
+// DefaultUpgrader is used by the package-level Upgrade, Handler, Serve,
+// ServeRaw and ServeConn functions.
+var DefaultUpgrader = NewUpgrader()
+
+// Upgrade upgrades r using DefaultUpgrader.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	return DefaultUpgrader.Upgrade(w, r)
+}
+
+// Handler returns DefaultUpgrader.Handler(fn).
+func Handler(fn func(*Conn) error) http.HandlerFunc {
+	return DefaultUpgrader.Handler(fn)
+}
+
+// Handler returns an http.HandlerFunc that upgrades each request and passes
+// the resulting connection to fn, or to the entry of SubprotocolHandlers
+// for its subprotocol if there is one. When fn returns nil the connection is
+// closed with 1000 (normal closure). When it returns an error the close
+// code comes from closeCodeFor: a *CloseError supplies its own code and
+// text, anything else is reported as 1011 (internal error). When mounted
+// on a pattern such as "/ws/{tenant}", the captured segments are available
+// through Conn.PathValue.
+func (u *Upgrader) Handler(fn func(*Conn) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		u.serve(r, c, fn)
+	}
+}
+
+// serve runs fn, or the SubprotocolHandlers entry for c's subprotocol, on
+// the connection upgraded from r, then closes it gracefully with the code
+// closeCodeFor derives from the result and logs the access. Handler,
+// ServeRaw and Serve all end connections this way.
+func (u *Upgrader) serve(r *http.Request, c *Conn, fn func(*Conn) error) {
+	start := time.Now()
+	defer c.Close()
+
+	handler := fn
+	if h, ok := u.SubprotocolHandlers[c.Subprotocol()]; ok {
+		handler = h
+	}
+	code, reason := closeCodeFor(handler(c))
+	// A peer that hangs up without a close frame is routine and not
+	// worth a log line.
+	if err := c.CloseGracefully(code, reason); err != nil && !errors.Is(err, ErrClosed) && !errors.Is(err, io.EOF) {
+		log.Println("Error closing connection:", err)
+	}
+	u.logAccess(r, c, start)
+}
+
+// closeCodeFor maps the error a handler returned to a close code and
+// reason. Reasons of other errors are not sent, since they may expose
+// internal details to the peer.
+func closeCodeFor(err error) (uint16, string) {
+	if err == nil {
+		return CloseNormalClosure, ""
+	}
+	var closeErr *CloseError
+	if errors.As(err, &closeErr) {
+		return closeErr.Code, closeErr.Text
+	}
+	return CloseInternalError, ""
+}
+
+// Upgrade performs the server side of the opening handshake and returns the
+// hijacked connection. On failure the HTTP error response has already been
+// written and the returned error describes why.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	start := time.Now()
+	c, err := u.upgrade(w, r)
+	u.handshakeDone(start, err)
+	return c, err
+}
+
+// handshakeDone reports a handshake begun at start to OnHandshakeComplete.
+func (u *Upgrader) handshakeDone(start time.Time, err error) {
+	if u.OnHandshakeComplete != nil {
+		u.OnHandshakeComplete(time.Since(start), err)
+	}
+}
+
+func (u *Upgrader) upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	hs, err := u.validate(w, r)
+	if err != nil {
+		return nil, err
+	}
+	return u.accept(w, r, hs)
+}
+
+// handshake is what validate learned about an acceptable request.
+type handshake struct {
+	http2    bool
+	identity any
+}
+
+// validate runs every check that can reject a handshake request: path,
+// method, rate limit, origin, authentication and the WebSocket headers. Nothing is
+// committed to the connection yet, so callers such as ProxyHandler can do
+// costly work between validate and accept. On failure the HTTP error
+// response has already been written.
+func (u *Upgrader) validate(w http.ResponseWriter, r *http.Request) (handshake, error) {
+	hs := handshake{http2: u.EnableHTTP2 && isExtendedConnect(r)}
+
+	if err := normalizePath(w, r); err != nil {
+		return hs, err
+	}
+
+	// RFC 6455 handshakes are GETs; RFC 8441 ones arrive as CONNECT.
+	if r.Method != http.MethodGet && !hs.http2 {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return hs, fmt.Errorf("Method not allowed: %s", r.Method)
+	}
+
+	if !u.rateLimit(w, r) {
+		return hs, fmt.Errorf("Rate limit exceeded for %s", u.ClientIP(r))
+	}
+
+	origin := r.Header.Get("Origin")
+	if !u.AllowedOrigins.Match(origin) {
+		log.Printf("Origin not allowed: %q from %s\n", origin, u.ClientIP(r))
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return hs, fmt.Errorf("Origin not allowed: %q", origin)
+	}
+
+	identity, err := u.authenticate(w, r)
+	if err != nil {
+		return hs, err
+	}
+	hs.identity = identity
+
+	if hs.http2 {
+		return hs, checkVersion(w, r)
+	}
+
+	// Upgrade is a token list; some clients offer other protocols too.
+	if !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Not a valid WebSocket handshake", http.StatusBadRequest)
+		return hs, fmt.Errorf("Not a valid WebSocket handshake")
+	}
+
+	if err := checkVersion(w, r); err != nil {
+		return hs, err
+	}
+
+	if r.Header.Get("Sec-WebSocket-Key") == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return hs, fmt.Errorf("Missing Sec-WebSocket-Key")
+	}
+	return hs, nil
+}
+
+// checkVersion rejects a handshake for any WebSocket version but 13.
+func checkVersion(w http.ResponseWriter, r *http.Request) error {
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		// Tell the client which version we speak so it can retry.
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "WebSocket version not supported", http.StatusUpgradeRequired)
+		return fmt.Errorf("WebSocket version not supported")
+	}
+	return nil
+}
+
+// accept completes a handshake validate has accepted and returns the
+// configured connection.
+func (u *Upgrader) accept(w http.ResponseWriter, r *http.Request, hs handshake) (*Conn, error) {
+	var c *Conn
+	var err error
+	if hs.http2 {
+		c, err = u.upgradeHTTP2(w, r)
+	} else {
+		c, err = u.upgradeHTTP1(w, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.identity = hs.identity
+	c.version, _ = strconv.Atoi(r.Header.Get("Sec-WebSocket-Version"))
+	u.configure(c)
+
+	if u.WelcomeMessage != nil {
+		opcode := u.WelcomeOpcode
+		if opcode == 0 {
+			opcode = OpText
+		}
+		if err := c.WriteMessage(opcode, u.WelcomeMessage); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("Error sending welcome message: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// configureSocket applies the Upgrader's socket options to conn. Failures
+// are logged but do not fail the connection.
+func (u *Upgrader) configureSocket(conn net.Conn) {
+	if err := setSocketBuffers(conn, u.SocketReadBuffer, u.SocketWriteBuffer); err != nil {
+		log.Println("Error setting socket buffers:", err)
+	}
+	if err := setKeepAlive(conn, u.TCPKeepAliveIdle, u.TCPKeepAliveInterval); err != nil {
+		log.Println("Error setting TCP keepalive:", err)
+	}
+}
+
+// configure copies the Upgrader's per-connection settings to c.
+func (u *Upgrader) configure(c *Conn) {
+	c.MaxFragments = u.MaxFragments
+	c.MaxFrameSize = u.MaxFrameSize
+	c.MaxMessageSize = u.MaxMessageSize
+	c.BufferPool = u.BufferPool
+	c.CompressionThreshold = u.CompressionThreshold
+	c.CloseGracePeriod = u.CloseGracePeriod
+	c.WriteTimeout = u.WriteTimeout
+	c.WriteThroughput = u.WriteThroughput
+}
+
+// discardBody reads and drops the body of a handshake request. Reading it
+// makes net/http, and ServeRaw, send 100 Continue if the client expects
+// one. On failure it returns the status to respond with.
+func (u *Upgrader) discardBody(r *http.Request) (int, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return 0, nil
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(r.Body, u.MaxHandshakeBody+1))
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("Error reading handshake body: %w", err)
+	}
+	if n > u.MaxHandshakeBody {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("Handshake body larger than %d bytes", u.MaxHandshakeBody)
+	}
+	return 0, nil
+}
+
+// writeUpgradeResponse writes the 101 response itself rather than through
+// net/http, which would canonicalize Sec-WebSocket-Accept to
+// Sec-Websocket-Accept and sort the headers. The handshake headers go
+// first, spelled and ordered as in RFC 6455 section 4.2.2, followed by any
+// others already set on the ResponseWriter.
+func writeUpgradeResponse(w *bufio.Writer, accept, subprotocol, extensions string, extra http.Header) error {
+	w.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	w.WriteString("Upgrade: websocket\r\n")
+	w.WriteString("Connection: Upgrade\r\n")
+	w.WriteString("Sec-WebSocket-Accept: " + accept + "\r\n")
+	if subprotocol != "" {
+		w.WriteString("Sec-WebSocket-Protocol: " + subprotocol + "\r\n")
+	}
+	if extensions != "" {
+		w.WriteString("Sec-WebSocket-Extensions: " + extensions + "\r\n")
+	}
+	if err := extra.Write(w); err != nil {
+		return err
+	}
+	w.WriteString("\r\n")
+	return w.Flush()
+}
+
+// upgradeHTTP1 completes an RFC 6455 handshake whose headers validate has
+// checked and hijacks the connection.
+func (u *Upgrader) upgradeHTTP1(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	secWebSocketKey := r.Header.Get("Sec-WebSocket-Key")
+
+	// Left unread, a body would be taken for the first frames.
+	if status, err := u.discardBody(r); err != nil {
+		http.Error(w, http.StatusText(status), status)
+		return nil, err
+	}
+
+	secWebSocketAccept := computeAcceptKey(secWebSocketKey)
+
+	exts, extensions := negotiateExtensions(r, u.extensions(r))
+	subprotocol := u.selectSubprotocol(r)
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("Hijacking not supported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, "Could not hijack connection: "+err.Error(), http.StatusInternalServerError)
+		return nil, fmt.Errorf("Could not hijack connection: %w", err)
+	}
+	if err := writeUpgradeResponse(rw.Writer, secWebSocketAccept, subprotocol, extensions, w.Header()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error writing handshake response: %w", err)
+	}
+	u.configureSocket(conn)
+	// rw.Reader may already hold frames the client sent right behind the
+	// request, so the Conn must read through it rather than from conn.
+	c := newConn(conn, rw, r)
+	c.setExtensions(exts)
+	c.subprotocol = subprotocol
+	return c, nil
+}
+
+// extensions returns the entries of u.Extensions this Upgrader may
+// negotiate for r, taking the origin's policy into account.
+func (u *Upgrader) extensions(r *http.Request) []Extension {
+	policy := u.policyFor(r.Header.Get("Origin"))
+	var exts []Extension
+	for _, ext := range u.Extensions {
+		if _, ok := ext.(deflateExtension); ok && !u.EnableCompression {
+			continue
+		}
+		if !policy.allowsExtension(ext.Name()) {
+			continue
+		}
+		exts = append(exts, ext)
+	}
+	return exts
+}
+
+// selectSubprotocol returns the first of u.Subprotocols that the client
+// offered and its origin's policy allows, or "" if there is none.
+func (u *Upgrader) selectSubprotocol(r *http.Request) string {
+	policy := u.policyFor(r.Header.Get("Origin"))
+	offered := headerValues(r.Header, "Sec-WebSocket-Protocol")
+	for _, supported := range u.Subprotocols {
+		if !policy.allowsSubprotocol(supported) {
+			continue
+		}
+		for _, p := range offered {
+			if p == supported {
+				return p
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpgraderCustomConfig(t *testing.T) {
+	u := NewUpgrader()
+	u.AllowedOrigins = MustOriginMatcher("https://*.example.com")
+	u.Subprotocols = []string{"chat.v2", "chat.v1"}
+	u.EnableCompression = true
+	u.MaxFragments = 7
+	u.CloseGracePeriod = 50 * time.Millisecond
+
+	type settings struct {
+		subprotocol  string
+		maxFragments int
+		grace        time.Duration
+	}
+	got := make(chan settings, 1)
+	srv := httptest.NewServer(u.Handler(func(c *Conn) error {
+		got <- settings{c.Subprotocol(), c.MaxFragments, c.CloseGracePeriod}
+		return nil
+	}))
+	defer srv.Close()
+
+	t.Run("Accepted", func(t *testing.T) {
+		resp, _ := dialTestServer(t, srv, "/ws", http.Header{
+			"Origin":                   {"https://app.example.com"},
+			"Sec-Websocket-Protocol":   {"chat.v1, chat.v2"},
+			"Sec-Websocket-Extensions": {"permessage-deflate"},
+		})
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+		}
+		if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != "chat.v2" {
+			t.Errorf("Sec-WebSocket-Protocol = %q, want %q", p, "chat.v2")
+		}
+		if e := resp.Header.Get("Sec-WebSocket-Extensions"); e == "" {
+			t.Error("permessage-deflate was not negotiated")
+		}
+
+		s := <-got
+		if s.subprotocol != "chat.v2" || s.maxFragments != 7 || s.grace != 50*time.Millisecond {
+			t.Errorf("Conn settings = %+v, want chat.v2, 7, 50ms", s)
+		}
+	})
+
+	t.Run("Default origin rejected", func(t *testing.T) {
+		resp, _ := dialTestServer(t, srv, "/ws", nil)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+		}
+	})
+}
+
+func TestUpgraderNoCommonSubprotocol(t *testing.T) {
+	u := NewUpgrader()
+	u.Subprotocols = []string{"chat.v2"}
+	srv := httptest.NewServer(u.Handler(func(c *Conn) error { return nil }))
+	defer srv.Close()
+
+	resp, _ := dialTestServer(t, srv, "/ws", http.Header{"Sec-Websocket-Protocol": {"mqtt"}})
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != "" {
+		t.Errorf("Sec-WebSocket-Protocol = %q, want none", p)
+	}
+}
+
+func TestUpgraderRepeatedSubprotocolHeader(t *testing.T) {
+	u := NewUpgrader()
+	u.Subprotocols = []string{"chat.v2", "chat.v1"}
+	srv := httptest.NewServer(u.Handler(func(c *Conn) error { return nil }))
+	defer srv.Close()
+
+	// The offer is split over two header lines, one of them a list.
+	resp, _ := dialTestServer(t, srv, "/ws", http.Header{"Sec-Websocket-Protocol": {"chat.v1", "mqtt, chat.v2"}})
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != "chat.v2" {
+		t.Errorf("Sec-WebSocket-Protocol = %q, want %q", p, "chat.v2")
+	}
+}
+
+func TestUpgraderUpgradeTokens(t *testing.T) {
+	srv := httptest.NewServer(NewUpgrader().Handler(func(c *Conn) error { return nil }))
+	defer srv.Close()
+
+	tests := []struct {
+		upgrade string
+		want    int
+	}{
+		{"websocket", http.StatusSwitchingProtocols},
+		{"WebSocket", http.StatusSwitchingProtocols},
+		{"websocket, foo", http.StatusSwitchingProtocols},
+		{"h2c, websocket", http.StatusSwitchingProtocols},
+		{"h2c", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.upgrade, func(t *testing.T) {
+			resp, _ := dialTestServer(t, srv, "/ws", http.Header{"Upgrade": {tt.upgrade}})
+			if resp.StatusCode != tt.want {
+				t.Errorf("Status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpgraderWelcomeMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message []byte
+		opcode  byte
+		want    Frame
+	}{
+		{"Text", []byte("Welcome"), 0, Frame{Opcode: OpText, Payload: []byte("Welcome")}},
+		{"Binary", []byte{0x01, 0x02}, OpBinary, Frame{Opcode: OpBinary, Payload: []byte{0x01, 0x02}}},
+		{"None", nil, 0, Frame{Opcode: OpClose}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := NewUpgrader()
+			u.WelcomeMessage = tt.message
+			u.WelcomeOpcode = tt.opcode
+			srv := httptest.NewServer(u.Handler(func(c *Conn) error { return nil }))
+			defer srv.Close()
+
+			resp, rw := dialTestServer(t, srv, "/ws", nil)
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+			}
+			// Without a welcome the handler's close frame comes first.
+			f, _, err := readFrame(rw.Reader)
+			if err != nil {
+				t.Fatal("readFrame() error:", err)
+			}
+			if f.Opcode != tt.want.Opcode || tt.want.Payload != nil && string(f.Payload) != string(tt.want.Payload) {
+				t.Errorf("First frame = %#x %v, want %#x %v", f.Opcode, f.Payload, tt.want.Opcode, tt.want.Payload)
+			}
+		})
+	}
+}
+
+func TestUpgraderHandshakeBody(t *testing.T) {
+	greet := func(c *Conn) error { return c.WriteMessage(OpText, []byte("hi")) }
+	srv := httptest.NewServer(NewUpgrader().Handler(greet))
+	defer srv.Close()
+
+	servers := []struct {
+		name string
+		dial func(t *testing.T) net.Conn
+	}{
+		{"net/http", func(t *testing.T) net.Conn {
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal("Dial error:", err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			return conn
+		}},
+		{"ServeRaw", func(t *testing.T) net.Conn {
+			server, client := net.Pipe()
+			t.Cleanup(func() { client.Close() })
+			go ServeRaw(server, greet)
+			return client
+		}},
+	}
+
+	// upgraded checks for the 101 and that the body was not taken for
+	// frames.
+	upgraded := func(t *testing.T, br *bufio.Reader) {
+		t.Helper()
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal("ReadResponse error:", err)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+		}
+		f, _, err := readFrame(br)
+		if err != nil {
+			t.Fatal("readFrame() error:", err)
+		}
+		if string(f.Payload) != "hi" {
+			t.Errorf("Payload = %q, want %q", f.Payload, "hi")
+		}
+	}
+
+	for _, s := range servers {
+		t.Run(s.name+"/Expect 100-continue", func(t *testing.T) {
+			conn := s.dial(t)
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			go conn.Write([]byte(rawHandshake + "Expect: 100-continue\r\nContent-Length: 5\r\n\r\n"))
+
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal("ReadResponse error:", err)
+			}
+			if resp.StatusCode != http.StatusContinue {
+				t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusContinue)
+			}
+			go conn.Write([]byte("hello"))
+			upgraded(t, br)
+		})
+
+		t.Run(s.name+"/Body", func(t *testing.T) {
+			conn := s.dial(t)
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			go conn.Write([]byte(rawHandshake + "Content-Length: 5\r\n\r\nhello"))
+			upgraded(t, bufio.NewReader(conn))
+		})
+
+		t.Run(s.name+"/Body too large", func(t *testing.T) {
+			conn := s.dial(t)
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			body := strings.Repeat("a", DefaultMaxHandshakeBody+1)
+			go conn.Write([]byte(rawHandshake + fmt.Sprintf("Content-Length: %d\r\n\r\n", len(body)) + body))
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal("ReadResponse error:", err)
+			}
+			if resp.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Errorf("Status = %d, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+			}
+		})
+	}
+}
+
+func TestUpgraderOnHandshakeComplete(t *testing.T) {
+	type result struct {
+		d   time.Duration
+		err error
+	}
+	results := make(chan result, 1)
+	u := NewUpgrader()
+	u.OnHandshakeComplete = func(d time.Duration, err error) {
+		results <- result{d, err}
+	}
+	srv := httptest.NewServer(u.Handler(func(c *Conn) error { return nil }))
+	defer srv.Close()
+
+	dialTestServer(t, srv, "/ws", nil)
+	if r := <-results; r.err != nil || r.d <= 0 {
+		t.Errorf("Successful handshake reported %v, %v, want a positive duration and no error", r.d, r.err)
+	}
+
+	dialTestServer(t, srv, "/ws", http.Header{"Sec-Websocket-Version": {"8"}})
+	if r := <-results; r.err == nil {
+		t.Error("Failed handshake reported no error")
+	}
+}
+
+func TestUpgraderVersion(t *testing.T) {
+	versions := make(chan int, 1)
+	srv := httptest.NewServer(NewUpgrader().Handler(func(c *Conn) error {
+		versions <- c.Version()
+		return nil
+	}))
+	defer srv.Close()
+
+	dialTestServer(t, srv, "/ws", nil)
+	if got := <-versions; got != 13 {
+		t.Errorf("Version() = %d, want 13", got)
+	}
+}
+
+func TestUpgraderPipelinedFrame(t *testing.T) {
+	srv := httptest.NewServer(NewUpgrader().Handler(func(c *Conn) error {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return err
+		}
+		return c.WriteMessage(msg.Opcode, msg.Data)
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The frame follows the handshake in the same write, so it sits in
+	// the buffer net/http read the request into when the connection is
+	// hijacked.
+	bw := bufio.NewWriter(conn)
+	bw.WriteString(rawHandshake + "\r\n")
+	writeFrame(bw, Frame{Fin: true, Opcode: OpText, Payload: []byte("early"), Masked: true})
+	if err := bw.Flush(); err != nil {
+		t.Fatal("Write error:", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal("ReadResponse error:", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	f, _, err := readFrame(br)
+	if err != nil {
+		t.Fatal("readFrame() error:", err)
+	}
+	if string(f.Payload) != "early" {
+		t.Errorf("Echo = %q, want %q", f.Payload, "early")
+	}
+}
+
+func TestUpgraderSubprotocolHandlers(t *testing.T) {
+	u := NewUpgrader()
+	u.Subprotocols = []string{"echo.v1", "upper.v1", "plain.v1"}
+	reply := func(transform func(string) string) func(*Conn) error {
+		return func(c *Conn) error {
+			return c.WriteMessage(OpText, []byte(transform("hello")))
+		}
+	}
+	u.SubprotocolHandlers = map[string]func(*Conn) error{
+		"echo.v1":  reply(func(s string) string { return s }),
+		"upper.v1": reply(strings.ToUpper),
+	}
+	srv := httptest.NewServer(u.Handler(reply(func(string) string { return "fallback" })))
+	defer srv.Close()
+
+	tests := []struct {
+		offer string
+		want  string
+	}{
+		{"echo.v1", "hello"},
+		{"upper.v1", "HELLO"},
+		{"plain.v1", "fallback"},
+		{"", "fallback"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.offer, func(t *testing.T) {
+			var header http.Header
+			if tt.offer != "" {
+				header = http.Header{"Sec-Websocket-Protocol": {tt.offer}}
+			}
+			resp, rw := dialTestServer(t, srv, "/ws", header)
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("Status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+			}
+			f, _, err := readFrame(rw.Reader)
+			if err != nil {
+				t.Fatal("readFrame() error:", err)
+			}
+			if string(f.Payload) != tt.want {
+				t.Errorf("Reply = %q, want %q", f.Payload, tt.want)
+			}
+		})
+	}
+}
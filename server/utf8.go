@@ -0,0 +1,48 @@
+package main
+
+import "unicode/utf8"
+
+// utf8Validator checks UTF-8 incrementally, so a text message can be
+// validated fragment by fragment. A multi-byte character split across
+// fragments is held back until the rest of it arrives.
+type utf8Validator struct {
+	pending [utf8.UTFMax]byte
+	n       int
+}
+
+// write validates the next chunk of the message and reports whether
+// everything seen so far is valid or a valid prefix.
+func (v *utf8Validator) write(p []byte) bool {
+	// Finish the character left over from the previous chunk.
+	for v.n > 0 && len(p) > 0 {
+		v.pending[v.n] = p[0]
+		v.n++
+		p = p[1:]
+		if utf8.FullRune(v.pending[:v.n]) {
+			if r, size := utf8.DecodeRune(v.pending[:v.n]); r == utf8.RuneError && size == 1 {
+				return false
+			}
+			v.n = 0
+		}
+	}
+	if len(p) == 0 {
+		return true
+	}
+
+	// Hold back an incomplete character at the end of p.
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				v.n = copy(v.pending[:], p[i:])
+				p = p[:i]
+			}
+			break
+		}
+	}
+	return utf8.Valid(p)
+}
+
+// complete reports whether the message did not end mid-character.
+func (v *utf8Validator) complete() bool {
+	return v.n == 0
+}
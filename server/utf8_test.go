@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestUTF8Validator(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		valid  bool
+	}{
+		{"ASCII", []string{"hello", " world"}, true},
+		{"Two-byte split", []string{"caf\xc3", "\xa9"}, true},
+		{"Four-byte split three ways", []string{"\xf0\x9f", "\x98", "\x80!"}, true},
+		{"Replacement character", []string{"\xef\xbf\xbd"}, true},
+		{"Invalid byte", []string{"ab\xff"}, false},
+		{"Bad continuation across split", []string{"caf\xc3", "e"}, false},
+		{"Truncated at end", []string{"caf\xc3"}, false},
+		{"Surrogate", []string{"\xed\xa0", "\x80"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v utf8Validator
+			valid := true
+			for _, chunk := range tt.chunks {
+				if !v.write([]byte(chunk)) {
+					valid = false
+					break
+				}
+			}
+			if valid {
+				valid = v.complete()
+			}
+			if valid != tt.valid {
+				t.Errorf("Valid = %v, want %v", valid, tt.valid)
+			}
+		})
+	}
+}
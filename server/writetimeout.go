@@ -0,0 +1,18 @@
+package main
+
+import "time"
+
+// armWriteDeadline sets the write deadline for sending n more bytes along
+// with whatever is already buffered, as described for Conn.WriteTimeout.
+// The caller holds writeMu.
+func (c *Conn) armWriteDeadline(n int) {
+	if c.WriteTimeout <= 0 {
+		return
+	}
+	d := c.WriteTimeout
+	if c.WriteThroughput > 0 {
+		pending := int64(c.rw.Writer.Buffered() + n)
+		d += time.Duration(pending * int64(time.Second) / c.WriteThroughput)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(d))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConnWriteTimeoutScales(t *testing.T) {
+	// The peer drains 1MB in 64KB chunks with a pause after each, taking
+	// well over the 20ms base timeout.
+	message := make([]byte, 1<<20)
+	slowPeer := func(r io.Reader) {
+		buf := make([]byte, 64<<10)
+		for {
+			if _, err := r.Read(buf); err != nil {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		throughput int64
+		wantErr    bool
+	}{
+		{"Fixed timeout", 0, true},
+		{"Scaled timeout", 1 << 20, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, peer := newTestConn(t)
+			c.WriteTimeout = 20 * time.Millisecond
+			c.WriteThroughput = tt.throughput
+			go slowPeer(peer.Reader)
+
+			err := c.WriteMessage(OpBinary, message)
+			if tt.wantErr {
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					t.Errorf("WriteMessage() error = %v, want a deadline error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("WriteMessage() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestConnWriteTimeoutDeadPeer(t *testing.T) {
+	c, _ := newTestConn(t)
+	c.WriteTimeout = 20 * time.Millisecond
+	c.WriteThroughput = 1 << 20
+
+	// Nobody reads, so even a small message fails soon after the base
+	// timeout.
+	start := time.Now()
+	if err := c.WriteMessage(OpText, []byte("hello")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("WriteMessage() error = %v, want a deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("WriteMessage() took %v to fail", elapsed)
+	}
+}